@@ -0,0 +1,171 @@
+// Package bsdiff applies patches in the formats produced by Android's bsdiff:
+// the classic BSDIFF40 format and the BSDF2 container, which picks the
+// compression of each of its three streams separately.
+package bsdiff
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	magicBSDIFF40 = "BSDIFF40"
+	magicBSDF2    = "BSDF2"
+
+	headerSize = 32
+
+	// Output allocated ahead of its data, the header size is not trusted
+	// beyond it
+	maxPrealloc = 64 << 20
+)
+
+// Stream compressions of a BSDF2 patch
+const (
+	compressionNone   = 0
+	compressionBZ2    = 1
+	compressionBrotli = 2
+)
+
+// ErrCorrupt is returned for malformed patches.
+var ErrCorrupt = errors.New("bsdiff: corrupt patch")
+
+// offtin decodes the 8 byte sign-magnitude little endian integers of the
+// patch header and control stream.
+func offtin(buf []byte) int64 {
+	y := int64(buf[7] & 0x7f)
+	for i := 6; i >= 0; i-- {
+		y = y<<8 | int64(buf[i])
+	}
+	if buf[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
+
+func newStream(compression byte, data []byte) (io.Reader, error) {
+	switch compression {
+	case compressionNone:
+		return bytes.NewReader(data), nil
+	case compressionBZ2:
+		return bzip2.NewReader(bytes.NewReader(data)), nil
+	case compressionBrotli:
+		return brotli.NewReader(bytes.NewReader(data)), nil
+	}
+	return nil, fmt.Errorf("%w: unknown stream compression %d", ErrCorrupt, compression)
+}
+
+// NewSize returns the size of the output of patch.
+func NewSize(patch []byte) (int64, error) {
+	if len(patch) < headerSize {
+		return 0, fmt.Errorf("%w: short header", ErrCorrupt)
+	}
+	new_size := offtin(patch[24:32])
+	if new_size < 0 || new_size > math.MaxInt {
+		return 0, fmt.Errorf("%w: bad new size %d", ErrCorrupt, new_size)
+	}
+	return new_size, nil
+}
+
+// appendFull appends n bytes of r to out, growing out as they are read
+// rather than by n up front.
+func appendFull(out []byte, r io.Reader, n int64) ([]byte, error) {
+	for n > 0 {
+		chunk := int(min(n, maxPrealloc))
+		out = slices.Grow(out, chunk)
+		read, err := io.ReadFull(r, out[len(out):len(out)+chunk])
+		out = out[:len(out)+read]
+		if err != nil {
+			return out, err
+		}
+		n -= int64(read)
+	}
+	return out, nil
+}
+
+// Patch applies patch to old and returns the new data.
+func Patch(old []byte, patch []byte) ([]byte, error) {
+	if len(patch) < headerSize {
+		return nil, fmt.Errorf("%w: short header", ErrCorrupt)
+	}
+
+	var compressions [3]byte
+	switch {
+	case string(patch[:8]) == magicBSDIFF40:
+		compressions = [3]byte{compressionBZ2, compressionBZ2, compressionBZ2}
+	case string(patch[:5]) == magicBSDF2:
+		copy(compressions[:], patch[5:8])
+	default:
+		return nil, fmt.Errorf("%w: bad magic %q", ErrCorrupt, patch[:8])
+	}
+
+	ctrl_len := offtin(patch[8:16])
+	diff_len := offtin(patch[16:24])
+	new_size := offtin(patch[24:32])
+	body := int64(len(patch) - headerSize)
+	if ctrl_len < 0 || diff_len < 0 || new_size < 0 || new_size > math.MaxInt || ctrl_len > body || diff_len > body-ctrl_len {
+		return nil, fmt.Errorf("%w: bad header lengths", ErrCorrupt)
+	}
+
+	blocks := [3][]byte{
+		patch[headerSize : headerSize+ctrl_len],
+		patch[headerSize+ctrl_len : headerSize+ctrl_len+diff_len],
+		patch[headerSize+ctrl_len+diff_len:],
+	}
+	var streams [3]io.Reader
+	for i := range streams {
+		s, err := newStream(compressions[i], blocks[i])
+		if err != nil {
+			return nil, err
+		}
+		streams[i] = s
+	}
+	ctrl, diff, extra := streams[0], streams[1], streams[2]
+
+	out := make([]byte, 0, min(new_size, maxPrealloc))
+	var ctrl_buf [24]byte
+	new_pos, old_pos := int64(0), int64(0)
+	for new_pos < new_size {
+		if _, err := io.ReadFull(ctrl, ctrl_buf[:]); err != nil {
+			return nil, fmt.Errorf("%w: control stream: %v", ErrCorrupt, err)
+		}
+		diff_size := offtin(ctrl_buf[0:8])
+		extra_size := offtin(ctrl_buf[8:16])
+		seek := offtin(ctrl_buf[16:24])
+
+		if diff_size < 0 || extra_size < 0 || diff_size > new_size-new_pos {
+			return nil, fmt.Errorf("%w: bad control entry at %d", ErrCorrupt, new_pos)
+		}
+
+		// Add the old data to the diff bytes, outside of old counts as zero
+		var err error
+		if out, err = appendFull(out, diff, diff_size); err != nil {
+			return nil, fmt.Errorf("%w: diff stream: %v", ErrCorrupt, err)
+		}
+		dst := out[new_pos:]
+		lo := max(old_pos, 0)
+		hi := min(old_pos+diff_size, int64(len(old)))
+		for i := lo; i < hi; i++ {
+			dst[i-old_pos] += old[i]
+		}
+		new_pos += diff_size
+		old_pos += diff_size
+
+		if extra_size > new_size-new_pos {
+			return nil, fmt.Errorf("%w: bad control entry at %d", ErrCorrupt, new_pos)
+		}
+		if out, err = appendFull(out, extra, extra_size); err != nil {
+			return nil, fmt.Errorf("%w: extra stream: %v", ErrCorrupt, err)
+		}
+		new_pos += extra_size
+		old_pos += seek
+	}
+
+	return out, nil
+}
@@ -0,0 +1,145 @@
+package bsdiff_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/affggh/payload_extract/bsdiff"
+	"github.com/andybalholm/brotli"
+)
+
+type control struct {
+	diff, extra, seek int64
+}
+
+func offtout(x int64) []byte {
+	buf := make([]byte, 8)
+	neg := x < 0
+	if neg {
+		x = -x
+	}
+	binary.LittleEndian.PutUint64(buf, uint64(x))
+	if neg {
+		buf[7] |= 0x80
+	}
+	return buf
+}
+
+// makePatch builds a BSDF2 patch turning old into new following ctrl, with
+// every stream compressed by compression (0 none, 2 brotli).
+func makePatch(old, new []byte, ctrl []control, compression byte) []byte {
+	var c, d, e bytes.Buffer
+	newPos, oldPos := int64(0), int64(0)
+	for _, entry := range ctrl {
+		c.Write(offtout(entry.diff))
+		c.Write(offtout(entry.extra))
+		c.Write(offtout(entry.seek))
+		for i := int64(0); i < entry.diff; i++ {
+			var o byte
+			if p := oldPos + i; p >= 0 && p < int64(len(old)) {
+				o = old[p]
+			}
+			d.WriteByte(new[newPos+i] - o)
+		}
+		newPos += entry.diff
+		oldPos += entry.diff
+		e.Write(new[newPos : newPos+entry.extra])
+		newPos += entry.extra
+		oldPos += entry.seek
+	}
+
+	compress := func(b []byte) []byte {
+		if compression == 0 {
+			return b
+		}
+		var out bytes.Buffer
+		w := brotli.NewWriter(&out)
+		w.Write(b)
+		w.Close()
+		return out.Bytes()
+	}
+	blocks := [][]byte{compress(c.Bytes()), compress(d.Bytes()), compress(e.Bytes())}
+
+	var patch bytes.Buffer
+	patch.WriteString("BSDF2")
+	patch.Write([]byte{compression, compression, compression})
+	patch.Write(offtout(int64(len(blocks[0]))))
+	patch.Write(offtout(int64(len(blocks[1]))))
+	patch.Write(offtout(int64(len(new))))
+	for _, b := range blocks {
+		patch.Write(b)
+	}
+	return patch.Bytes()
+}
+
+func TestPatch(t *testing.T) {
+	old := make([]byte, 1000)
+	for i := range old {
+		old[i] = byte(i * 13)
+	}
+	new := append([]byte{}, old[500:900]...)
+	for i := 0; i < len(new); i += 17 {
+		new[i]++
+	}
+	new = append(new, []byte("inserted bytes")...)
+	new = append(new, old[0:300]...)
+	// Reads past the end of old
+	new = append(new, old[950:]...)
+	new = append(new, 1, 2, 3)
+
+	ctrl := []control{
+		{diff: 400, extra: 14, seek: -900},
+		{diff: 300, extra: 0, seek: 650},
+		{diff: 53, extra: 0, seek: 0},
+	}
+
+	for _, compression := range []byte{0, 2} {
+		patch := makePatch(old, new, ctrl, compression)
+
+		if size, err := bsdiff.NewSize(patch); err != nil || size != int64(len(new)) {
+			t.Errorf("NewSize = %d, %v, want %d", size, err, len(new))
+		}
+
+		got, err := bsdiff.Patch(old, patch)
+		if err != nil {
+			t.Fatalf("compression %d: %v", compression, err)
+		}
+		if !bytes.Equal(got, new) {
+			t.Errorf("compression %d: patched data differs", compression)
+		}
+	}
+}
+
+func TestPatchCorrupt(t *testing.T) {
+	old := []byte("old data")
+	new := []byte("new data!")
+	patch := makePatch(old, new, []control{{diff: 8, extra: 1}}, 0)
+
+	small := append([]byte{}, patch...)
+	copy(small[24:32], []byte{5, 0, 0, 0, 0, 0, 0, 0})
+	huge := append([]byte{}, patch...)
+	copy(huge[24:32], offtout(1<<50))
+	negative := append([]byte{}, patch...)
+	copy(negative[24:32], offtout(-5))
+
+	cases := map[string][]byte{
+		"short":     patch[:20],
+		"magic":     append([]byte("BSDIFF41"), patch[8:]...),
+		"truncated": patch[:len(patch)-1],
+		// control entry writing past new_size
+		"overflow": small,
+		// new_size far past the data, allocated as the data comes
+		"huge":     huge,
+		"negative": negative,
+	}
+	for name, p := range cases {
+		if _, err := bsdiff.Patch(old, p); !errors.Is(err, bsdiff.ErrCorrupt) {
+			t.Errorf("%s: err = %v, want ErrCorrupt", name, err)
+		}
+	}
+	if _, err := bsdiff.NewSize(negative); !errors.Is(err, bsdiff.ErrCorrupt) {
+		t.Errorf("NewSize err = %v, want ErrCorrupt", err)
+	}
+}
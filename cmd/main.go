@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 
 	payload_extract "github.com/affggh/payload_extract"
 )
@@ -25,6 +31,7 @@ const (
 	TYPE_BIN payload_type = iota
 	TYPE_ZIP
 	TYPE_URL
+	TYPE_STDIN
 )
 
 const Version = "Unknow-dirty"
@@ -37,6 +44,26 @@ type config struct {
 	act         action
 	_type       payload_type
 	showVersion bool
+	progress    string
+	noDataHash  bool
+	verify      bool
+	pubkeys     []string
+	sourceDir   string
+	punchHoles  bool
+	sparse      bool
+	format      string
+	simgMaxSize int64
+	simgCRC     bool
+	superSize   int64
+	superSlots  int
+	devices     string
+	directIO    bool
+	tar         bool
+	codec       string
+	codecLevel  int
+	zstdFrame   int
+	zipIndex    string
+	zipInterval int64
 }
 
 func main() {
@@ -49,18 +76,41 @@ func main() {
 		showVersion: false,
 	}
 
-	flag.StringVar(&cfg.input, "i", "", "input payload bin/zip/url")
+	flag.StringVar(&cfg.input, "i", "", "input payload bin/zip/url, - for a bin/zip stream on stdin")
 	flag.StringVar(&cfg.outdir, "o", "out", "output directory")
 	flag.Func("X", "extract partitions", func(s string) error {
 		cfg.partitions = strings.Split(s, ",")
 		return nil
 	})
 	flag.IntVar(&cfg.workers, "T", 12, "thread pool workers")
+	flag.StringVar(&cfg.sourceDir, "source", "", "directory of <partition>.img from the previous build, for delta payloads (ZUCCHINI: raw elements only)")
 	flag.BoolFunc("P", "do not extract, print partitions info", func(s string) error {
 		cfg.act = ACTION_SHOW_PARTITION_INFO
 		return nil
 	})
 	flag.BoolVar(&cfg.showVersion, "v", false, "print version and exit")
+	flag.Func("pubkey", "verify payload signatures with PEM public key or X.509 certificate (repeatable)", func(s string) error {
+		cfg.pubkeys = append(cfg.pubkeys, s)
+		return nil
+	})
+	flag.BoolVar(&cfg.verify, "verify", false, "verify extracted images against the manifest size and hash")
+	flag.BoolVar(&cfg.noDataHash, "no-data-hash", false, "do not verify operation data hashes (faster)")
+	flag.BoolVar(&cfg.punchHoles, "punch-holes", false, "punch holes for zeroed blocks instead of writing zeros (sparse output)")
+	flag.BoolVar(&cfg.sparse, "sparse", false, "leave all-zero blocks as holes in the output images")
+	flag.StringVar(&cfg.format, "format", "raw", "output image format: raw or simg (Android sparse image)")
+	flag.Int64Var(&cfg.simgMaxSize, "simg-max-size", 0, "split sparse images into <name>.img.N files of at most this many bytes, 0 for no split")
+	flag.BoolVar(&cfg.simgCRC, "simg-crc", false, "add a CRC32 chunk to sparse images")
+	flag.Int64Var(&cfg.superSize, "super-size", 0, "write the dynamic partitions into a super.img of this size in bytes")
+	flag.IntVar(&cfg.superSlots, "super-slots", 2, "metadata slots of super.img")
+	flag.StringVar(&cfg.devices, "devices", "", "file of name=/dev/path lines, write those partitions to block devices")
+	flag.BoolVar(&cfg.directIO, "direct", false, "open block devices with O_DIRECT")
+	flag.BoolVar(&cfg.tar, "tar", false, "write the images as a tar stream to stdout instead of the output directory")
+	flag.StringVar(&cfg.codec, "codec", "none", "compress images: none, zst (seekable zstd), xz or gz")
+	flag.IntVar(&cfg.codecLevel, "codec-level", 0, "compression level, 0 for the codec default")
+	flag.IntVar(&cfg.zstdFrame, "zstd-frame", 0, "uncompressed size of seekable zstd frames in bytes, 0 for 2MiB")
+	flag.StringVar(&cfg.zipIndex, "zip-index", "", "index file of a deflated payload.bin in a zip, loaded if present and saved after extracting")
+	flag.Int64Var(&cfg.zipInterval, "zip-index-interval", 4, "MiB of payload between the checkpoints of deflated payload.bin indexes")
+	flag.StringVar(&cfg.progress, "progress", "bar", "progress output: bar, json (newline delimited on stdout) or none")
 
 	flag.Parse()
 
@@ -72,9 +122,14 @@ func main() {
 	if len(cfg.input) == 0 {
 		log.Fatalln("Must spec input file!")
 	}
+	if cfg.zipInterval <= 0 {
+		log.Fatalln("-zip-index-interval must be positive")
+	}
 
 	// Detect input type
-	if strings.HasPrefix(cfg.input, "http://") || strings.HasPrefix(cfg.input, "https://") {
+	if cfg.input == "-" {
+		cfg._type = TYPE_STDIN
+	} else if strings.HasPrefix(cfg.input, "http://") || strings.HasPrefix(cfg.input, "https://") {
 		cfg._type = TYPE_URL
 	} else {
 		fd, err := os.Open(cfg.input)
@@ -96,19 +151,33 @@ func main() {
 		fd.Close()
 	}
 
+	// Cancel extraction on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Adjust reader
-	var reader io.ReadSeekCloser
+	var reader interface {
+		io.ReaderAt
+		io.Closer
+	}
+	var size int64
 	var err error
+	var payload *payload_extract.Payload
+	var zipreader *payload_extract.ZipPayloadReader
 
 	switch cfg._type {
 	case TYPE_URL:
-		urlreder := payload_extract.NewUrlRangeReaderAt(cfg.input)
+		urlreder, err := payload_extract.NewUrlRangeReaderAtContext(ctx, cfg.input)
+		if err != nil {
+			log.Fatalln(err)
+		}
 		defer urlreder.Close()
 
-		reader, err = payload_extract.NewZipPayloadReader(urlreder, urlreder.Size())
+		zipreader, err = payload_extract.NewZipPayloadReader(urlreder, urlreder.Size())
 		if err != nil {
 			log.Fatalln(err)
 		}
+		reader, size = zipreader, zipreader.Size()
 	case TYPE_ZIP:
 		fd, err := os.Open(cfg.input)
 		if err != nil {
@@ -116,13 +185,33 @@ func main() {
 		}
 		defer fd.Close()
 
-		size, _ := fd.Seek(0, io.SeekEnd)
-		reader, err = payload_extract.NewZipPayloadReader(fd, size)
+		fdsize, _ := fd.Seek(0, io.SeekEnd)
+		zipreader, err = payload_extract.NewZipPayloadReader(fd, fdsize)
 		if err != nil {
 			log.Fatalln(err)
 		}
+		reader, size = zipreader, zipreader.Size()
 	case TYPE_BIN:
-		reader, err = os.Open(cfg.input)
+		fd, err := os.Open(cfg.input)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		size, _ = fd.Seek(0, io.SeekEnd)
+		reader = fd
+	case TYPE_STDIN:
+		if len(cfg.pubkeys) != 0 {
+			log.Fatalln("-pubkey needs a seekable input")
+		}
+
+		stream := bufio.NewReaderSize(os.Stdin, 1<<20)
+		var input io.Reader = stream
+		if magic, _ := stream.Peek(4); bytes.Equal(magic, []byte("PK\x03\x04")) {
+			input, err = payload_extract.NewZipStreamPayloadReader(stream)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+		payload, err = payload_extract.OpenStream(input)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -130,19 +219,226 @@ func main() {
 		log.Fatalln("Unsupported input type")
 
 	}
-	defer reader.Close()
+	if zipreader != nil && zipreader.Deflated() {
+		zipreader.SetIndexInterval(cfg.zipInterval << 20)
+		if len(cfg.zipIndex) != 0 {
+			loadZipIndex(zipreader, cfg.zipIndex)
+		}
+	}
+	if reader != nil {
+		defer reader.Close()
+
+		payload, err = payload_extract.Open(reader, size)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if len(cfg.pubkeys) != 0 {
+		var keys []crypto.PublicKey
+		for _, name := range cfg.pubkeys {
+			k, err := payload_extract.LoadPublicKeysFile(name)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			keys = append(keys, k...)
+		}
+
+		fmt.Println("Signature Verify:")
+		metadata := payload.VerifyMetadataSignature(keys)
+		payload_extract.PrintSignatureResult("Metadata", metadata)
+		whole := payload.VerifyPayloadSignature(ctx, keys)
+		payload_extract.PrintSignatureResult("Payload", whole)
+		if metadata.Err != nil || whole.Err != nil {
+			log.Fatalln("Signature verification failed")
+		}
+	}
 
 	// Do payload action
 	switch cfg.act {
 	case ACTION_EXTRACT_PARTITION:
-		payload_extract.ExtractPartitionsFromPayload(reader, cfg.partitions, cfg.outdir, cfg.workers)
-	case ACTION_SHOW_PARTITION_INFO:
-		manifest, err := payload_extract.InitPayloadInfo(reader)
+		var progress payload_extract.ProgressReporter
+		switch cfg.progress {
+		case "bar":
+			progress = payload_extract.NewTerminalProgress(os.Stderr)
+		case "json":
+			if cfg.tar {
+				log.Fatalln("-progress json writes to stdout, which -tar uses")
+			}
+			progress = payload_extract.NewJSONProgress(os.Stdout)
+		case "none":
+			progress = payload_extract.NopProgress{}
+		default:
+			log.Fatalln("Unsupported progress output:", cfg.progress)
+		}
+
+		// Messages go to stderr when stdout carries the tar stream
+		messages := os.Stdout
+		if cfg.tar {
+			messages = os.Stderr
+		}
+		if cfg.progress == "bar" {
+			fmt.Fprintln(messages, "Processing with threads:", cfg.workers)
+		}
+		var format payload_extract.OutputFormat
+		switch cfg.format {
+		case "raw":
+			format = payload_extract.FormatRaw
+		case "simg":
+			format = payload_extract.FormatSparseImage
+			if cfg.verify {
+				log.Fatalln("-verify needs raw images")
+			}
+		default:
+			log.Fatalln("Unsupported output format:", cfg.format)
+		}
+
+		var codec payload_extract.Codec
+		switch cfg.codec {
+		case "none":
+			codec = payload_extract.CodecNone
+		case "zst":
+			codec = payload_extract.CodecZstd
+		case "xz":
+			codec = payload_extract.CodecXz
+		case "gz":
+			codec = payload_extract.CodecGzip
+		default:
+			log.Fatalln("Unsupported codec:", cfg.codec)
+		}
+		if codec != payload_extract.CodecNone && cfg.verify {
+			log.Fatalln("-verify needs uncompressed images")
+		}
+		if cfg.superSize != 0 && cfg.verify {
+			log.Fatalln("-verify needs <name>.img files, not a super.img")
+		}
+		if len(cfg.devices) != 0 && cfg.verify {
+			log.Fatalln("-verify needs <name>.img files, not block devices")
+		}
+		if cfg.tar && cfg.verify {
+			log.Fatalln("-verify needs <name>.img files, not a tar stream")
+		}
+
+		var devices map[string]string
+		if len(cfg.devices) != 0 {
+			fd, err := os.Open(cfg.devices)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			devices, err = payload_extract.ParseDeviceMap(fd)
+			fd.Close()
+			if err != nil {
+				log.Fatalln(cfg.devices+":", err)
+			}
+		}
+
+		var source payload_extract.SourceProvider
+		if len(cfg.sourceDir) != 0 {
+			dirsource := payload_extract.NewDirSource(cfg.sourceDir)
+			defer dirsource.Close()
+			source = dirsource
+		}
+
+		opts := payload_extract.ExtractOptions{
+			Partitions:         cfg.partitions,
+			OutDir:             cfg.outdir,
+			Workers:            cfg.workers,
+			Progress:           progress,
+			SkipDataHash:       cfg.noDataHash,
+			Source:             source,
+			PunchHoles:         cfg.punchHoles,
+			Sparse:             cfg.sparse,
+			Format:             format,
+			SimgMaxSize:        cfg.simgMaxSize,
+			SimgCRC:            cfg.simgCRC,
+			SuperSize:          cfg.superSize,
+			SuperMetadataSlots: cfg.superSlots,
+			Devices:            devices,
+			DirectIO:           cfg.directIO,
+			Codec:              codec,
+			CodecLevel:         cfg.codecLevel,
+			ZstdFrameSize:      cfg.zstdFrame,
+		}
+		if cfg.tar {
+			out := bufio.NewWriterSize(os.Stdout, 1<<20)
+			err := payload.ExtractTar(ctx, out, opts)
+			if err == nil {
+				err = out.Flush()
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if cfg.progress == "bar" {
+				fmt.Fprintln(messages, "Done!")
+			}
+			break
+		}
+
+		err := payload.Extract(ctx, opts)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		payload_extract.PrintPartitionsInfo(manifest, cfg.partitions)
+		if cfg.progress == "bar" {
+			fmt.Println("Done!")
+		}
+		if cfg.sparse && format == payload_extract.FormatRaw && cfg.progress != "json" {
+			payload_extract.PrintDiskUsage(cfg.outdir, payload.Partitions(cfg.partitions))
+		}
+		if codec != payload_extract.CodecNone && cfg.progress != "json" {
+			payload.PrintCompressionReport(cfg.outdir, cfg.partitions, codec)
+		}
+
+		if cfg.verify {
+			results, err := payload.VerifyImages(ctx, cfg.outdir, cfg.partitions)
+			payload_extract.PrintVerifyResults(results)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+	case ACTION_SHOW_PARTITION_INFO:
+		payload_extract.PrintPartitionsInfo(payload.Manifest(), cfg.partitions)
 	default:
 		log.Fatalln("Unsupport action")
 	}
+
+	if zipreader != nil && zipreader.Deflated() && len(cfg.zipIndex) != 0 {
+		if err := saveZipIndex(zipreader, cfg.zipIndex); err != nil {
+			log.Println("Saving zip index:", err)
+		}
+	}
+}
+
+// loadZipIndex loads the index of zipreader from name if it exists, starting
+// over on stale or broken ones.
+func loadZipIndex(zipreader *payload_extract.ZipPayloadReader, name string) {
+	fd, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = zipreader.LoadIndex(bufio.NewReader(fd))
+		fd.Close()
+	}
+	if err != nil {
+		log.Println("Ignoring zip index", name+":", err)
+	}
+}
+
+func saveZipIndex(zipreader *payload_extract.ZipPayloadReader, name string) error {
+	fd, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	err = fd.Chmod(0644)
+	if err == nil {
+		err = zipreader.SaveIndex(fd)
+	}
+	if close_err := fd.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fd.Name(), name)
 }
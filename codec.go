@@ -0,0 +1,269 @@
+package payload_extract_go
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/DataDog/zstd"
+	"github.com/affggh/payload_extract/update_engine"
+	"github.com/panjf2000/ants/v2"
+	xz "github.com/remyoudompheng/go-liblzma"
+)
+
+// Codec selects the compression of extracted images.
+type Codec int
+
+const (
+	// CodecNone writes uncompressed images.
+	CodecNone Codec = iota
+	// CodecZstd writes seekable zstd images, <name>.img.zst.
+	CodecZstd
+	// CodecXz writes <name>.img.xz.
+	CodecXz
+	// CodecGzip writes <name>.img.gz.
+	CodecGzip
+)
+
+// Extension returns the file name extension of images compressed with c.
+func (c Codec) Extension() string {
+	switch c {
+	case CodecZstd:
+		return ".zst"
+	case CodecXz:
+		return ".xz"
+	case CodecGzip:
+		return ".gz"
+	}
+	return ""
+}
+
+// Default uncompressed size of the frames of seekable zstd images
+const defaultZstdFrameSize = 2 << 20
+
+// newCompressor returns a writer compressing to w with codec at level, the
+// codec default if 0. Zstd frames of frame_size bytes are compressed by up to
+// workers goroutines.
+func newCompressor(w io.Writer, codec Codec, level int, frame_size int, workers int) (io.WriteCloser, error) {
+	switch codec {
+	case CodecZstd:
+		if level == 0 {
+			level = zstd.DefaultCompression
+		}
+		if frame_size <= 0 {
+			frame_size = defaultZstdFrameSize
+		}
+		return newSeekableZstdWriter(w, level, frame_size, workers), nil
+	case CodecXz:
+		preset := xz.LevelDefault
+		if level != 0 {
+			preset = xz.Preset(level)
+		}
+		return xz.NewWriter(w, preset)
+	case CodecGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+	return nil, fmt.Errorf("unsupported codec %d", codec)
+}
+
+// The zstd seekable format, see zstd's contrib/seekable_format: independent
+// frames followed by a skippable frame holding the compressed and
+// decompressed size of each frame.
+const (
+	zstdSkippableMagic = 0x184d2a5e
+	zstdSeekableMagic  = 0x8f92eab1
+	zstdSeekFooterSize = 9
+)
+
+type zstdFrame struct {
+	data []byte
+	size int // decompressed
+	err  error
+}
+
+// seekableZstdWriter compresses fixed size frames concurrently and writes
+// them in order, ending with the seek table on Close.
+type seekableZstdWriter struct {
+	w          io.Writer
+	level      int
+	frame_size int
+	buf        []byte
+
+	queue chan chan zstdFrame // frames being compressed, in order
+	done  chan struct{}       // closed once the queue is drained
+
+	mu    sync.Mutex
+	err   error
+	table []byte // seek table entries
+}
+
+func newSeekableZstdWriter(w io.Writer, level, frame_size, workers int) *seekableZstdWriter {
+	z := &seekableZstdWriter{
+		w:          w,
+		level:      level,
+		frame_size: frame_size,
+		queue:      make(chan chan zstdFrame, max(workers, 1)),
+		done:       make(chan struct{}),
+	}
+	go z.writeFrames()
+	return z
+}
+
+func (z *seekableZstdWriter) writeFrames() {
+	defer close(z.done)
+	for result := range z.queue {
+		frame := <-result
+		z.mu.Lock()
+		failed := z.err != nil
+		z.mu.Unlock()
+		if failed {
+			continue // drain
+		}
+
+		err := frame.err
+		if err == nil {
+			_, err = z.w.Write(frame.data)
+		}
+
+		z.mu.Lock()
+		if err != nil {
+			z.err = err
+		} else {
+			z.table = binary.LittleEndian.AppendUint32(z.table, uint32(len(frame.data)))
+			z.table = binary.LittleEndian.AppendUint32(z.table, uint32(frame.size))
+		}
+		z.mu.Unlock()
+	}
+}
+
+func (z *seekableZstdWriter) failed() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
+
+// flushFrame queues the buffered data for compression.
+func (z *seekableZstdWriter) flushFrame() {
+	src := z.buf
+	z.buf = nil
+	result := make(chan zstdFrame, 1)
+	z.queue <- result
+	go func() {
+		data, err := zstd.CompressLevel(nil, src, z.level)
+		result <- zstdFrame{data: data, size: len(src), err: err}
+	}()
+}
+
+func (z *seekableZstdWriter) Write(p []byte) (int, error) {
+	if err := z.failed(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) {
+		if z.buf == nil {
+			z.buf = make([]byte, 0, z.frame_size)
+		}
+		chunk := min(len(p)-n, z.frame_size-len(z.buf))
+		z.buf = append(z.buf, p[n:n+chunk]...)
+		n += chunk
+		if len(z.buf) == z.frame_size {
+			z.flushFrame()
+		}
+	}
+	return n, nil
+}
+
+// Close compresses the last frame and writes the seek table. It does not
+// close the underlying writer.
+func (z *seekableZstdWriter) Close() error {
+	if len(z.buf) > 0 {
+		z.flushFrame()
+	}
+	close(z.queue)
+	<-z.done
+	if err := z.failed(); err != nil {
+		return err
+	}
+
+	frames := len(z.table) / 8
+	seek_table := binary.LittleEndian.AppendUint32(nil, zstdSkippableMagic)
+	seek_table = binary.LittleEndian.AppendUint32(seek_table, uint32(len(z.table)+zstdSeekFooterSize))
+	seek_table = append(seek_table, z.table...)
+	seek_table = binary.LittleEndian.AppendUint32(seek_table, uint32(frames))
+	seek_table = append(seek_table, 0) // descriptor, no checksums
+	seek_table = binary.LittleEndian.AppendUint32(seek_table, zstdSeekableMagic)
+	_, err := z.w.Write(seek_table)
+	return err
+}
+
+// extractCompressed streams partition p into out_path compressed with
+// opts.Codec.
+func (payload *Payload) extractCompressed(
+	ctx context.Context,
+	p *update_engine.PartitionUpdate,
+	opts ExtractOptions,
+	out_path string,
+	source io.ReaderAt,
+	progress ProgressReporter,
+	pool *ants.Pool,
+) error {
+	fd, err := os.Create(out_path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	compressor, err := newCompressor(fd, opts.Codec, opts.CodecLevel, opts.ZstdFrameSize, opts.Workers)
+	if err != nil {
+		return err
+	}
+
+	block_size := payload.BlockSize()
+	err = streamPartition(ctx, compressor, payload, block_size, p, imageSize(p, block_size), source, !opts.SkipDataHash, progress, pool, 2*max(opts.Workers, 1))
+	// Close in any case, it stops the zstd frame writer
+	if close_err := compressor.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// PrintCompressionReport prints the image and compressed sizes of the images
+// of partitions_name (every partition if empty) in out_dir, and their totals.
+func (payload *Payload) PrintCompressionReport(out_dir string, partitions_name []string, codec Codec) {
+	fmt.Println("Compression Report:")
+	fmt.Println("\t\t", "PartitionName", "Size", "Compressed", "Ratio")
+	var total_size, total_compressed int64
+	row := func(name string, size, compressed int64) {
+		ratio := 0.0
+		if size != 0 {
+			ratio = 100 * float64(compressed) / float64(size)
+		}
+		fmt.Printf("\t\t %-14s%-12d%-12d%.1f%%\n", name, size, compressed, ratio)
+	}
+	for _, p := range payload.Partitions(partitions_name) {
+		info, err := os.Stat(path.Join(out_dir, p.GetPartitionName()+".img"+codec.Extension()))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Printf("\t\t %-14s%v\n", p.GetPartitionName(), err)
+			}
+			continue
+		}
+		size := imageSize(p, payload.BlockSize())
+		total_size += size
+		total_compressed += info.Size()
+		row(p.GetPartitionName(), size, info.Size())
+	}
+	row("total", total_size, total_compressed)
+}
@@ -0,0 +1,129 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DataDog/zstd"
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
+	xz "github.com/remyoudompheng/go-liblzma"
+)
+
+// readSeekableZstd decompresses a seekable zstd image frame by frame through
+// its seek table.
+func readSeekableZstd(t *testing.T, data []byte) (image []byte, frames int) {
+	t.Helper()
+	footer := data[len(data)-9:]
+	if binary.LittleEndian.Uint32(footer[5:]) != 0x8f92eab1 || footer[4] != 0 {
+		t.Fatalf("seek table footer % x", footer)
+	}
+	frames = int(binary.LittleEndian.Uint32(footer))
+	table_start := len(data) - 9 - 8*frames
+	if binary.LittleEndian.Uint32(data[table_start-8:]) != 0x184d2a5e ||
+		binary.LittleEndian.Uint32(data[table_start-4:]) != uint32(8*frames+9) {
+		t.Fatal("bad seek table frame header")
+	}
+
+	offset := 0
+	for i := 0; i < frames; i++ {
+		entry := data[table_start+8*i:]
+		compressed := int(binary.LittleEndian.Uint32(entry))
+		size := int(binary.LittleEndian.Uint32(entry[4:]))
+		frame, err := zstd.Decompress(nil, data[offset:offset+compressed])
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if len(frame) != size {
+			t.Fatalf("frame %d: %d bytes, seek table says %d", i, len(frame), size)
+		}
+		image = append(image, frame...)
+		offset += compressed
+	}
+	if offset != table_start-8 {
+		t.Fatalf("frames end at %d, seek table at %d", offset, table_start-8)
+	}
+	return image, frames
+}
+
+func TestExtractCompressed(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 10, 1)
+	clear(boot[4*bs : 6*bs])
+	vendor := testImage(bs, 32, 2)
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[6*bs:], ext(6, 4))
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:4*bs], ext(0, 4))
+	tp.addOp(part, update_engine.InstallOperation_ZERO, nil, ext(4, 1))
+	tp.addImageOps(tp.addPartition("vendor", vendor), vendor, 5)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{"boot": boot, "vendor": vendor}
+	for _, codec := range []payload_extract.Codec{payload_extract.CodecZstd, payload_extract.CodecXz, payload_extract.CodecGzip} {
+		opts := payload_extract.ExtractOptions{
+			OutDir:  t.TempDir(),
+			Workers: 3,
+			Codec:   codec,
+			// Frames ending within blocks
+			ZstdFrameSize: 3*bs + 100,
+		}
+		if err := payload.Extract(context.Background(), opts); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, image := range want {
+			file := filepath.Join(opts.OutDir, name+".img"+codec.Extension())
+			compressed, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []byte
+			switch codec {
+			case payload_extract.CodecZstd:
+				var frames int
+				got, frames = readSeekableZstd(t, compressed)
+				if want_frames := (len(image) + 3*bs + 99) / (3*bs + 100); frames != want_frames {
+					t.Errorf("%s: %d frames, want %d", file, frames, want_frames)
+				}
+			case payload_extract.CodecXz:
+				r, err := xz.NewReader(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+			case payload_extract.CodecGzip:
+				r, err := gzip.NewReader(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, image) {
+				t.Errorf("%s differs", file)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(opts.OutDir, "boot.img")); !os.IsNotExist(err) {
+			t.Error("boot.img written")
+		}
+	}
+}
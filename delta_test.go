@@ -0,0 +1,416 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/lz4diff"
+	"github.com/affggh/payload_extract/puffin"
+	"github.com/affggh/payload_extract/update_engine"
+	"github.com/andybalholm/brotli"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// addSourceOp appends a source operation reading src extents of old.
+func addSourceOp(tp *testPayload, part *update_engine.PartitionUpdate, typ update_engine.InstallOperation_Type, old []byte, data []byte, src []*update_engine.Extent, dst ...*update_engine.Extent) *update_engine.InstallOperation {
+	op := tp.addOp(part, typ, data, dst...)
+	op.SrcExtents = src
+	h := sha256.New()
+	for _, e := range src {
+		start := int(e.GetStartBlock()) * tp.blockSize
+		h.Write(old[start : start+int(e.GetNumBlocks())*tp.blockSize])
+	}
+	op.SrcSha256Hash = h.Sum(nil)
+	return op
+}
+
+// extractDelta extracts the payload with sources from a directory holding
+// the given old images.
+func extractDelta(t *testing.T, data []byte, old map[string][]byte) (string, error) {
+	t.Helper()
+	srcDir := t.TempDir()
+	for name, image := range old {
+		if err := os.WriteFile(filepath.Join(srcDir, name+".img"), image, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := payload_extract.NewDirSource(srcDir)
+	defer source.Close()
+
+	out := t.TempDir()
+	return out, payload.Extract(context.Background(), payload_extract.ExtractOptions{
+		OutDir:  out,
+		Workers: 2,
+		Source:  source,
+	})
+}
+
+// bsdf2 returns an uncompressed BSDF2 patch from old to new made of one diff
+// over the common length and the rest of new as extra data.
+func bsdf2(old, new []byte) []byte {
+	var patch bytes.Buffer
+	offtout := func(x int) {
+		binary.Write(&patch, binary.LittleEndian, int64(x))
+	}
+	diff := min(len(old), len(new))
+	patch.WriteString("BSDF2\x00\x00\x00")
+	offtout(24)
+	offtout(diff)
+	offtout(len(new))
+	offtout(diff)
+	offtout(len(new) - diff)
+	offtout(0)
+	for i := 0; i < diff; i++ {
+		patch.WriteByte(new[i] - old[i])
+	}
+	patch.Write(new[diff:])
+	return patch.Bytes()
+}
+
+func checkImage(t *testing.T, out, name string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(filepath.Join(out, name+".img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: extracted image differs", name)
+	}
+}
+
+func TestSourceCopy(t *testing.T) {
+	const bs = 4096
+	old := testImage(bs, 8, 5)
+
+	// New image: old blocks 4-7, old blocks 0-1 and two new blocks
+	image := append(append([]byte{}, old[4*bs:8*bs]...), old[0:2*bs]...)
+	image = append(image, testImage(bs, 2, 9)...)
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("system", image)
+	addSourceOp(tp, part, update_engine.InstallOperation_SOURCE_COPY, old, nil,
+		[]*update_engine.Extent{ext(4, 4), ext(0, 2)}, ext(0, 6))
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, image[6*bs:], ext(6, 2))
+	data := tp.bytes()
+
+	out, err := extractDelta(t, data, map[string][]byte{"system": old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, out, "system", image)
+
+	// A different source image is detected by src_sha256_hash
+	_, err = extractDelta(t, data, map[string][]byte{"system": testImage(bs, 8, 6)})
+	if !errors.Is(err, payload_extract.ErrHashMismatch) {
+		t.Errorf("err = %v, want source hash mismatch", err)
+	}
+
+	// No source at all
+	_, err = extractDelta(t, data, nil)
+	if err == nil {
+		t.Error("expected error without source image")
+	}
+
+	// Extents past the source image are rejected before they are read
+	tp = newTestPayload(bs)
+	op := addSourceOp(tp, tp.addPartition("system", image), update_engine.InstallOperation_SOURCE_COPY, old, nil,
+		[]*update_engine.Extent{ext(0, 8)}, ext(0, 8))
+	op.SrcExtents[0].NumBlocks = proto.Uint64(1 << 40)
+	_, err = extractDelta(t, tp.bytes(), map[string][]byte{"system": old})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the source image") {
+		t.Errorf("err = %v, want source extents past the image", err)
+	}
+}
+
+func TestSourceBsdiff(t *testing.T) {
+	const bs = 4096
+	old := testImage(bs, 8, 5)
+
+	// Patch output: old blocks 2-5 with a few bytes changed, then two new
+	// blocks
+	src := old[2*bs : 6*bs]
+	patched := append([]byte{}, src...)
+	for i := 0; i < len(patched); i += 1000 {
+		patched[i] ^= 0x5a
+	}
+	patched = append(patched, testImage(bs, 2, 9)...)
+
+	patch := bsdf2(src, patched)
+
+	// The output is scattered with its second half first
+	image := append(append([]byte{}, patched[3*bs:]...), patched[:3*bs]...)
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("vendor", image)
+	addSourceOp(tp, part, update_engine.InstallOperation_BROTLI_BSDIFF, old, patch,
+		[]*update_engine.Extent{ext(2, 4)}, ext(3, 3), ext(0, 3))
+	data := tp.bytes()
+
+	out, err := extractDelta(t, data, map[string][]byte{"vendor": old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, out, "vendor", image)
+
+	_, err = extractDelta(t, data, map[string][]byte{"vendor": testImage(bs, 8, 6)})
+	if !errors.Is(err, payload_extract.ErrHashMismatch) {
+		t.Errorf("err = %v, want source hash mismatch", err)
+	}
+
+	// A patch header sizing the output past dst_extents fails before
+	// patching
+	huge := bytes.Clone(patch)
+	binary.LittleEndian.PutUint64(huge[24:32], 1<<50)
+	tp = newTestPayload(bs)
+	addSourceOp(tp, tp.addPartition("vendor", image), update_engine.InstallOperation_BROTLI_BSDIFF, old, huge,
+		[]*update_engine.Extent{ext(2, 4)}, ext(3, 3), ext(0, 3))
+	_, err = extractDelta(t, tp.bytes(), map[string][]byte{"vendor": old})
+	if !errors.Is(err, payload_extract.ErrDataLength) {
+		t.Errorf("err = %v, want ErrDataLength", err)
+	}
+}
+
+// puffdiff returns a puffdiff patch from src to dst, which hold a deflate
+// stream at byte srcDeflate and dstDeflate.
+func puffdiff(t *testing.T, src, dst []byte, srcDeflate, dstDeflate int64) []byte {
+	t.Helper()
+	// stream returns the puff stream of data and its StreamInfo message
+	stream := func(data []byte, offset int64) ([]byte, []byte) {
+		deflates, err := puffin.FindDeflateSubBlocks(data, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		puff, puffs, err := puffin.PuffStream(data, deflates)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var info []byte
+		extent := func(num protowire.Number, offset, length uint64) {
+			var ext []byte
+			ext = protowire.AppendTag(ext, 1, protowire.VarintType)
+			ext = protowire.AppendVarint(ext, offset)
+			ext = protowire.AppendTag(ext, 2, protowire.VarintType)
+			ext = protowire.AppendVarint(ext, length)
+			info = protowire.AppendTag(info, num, protowire.BytesType)
+			info = protowire.AppendBytes(info, ext)
+		}
+		for i := range deflates {
+			extent(1, deflates[i].Offset, deflates[i].Length)
+			extent(2, puffs[i].Offset*8, puffs[i].Length*8)
+		}
+		info = protowire.AppendTag(info, 3, protowire.VarintType)
+		info = protowire.AppendVarint(info, uint64(len(puff)))
+		return puff, info
+	}
+	srcPuff, srcInfo := stream(src, srcDeflate)
+	dstPuff, dstInfo := stream(dst, dstDeflate)
+
+	var header []byte
+	header = protowire.AppendTag(header, 2, protowire.BytesType)
+	header = protowire.AppendBytes(header, srcInfo)
+	header = protowire.AppendTag(header, 3, protowire.BytesType)
+	header = protowire.AppendBytes(header, dstInfo)
+
+	patch := []byte("PUF1")
+	patch = binary.BigEndian.AppendUint32(patch, uint32(len(header)))
+	patch = append(patch, header...)
+	return append(patch, bsdf2(srcPuff, dstPuff)...)
+}
+
+// zipLike returns a block aligned file of size blocks holding a short raw
+// header and content deflated at byte 16.
+func zipLike(t *testing.T, bs, blocks int, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString("PK-like header..")
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	w.Close()
+	if buf.Len() > bs*blocks {
+		t.Fatalf("deflated content does not fit %d blocks", blocks)
+	}
+	buf.Write(make([]byte, bs*blocks-buf.Len()))
+	return buf.Bytes()
+}
+
+func TestSourcePuffdiff(t *testing.T) {
+	const bs = 4096
+	content := bytes.Repeat([]byte("an app resource, "), 3000)
+
+	old := append(testImage(bs, 2, 5), zipLike(t, bs, 4, content)...)
+	content = append(content, "updated"...)
+	content[100] = 'X'
+	newFile := zipLike(t, bs, 4, content)
+
+	image := append(testImage(bs, 2, 5), newFile...)
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("product", image)
+	addSourceOp(tp, part, update_engine.InstallOperation_SOURCE_COPY, old, nil,
+		[]*update_engine.Extent{ext(0, 2)}, ext(0, 2))
+	addSourceOp(tp, part, update_engine.InstallOperation_PUFFDIFF, old,
+		puffdiff(t, old[2*bs:], newFile, 16, 16),
+		[]*update_engine.Extent{ext(2, 4)}, ext(2, 4))
+	data := tp.bytes()
+
+	out, err := extractDelta(t, data, map[string][]byte{"product": old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, out, "product", image)
+}
+
+// zucchiniRaw returns a Zucchini patch with a single raw element copying
+// length bytes of old at src to new at dst, the rest of new as extra data.
+func zucchiniRaw(old, new []byte, src, dst, length int) []byte {
+	var e []byte
+	for _, v := range []uint32{0, uint32(len(old)), 0, uint32(len(new)), 0} {
+		e = binary.LittleEndian.AppendUint32(e, v)
+	}
+	e = binary.LittleEndian.AppendUint16(e, 1)
+	extra := append(append([]byte{}, new[:dst]...), new[dst+length:]...)
+	for _, buf := range [][]byte{
+		protowire.AppendVarint(nil, protowire.EncodeZigZag(int64(src))),
+		protowire.AppendVarint(nil, uint64(dst)),
+		protowire.AppendVarint(nil, uint64(length)),
+		extra, nil, nil, nil,
+	} {
+		e = binary.LittleEndian.AppendUint32(e, uint32(len(buf)))
+		e = append(e, buf...)
+	}
+	e = binary.LittleEndian.AppendUint32(e, 0)
+
+	p := []byte("Zucc")
+	p = binary.LittleEndian.AppendUint16(p, 1)
+	p = binary.LittleEndian.AppendUint16(p, 0)
+	for _, v := range []uint32{uint32(len(old)), crc32.ChecksumIEEE(old), uint32(len(new)), crc32.ChecksumIEEE(new), 1} {
+		p = binary.LittleEndian.AppendUint32(p, v)
+	}
+	return append(p, e...)
+}
+
+func TestSourceZucchini(t *testing.T) {
+	const bs = 4096
+	old := testImage(bs, 4, 5)
+	image := append(append([]byte{}, old[bs:3*bs]...), testImage(bs, 1, 9)...)
+
+	patch := zucchiniRaw(old, image, bs, 0, 2*bs)
+	var compressed bytes.Buffer
+	w := brotli.NewWriter(&compressed)
+	w.Write(patch)
+	w.Close()
+
+	for name, blob := range map[string][]byte{"raw": patch, "brotli": compressed.Bytes()} {
+		tp := newTestPayload(bs)
+		part := tp.addPartition("odm", image)
+		addSourceOp(tp, part, update_engine.InstallOperation_ZUCCHINI, old, blob,
+			[]*update_engine.Extent{ext(0, 4)}, ext(0, 3))
+
+		out, err := extractDelta(t, tp.bytes(), map[string][]byte{"odm": old})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkImage(t, out, "odm", image)
+	}
+
+	// A patch header sizing the new image past dst_extents fails before
+	// patching
+	huge := bytes.Clone(patch)
+	binary.LittleEndian.PutUint32(huge[16:], 0xFFFFFFFF)
+	tp := newTestPayload(bs)
+	addSourceOp(tp, tp.addPartition("odm", image), update_engine.InstallOperation_ZUCCHINI, old, huge,
+		[]*update_engine.Extent{ext(0, 4)}, ext(0, 3))
+	_, err := extractDelta(t, tp.bytes(), map[string][]byte{"odm": old})
+	if !errors.Is(err, payload_extract.ErrDataLength) {
+		t.Errorf("err = %v, want ErrDataLength", err)
+	}
+}
+
+// lz4diffFile describes two 16KB clusters compressed into one block each.
+func lz4diffFile(bs int) []byte {
+	var file []byte
+	for i := 0; i < 2; i++ {
+		var info []byte
+		info = protowire.AppendTag(info, 1, protowire.VarintType)
+		info = protowire.AppendVarint(info, uint64(i*4*bs))
+		info = protowire.AppendTag(info, 2, protowire.VarintType)
+		info = protowire.AppendVarint(info, uint64(4*bs))
+		info = protowire.AppendTag(info, 3, protowire.VarintType)
+		info = protowire.AppendVarint(info, uint64(bs))
+		file = protowire.AppendTag(file, 1, protowire.BytesType)
+		file = protowire.AppendBytes(file, info)
+	}
+	var algo []byte
+	algo = protowire.AppendTag(algo, 1, protowire.VarintType)
+	algo = protowire.AppendVarint(algo, lz4diff.AlgoLZ4HC)
+	algo = protowire.AppendTag(algo, 2, protowire.VarintType)
+	algo = protowire.AppendVarint(algo, 9)
+	file = protowire.AppendTag(file, 2, protowire.BytesType)
+	file = protowire.AppendBytes(file, algo)
+	file = protowire.AppendTag(file, 3, protowire.VarintType)
+	return protowire.AppendVarint(file, 1)
+}
+
+func TestSourceLz4diff(t *testing.T) {
+	const bs = 4096
+	var header []byte
+	header = protowire.AppendTag(header, 1, protowire.BytesType)
+	header = protowire.AppendBytes(header, lz4diffFile(bs))
+	header = protowire.AppendTag(header, 2, protowire.BytesType)
+	header = protowire.AppendBytes(header, lz4diffFile(bs))
+
+	// Old and new EROFS-like images of two zero padded LZ4HC clusters
+	oldPlain := testImage(bs, 8, 5)
+	newPlain := testImage(bs, 8, 7)
+	newPlain[5000] = 'X'
+
+	patch := []byte("LZ4DIFF")
+	patch = binary.BigEndian.AppendUint32(patch, 1)
+	patch = binary.BigEndian.AppendUint32(patch, uint32(len(header)))
+	patch = append(append(patch, header...), bsdf2(oldPlain, newPlain)...)
+
+	parsed, _, err := lz4diff.ParseHeader(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := lz4diff.Compress(oldPlain, &parsed.Src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := lz4diff.Compress(newPlain, &parsed.Dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("system_ext", image)
+	addSourceOp(tp, part, update_engine.InstallOperation_LZ4DIFF_BSDIFF, old, patch,
+		[]*update_engine.Extent{ext(0, 2)}, ext(0, 2))
+
+	out, err := extractDelta(t, tp.bytes(), map[string][]byte{"system_ext": old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, out, "system_ext", image)
+}
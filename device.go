@@ -0,0 +1,219 @@
+package payload_extract_go
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+var (
+	// ErrDeviceMounted is returned for target devices that are mounted or
+	// otherwise in use.
+	ErrDeviceMounted = errors.New("device is mounted or in use")
+	// ErrDeviceTooSmall is returned for target devices smaller than the
+	// partition.
+	ErrDeviceTooSmall = errors.New("device is smaller than the partition")
+)
+
+// ParseDeviceMap reads a partition to device mapping, one name=path per
+// line. Blank lines and lines starting with # are ignored.
+func ParseDeviceMap(r io.Reader) (map[string]string, error) {
+	devices := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, device, ok := strings.Cut(line, "=")
+		name, device = strings.TrimSpace(name), strings.TrimSpace(device)
+		if !ok || len(name) == 0 || len(device) == 0 {
+			return nil, fmt.Errorf("line %d: want name=path, got %q", line_number, line)
+		}
+		if _, dup := devices[name]; dup {
+			return nil, fmt.Errorf("line %d: partition %s mapped twice", line_number, name)
+		}
+		devices[name] = device
+	}
+	return devices, scanner.Err()
+}
+
+// openDevice opens the block device (or existing regular file) at
+// device_path for writing size bytes. Devices that are mounted or smaller
+// than size are refused. With direct, block devices are opened with O_DIRECT.
+func openDevice(device_path string, size int64, direct bool) (*os.File, error) {
+	info, err := os.Stat(device_path)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags int
+	switch {
+	case info.Mode().IsRegular():
+		flags = os.O_RDWR
+	case info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0:
+		if err := checkNotMounted(device_path, info); err != nil {
+			return nil, err
+		}
+		// Reads of partial blocks need read access too
+		flags = os.O_RDWR | openExclusive
+		if direct {
+			flags |= openDirect
+		}
+	default:
+		return nil, fmt.Errorf("%s is neither a block device nor a regular file", device_path)
+	}
+
+	fd, err := os.OpenFile(device_path, flags, 0)
+	if err != nil {
+		if isBusy(err) {
+			return nil, fmt.Errorf("%s: %w", device_path, ErrDeviceMounted)
+		}
+		return nil, err
+	}
+
+	device_size, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if device_size < size {
+		fd.Close()
+		return nil, fmt.Errorf("%s: %w: %d bytes, want %d", device_path, ErrDeviceTooSmall, device_size, size)
+	}
+	return fd, nil
+}
+
+// unwrittenExtents returns the extents of the first total_blocks blocks no
+// operation of p writes to.
+func unwrittenExtents(p *update_engine.PartitionUpdate, total_blocks uint64) []*update_engine.Extent {
+	var written []*update_engine.Extent
+	for _, operation := range p.Operations {
+		written = append(written, operation.GetDstExtents()...)
+	}
+	sort.Slice(written, func(i, j int) bool {
+		return written[i].GetStartBlock() < written[j].GetStartBlock()
+	})
+
+	var unwritten []*update_engine.Extent
+	next := uint64(0)
+	add := func(end uint64) {
+		if end > next {
+			start, num := next, end-next
+			unwritten = append(unwritten, &update_engine.Extent{StartBlock: &start, NumBlocks: &num})
+		}
+	}
+	for _, ext := range written {
+		add(min(ext.GetStartBlock(), total_blocks))
+		next = max(next, ext.GetStartBlock()+ext.GetNumBlocks())
+	}
+	add(total_blocks)
+	return unwritten
+}
+
+const alignedBufferSize = 1 << 20
+
+// alignedWriter writes to fd in whole blocks of align bytes at aligned
+// offsets from aligned memory, as O_DIRECT requires. Partial blocks are read,
+// patched and written back, which is safe since operations write distinct
+// blocks.
+type alignedWriter struct {
+	fd      *os.File
+	align   int64
+	buffers sync.Pool
+}
+
+func newAlignedWriter(fd *os.File, align int) *alignedWriter {
+	w := &alignedWriter{fd: fd, align: int64(align)}
+	w.buffers.New = func() any {
+		buf := make([]byte, alignedBufferSize+align)
+		shift := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align))
+		if shift != 0 {
+			shift = align - shift
+		}
+		return buf[shift : shift+alignedBufferSize]
+	}
+	return w
+}
+
+func (w *alignedWriter) WriteAt(p []byte, off int64) (int, error) {
+	buf := w.buffers.Get().([]byte)
+	defer w.buffers.Put(buf)
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		start := pos / w.align * w.align
+		end := min(alignUp(off+int64(len(p)), w.align), start+int64(len(buf)))
+		chunk := buf[:end-start]
+		data_end := min(off+int64(len(p)), end)
+
+		// Keep the bytes around the data in the head and tail blocks
+		if pos > start {
+			if _, err := readFullAt(w.fd, chunk[:w.align], start); err != nil {
+				return n, err
+			}
+		}
+		if tail := end - w.align; data_end < end && (tail > start || pos == start) {
+			if _, err := readFullAt(w.fd, chunk[tail-start:], tail); err != nil {
+				return n, err
+			}
+		}
+
+		copied := copy(chunk[pos-start:data_end-start], p[n:])
+		if _, err := w.fd.WriteAt(chunk, start); err != nil {
+			return n, err
+		}
+		n += copied
+	}
+	return n, nil
+}
+
+// deviceTarget opens the device at device_path for partition p, to be
+// extracted by extractPlan. Unlike fresh image files devices hold stale data,
+// the bytes no operation writes are zeroed up to the new_partition_info size
+// when it is past the last extent.
+func (payload *Payload) deviceTarget(
+	p *update_engine.PartitionUpdate,
+	opts ExtractOptions,
+	device_path string,
+) (*partitionTarget, error) {
+	block_size := payload.BlockSize()
+	size := partitionSize(p, block_size)
+
+	end := max(size, int64(p.GetNewPartitionInfo().GetSize()))
+	fd, err := openDevice(device_path, end, opts.DirectIO)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := newAlignedWriter(fd, block_size)
+	_, err = zeroExtents(writer, unwrittenExtents(p, uint64(end)/uint64(block_size)), block_size, false)
+	if tail := end % int64(block_size); err == nil && tail != 0 {
+		// Extents end on blocks, a partial last block is past them
+		_, err = write_zero(writer, tail, end-tail)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	target := &partitionTarget{writer: writer}
+	target.finish = func(err error) error {
+		if err == nil {
+			err = fd.Sync()
+		}
+		if close_err := fd.Close(); err == nil {
+			err = close_err
+		}
+		return err
+	}
+	return target, nil
+}
@@ -0,0 +1,72 @@
+package payload_extract_go
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// O_EXCL on a block device fails with EBUSY if it is mounted or claimed
+	openExclusive = syscall.O_EXCL
+	openDirect    = syscall.O_DIRECT
+)
+
+func isBusy(err error) bool {
+	return errors.Is(err, syscall.EBUSY)
+}
+
+// checkNotMounted refuses the block device at device_path if it, or one of
+// its partitions, appears in /proc/self/mountinfo.
+func checkNotMounted(device_path string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	device := sysfsBlockPath(deviceNumber(uint64(st.Rdev)))
+
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer mountinfo.Close()
+
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		// id parent major:minor root mount_point ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounted := sysfsBlockPath(fields[2])
+		if len(device) == 0 || len(mounted) == 0 {
+			continue
+		}
+		// Partitions are subdirectories of their disk in sysfs
+		if mounted == device || strings.HasPrefix(mounted, device+"/") {
+			return fmt.Errorf("%s: %w on %s", device_path, ErrDeviceMounted, fields[4])
+		}
+	}
+	return scanner.Err()
+}
+
+// deviceNumber formats a dev_t as major:minor, as glibc splits it.
+func deviceNumber(rdev uint64) string {
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// sysfsBlockPath resolves the sysfs directory of block device major:minor,
+// empty if it is not a block device.
+func sysfsBlockPath(number string) string {
+	path, err := filepath.EvalSymlinks("/sys/dev/block/" + number)
+	if err != nil {
+		return ""
+	}
+	return path
+}
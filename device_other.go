@@ -0,0 +1,23 @@
+//go:build !linux
+
+package payload_extract_go
+
+import (
+	"errors"
+	"os"
+)
+
+const (
+	openExclusive = 0
+	openDirect    = 0
+)
+
+func isBusy(err error) bool {
+	return false
+}
+
+// checkNotMounted cannot tell mounted devices apart outside Linux, block
+// devices are refused.
+func checkNotMounted(device_path string, info os.FileInfo) error {
+	return errors.New("writing to block devices is only supported on Linux")
+}
@@ -0,0 +1,105 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseDeviceMap(t *testing.T) {
+	devices, err := payload_extract.ParseDeviceMap(strings.NewReader("# lab rig\nboot = /dev/sdb1\n\nvendor=/dev/sdb2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices["boot"] != "/dev/sdb1" || devices["vendor"] != "/dev/sdb2" {
+		t.Errorf("devices %v", devices)
+	}
+
+	for _, bad := range []string{"boot /dev/sdb1\n", "boot=\n", "boot=/dev/a\nboot=/dev/b\n"} {
+		if _, err := payload_extract.ParseDeviceMap(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestExtractDevice(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 12, 1)
+	// Blocks 4 and 5 are written by no operation, 8 and 9 zeroed
+	clear(boot[4*bs : 6*bs])
+	clear(boot[8*bs : 10*bs])
+	clear(boot[12*bs-100:])
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:4*bs], ext(0, 4))
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[6*bs:8*bs], ext(6, 2))
+	tp.addOp(part, update_engine.InstallOperation_ZERO, nil, ext(8, 2))
+	// Unaligned output, ending within the last block
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[10*bs:12*bs-100], ext(10, 2))
+	// The partition is larger than its extents, ending within a block
+	part.NewPartitionInfo.Size = proto.Uint64(uint64(len(boot) + bs + 100))
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stale data on the device, larger than the partition
+	device := filepath.Join(t.TempDir(), "device")
+	stale := bytes.Repeat([]byte{0xa5}, len(boot)+3*bs)
+	if err := os.WriteFile(device, stale, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := payload_extract.ExtractOptions{
+		OutDir:  t.TempDir(),
+		Workers: 2,
+		Devices: map[string]string{"boot": device},
+	}
+	// Nothing is written to the output directory, it is left alone
+	keep := filepath.Join(opts.OutDir, "keep")
+	if err := os.WriteFile(keep, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := payload.Extract(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(keep); err != nil {
+		t.Errorf("output directory cleared: %v", err)
+	}
+	got, err := os.ReadFile(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(boot)], boot) {
+		t.Error("partition on the device differs")
+	}
+	if !bytes.Equal(got[len(boot):len(boot)+bs+100], make([]byte, bs+100)) {
+		t.Error("partition past its extents not zeroed")
+	}
+	if !bytes.Equal(got[len(boot)+bs+100:], stale[len(boot)+bs+100:]) {
+		t.Error("bytes past the partition changed")
+	}
+	if _, err := os.Stat(filepath.Join(opts.OutDir, "boot.img")); !os.IsNotExist(err) {
+		t.Error("boot.img written")
+	}
+
+	// Devices smaller than the partition are refused
+	if err := os.Truncate(device, int64(len(boot)-bs)); err != nil {
+		t.Fatal(err)
+	}
+	err = payload.Extract(context.Background(), opts)
+	if !errors.Is(err, payload_extract.ErrDeviceTooSmall) {
+		t.Errorf("err = %v, want ErrDeviceTooSmall", err)
+	}
+}
@@ -0,0 +1,148 @@
+package payload_extract_go
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+// ErrDataLength is wrapped by errors reporting operation output that does not
+// fill its dst_extents.
+var ErrDataLength = errors.New("output length does not match dst_extents")
+
+// extentsSize returns the size in bytes of extents.
+func extentsSize(extents []*update_engine.Extent, block_size int) int64 {
+	total := int64(0)
+	for _, ext := range extents {
+		total += int64(ext.GetNumBlocks()) * int64(block_size)
+	}
+	return total
+}
+
+// checkDataLength checks the output length of an operation against the size
+// of its dst_extents. Like update_engine, output ending within the last block
+// is accepted and zero padded.
+func checkDataLength(length, want int64, block_size int) error {
+	if length > want || want-length >= int64(block_size) {
+		return fmt.Errorf("%w: %d bytes for %d bytes of extents", ErrDataLength, length, want)
+	}
+	return nil
+}
+
+// extentWriter writes a stream across the dst_extents of an operation, in
+// order, refusing to write past the last extent.
+type extentWriter struct {
+	writer     io.WriterAt
+	extents    []*update_engine.Extent
+	block_size int64
+
+	ext     int   // current extent
+	pos     int64 // offset in the current extent
+	written int64
+}
+
+func newExtentWriter(writer io.WriterAt, extents []*update_engine.Extent, block_size int) *extentWriter {
+	return &extentWriter{
+		writer:     writer,
+		extents:    extents,
+		block_size: int64(block_size),
+	}
+}
+
+func (w *extentWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if w.ext >= len(w.extents) {
+			return n, fmt.Errorf("%w: more than %d bytes of output", ErrDataLength, w.written)
+		}
+		ext := w.extents[w.ext]
+		length := int64(ext.GetNumBlocks()) * w.block_size
+		chunk := int(min(int64(len(p)-n), length-w.pos))
+
+		m, err := w.writer.WriteAt(p[n:n+chunk], int64(ext.GetStartBlock())*w.block_size+w.pos)
+		n += m
+		w.pos += int64(m)
+		w.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+
+		if w.pos == length {
+			w.ext++
+			w.pos = 0
+		}
+	}
+	return n, nil
+}
+
+// Finish checks that the extents were filled, zero padding the rest of the
+// last block.
+func (w *extentWriter) Finish() error {
+	want := extentsSize(w.extents, int(w.block_size))
+	if err := checkDataLength(w.written, want, int(w.block_size)); err != nil {
+		return err
+	}
+	if pad := want - w.written; pad > 0 {
+		if _, err := w.Write(zero_buffer[:pad]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Written returns the number of bytes written so far.
+func (w *extentWriter) Written() int64 {
+	return w.written
+}
+
+// writeExtents writes data across extents of writer and checks it fills them.
+func writeExtents(writer io.WriterAt, extents []*update_engine.Extent, data []byte, block_size int) (int, error) {
+	w := newExtentWriter(writer, extents, block_size)
+	if _, err := w.Write(data); err != nil {
+		return int(w.Written()), err
+	}
+	return int(w.Written()), w.Finish()
+}
+
+// zeroExtents zeroes extents of writer, for ZERO and DISCARD operations. With
+// punch_holes, files get holes punched instead of zeros written where the
+// filesystem supports it.
+func zeroExtents(writer io.WriterAt, extents []*update_engine.Extent, block_size int, punch_holes bool) (int, error) {
+	fd, can_punch := writer.(*os.File)
+	can_punch = can_punch && punch_holes
+	// Sparse output leaves the blocks of the truncated file as holes
+	_, sparse := writer.(*sparseWriter)
+
+	total := 0
+	for _, ext := range extents {
+		offset := int64(ext.GetStartBlock()) * int64(block_size)
+		size := int64(ext.GetNumBlocks()) * int64(block_size)
+
+		if sparse {
+			total += int(size)
+			continue
+		}
+
+		if can_punch {
+			err := punchHole(fd, offset, size)
+			if err == nil {
+				total += int(size)
+				continue
+			}
+			if !errors.Is(err, errors.ErrUnsupported) {
+				return total, err
+			}
+			can_punch = false
+		}
+
+		n, err := write_zero(writer, size, offset)
+		total += int(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -4,6 +4,7 @@ go 1.24.2
 
 require (
 	github.com/DataDog/zstd v1.5.7
+	github.com/andybalholm/brotli v1.2.0
 	github.com/remyoudompheng/go-liblzma v0.0.0-20190506200333-81bf2d431b96
 	google.golang.org/protobuf v1.36.6
 )
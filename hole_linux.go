@@ -0,0 +1,35 @@
+package payload_extract_go
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	falloc_fl_keep_size  = 0x01
+	falloc_fl_punch_hole = 0x02
+)
+
+// punchHole deallocates size bytes of fd at offset, which then read as
+// zeros. Filesystems without hole support give errors.ErrUnsupported.
+func punchHole(fd *os.File, offset, size int64) error {
+	conn, err := fd.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno error
+	err = conn.Control(func(sysfd uintptr) {
+		errno = syscall.Fallocate(int(sysfd), falloc_fl_punch_hole|falloc_fl_keep_size, offset, size)
+	})
+	if err != nil {
+		return err
+	}
+	if errors.Is(errno, syscall.EOPNOTSUPP) || errors.Is(errno, syscall.ENOSYS) {
+		return errors.ErrUnsupported
+	}
+	if errno != nil {
+		return &os.PathError{Op: "fallocate", Path: fd.Name(), Err: errno}
+	}
+	return nil
+}
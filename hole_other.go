@@ -0,0 +1,13 @@
+//go:build !linux
+
+package payload_extract_go
+
+import (
+	"errors"
+	"os"
+)
+
+// punchHole is only implemented on Linux, zeros are written elsewhere.
+func punchHole(fd *os.File, offset, size int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,147 @@
+// Package deflate holds the bit level pieces of RFC 1951 shared by the
+// puffin patcher and the zip index: LSB first bit reader and writer,
+// canonical Huffman codes and the fixed tables of the format.
+package deflate
+
+import (
+	"errors"
+)
+
+// ErrUnexpectedEnd is returned when a read runs past the end of the data.
+var ErrUnexpectedEnd = errors.New("deflate: unexpected end of data")
+
+// BitReader reads bits LSB first from a byte slice.
+type BitReader struct {
+	data []byte
+	pos  int64 // in bits
+	end  int64 // in bits
+}
+
+// NewBitReader returns a reader over all bits of data.
+func NewBitReader(data []byte) *BitReader {
+	return &BitReader{data: data, end: int64(len(data)) * 8}
+}
+
+// NewBitReaderAt returns a reader over the bits [start, end) of data. Offsets
+// and byte boundaries stay relative to the start of data.
+func NewBitReaderAt(data []byte, start, end int64) *BitReader {
+	return &BitReader{data: data, pos: start, end: min(end, int64(len(data))*8)}
+}
+
+// Offset returns the position in bits.
+func (r *BitReader) Offset() int64 {
+	return r.pos
+}
+
+// Remaining returns the number of unread bits.
+func (r *BitReader) Remaining() int64 {
+	return r.end - r.pos
+}
+
+// BoundaryBits returns the number of bits up to the next byte boundary.
+func (r *BitReader) BoundaryBits() uint {
+	return uint(-r.pos & 7)
+}
+
+// Peek returns the next n (<= 32) bits without consuming them, bits past the
+// end read as zeros.
+func (r *BitReader) Peek(n uint) uint32 {
+	var v uint64
+	idx := r.pos >> 3
+	shift := uint(r.pos & 7)
+	for got := uint(0); got < n+shift && idx < int64(len(r.data)); got += 8 {
+		v |= uint64(r.data[idx]) << got
+		idx++
+	}
+	v >>= shift
+	if rem := r.end - r.pos; rem < int64(n) {
+		if rem < 0 {
+			rem = 0
+		}
+		n = uint(rem)
+	}
+	return uint32(v & (1<<n - 1))
+}
+
+// Skip consumes n bits.
+func (r *BitReader) Skip(n uint) error {
+	if int64(n) > r.end-r.pos {
+		r.pos = r.end
+		return ErrUnexpectedEnd
+	}
+	r.pos += int64(n)
+	return nil
+}
+
+// ReadBits consumes and returns the next n (<= 32) bits.
+func (r *BitReader) ReadBits(n uint) (uint32, error) {
+	if int64(n) > r.end-r.pos {
+		return 0, ErrUnexpectedEnd
+	}
+	v := r.Peek(n)
+	r.pos += int64(n)
+	return v, nil
+}
+
+// ReadBytes returns the next n bytes, the reader must be byte aligned.
+func (r *BitReader) ReadBytes(n int) ([]byte, error) {
+	if r.pos&7 != 0 {
+		return nil, errors.New("deflate: unaligned byte read")
+	}
+	if int64(n)*8 > r.end-r.pos {
+		return nil, ErrUnexpectedEnd
+	}
+	start := r.pos >> 3
+	r.pos += int64(n) * 8
+	return r.data[start : start+int64(n)], nil
+}
+
+// BitWriter writes bits LSB first into a growing byte slice.
+type BitWriter struct {
+	buf   []byte
+	acc   uint64
+	nacc  uint
+	nbits int64
+}
+
+// Bits returns the number of bits written.
+func (w *BitWriter) Bits() int64 {
+	return w.nbits
+}
+
+// BoundaryBits returns the number of bits up to the next byte boundary.
+func (w *BitWriter) BoundaryBits() uint {
+	return uint(-w.nbits & 7)
+}
+
+// WriteBits writes the low n (<= 32) bits of v.
+func (w *BitWriter) WriteBits(n uint, v uint32) {
+	w.acc |= uint64(v&(1<<n-1)) << w.nacc
+	w.nacc += n
+	w.nbits += int64(n)
+	for w.nacc >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+// WriteBytes writes whole bytes, fast when the writer is byte aligned.
+func (w *BitWriter) WriteBytes(b []byte) {
+	if w.nacc == 0 {
+		w.buf = append(w.buf, b...)
+		w.nbits += int64(len(b)) * 8
+		return
+	}
+	for _, c := range b {
+		w.WriteBits(8, uint32(c))
+	}
+}
+
+// Bytes returns the written data, the last partial byte padded with zeros.
+func (w *BitWriter) Bytes() []byte {
+	if w.nacc > 0 {
+		return append(w.buf[:len(w.buf):len(w.buf)], byte(w.acc))
+	}
+	return w.buf
+}
@@ -0,0 +1,250 @@
+package deflate_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"testing"
+
+	"github.com/affggh/payload_extract/internal/deflate"
+)
+
+// token is a literal, or a match if length is set.
+type token struct {
+	lit            byte
+	length, offset int
+}
+
+// fixedBlock encodes tokens as a fixed Huffman block.
+func fixedBlock(t *testing.T, w *deflate.BitWriter, final bool, tokens ...token) {
+	t.Helper()
+	header := uint32(1 << 1)
+	if final {
+		header |= 1
+	}
+	w.WriteBits(3, header)
+
+	litlen, distance := deflate.FixedHuffman()
+	encode := func(h *deflate.Huffman, sym int) {
+		if err := h.Encode(w, sym); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tok := range tokens {
+		if tok.length == 0 {
+			encode(litlen, int(tok.lit))
+			continue
+		}
+		idx := deflate.LengthSymbol(tok.length)
+		encode(litlen, 257+idx)
+		w.WriteBits(uint(deflate.LengthExtra[idx]), uint32(tok.length-int(deflate.LengthBase[idx])))
+		dsym := deflate.DistanceSymbol(tok.offset)
+		encode(distance, dsym)
+		w.WriteBits(uint(deflate.DistanceExtra[dsym]), uint32(tok.offset-int(deflate.DistanceBase[dsym])))
+	}
+	encode(litlen, 256)
+}
+
+func literals(s string) []token {
+	var tokens []token
+	for _, c := range []byte(s) {
+		tokens = append(tokens, token{lit: c})
+	}
+	return tokens
+}
+
+func compress(t *testing.T, level int, parts ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range parts {
+		w.Write(p)
+		// Ends the block, the next part starts a new one
+		w.Flush()
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// inflate decodes every block of data up to the final one.
+func inflate(data []byte) ([]byte, error) {
+	r := deflate.NewBitReader(data)
+	var out []byte
+	for {
+		var final bool
+		var err error
+		if out, final, err = deflate.InflateBlock(r, out); err != nil {
+			return out, err
+		}
+		if final {
+			return out, nil
+		}
+	}
+}
+
+func TestInflateBlock(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog, "), 500)
+
+	fixed := &deflate.BitWriter{}
+	fixedBlock(t, fixed, true, append(literals("abc"), token{length: 7, offset: 3}, token{lit: '!'})...)
+
+	// Back references reach into the previous block
+	two := &deflate.BitWriter{}
+	fixedBlock(t, two, false, literals("xyz")...)
+	fixedBlock(t, two, true, token{length: 258, offset: 2})
+
+	far := &deflate.BitWriter{}
+	fixedBlock(t, far, true, append(literals("ab"), token{length: 3, offset: 3})...)
+
+	short := compress(t, flate.BestCompression, text)
+	if short[0]>>1&3 != 2 {
+		t.Fatal("compressed text does not start with a dynamic block")
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+		err  error // wanted error
+		bad  bool  // any error
+	}{
+		{name: "stored", data: compress(t, flate.NoCompression, []byte("stored block")), want: []byte("stored block")},
+		{name: "fixed", data: fixed.Bytes(), want: []byte("abcabcabca!")},
+		{name: "fixed blocks", data: two.Bytes(), want: append([]byte("xyz"), bytes.Repeat([]byte("yz"), 129)...)},
+		{name: "dynamic", data: short, want: text},
+		{name: "mixed", data: compress(t, flate.BestSpeed, text[:1000], []byte{}, text), want: append(append([]byte{}, text[:1000]...), text...)},
+		{name: "empty", data: compress(t, flate.DefaultCompression), want: nil},
+
+		{name: "block type 3", data: []byte{0x07}, bad: true},
+		{name: "stored length", data: []byte{0x01, 0x05, 0x00, 0x00, 0x00}, bad: true},
+		{name: "stored truncated", data: []byte{0x01, 0x05, 0x00, 0xFA, 0xFF, 'a'}, err: deflate.ErrUnexpectedEnd},
+		{name: "distance before start", data: far.Bytes(), bad: true},
+		{name: "dynamic truncated", data: short[:len(short)/2], err: deflate.ErrUnexpectedEnd},
+		{name: "no data", data: nil, err: deflate.ErrUnexpectedEnd},
+	}
+	for _, tt := range tests {
+		got, err := inflate(tt.data)
+		switch {
+		case tt.err != nil || tt.bad:
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			} else if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !bytes.Equal(got, tt.want):
+			t.Errorf("%s: got %q, want %q", tt.name, truncate(got), truncate(tt.want))
+		}
+	}
+}
+
+func truncate(b []byte) []byte {
+	return b[:min(len(b), 32)]
+}
+
+func TestInflateInvalidSymbol(t *testing.T) {
+	// Length symbols 286 and 287 have fixed codes but no meaning
+	w := &deflate.BitWriter{}
+	w.WriteBits(3, 1|1<<1)
+	litlen, _ := deflate.FixedHuffman()
+	litlen.Encode(w, 'a')
+	litlen.Encode(w, 286)
+	if _, err := inflate(w.Bytes()); err == nil {
+		t.Error("expected error for length symbol 286")
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	lens := []uint8{2, 1, 3, 3, 0}
+	h, err := deflate.NewHuffman(lens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syms := []int{0, 1, 2, 3, 1, 1, 0}
+	w := &deflate.BitWriter{}
+	for _, sym := range syms {
+		if err := h.Encode(w, sym); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Encode(w, 4); err == nil {
+		t.Error("encoded a symbol without code")
+	}
+	r := deflate.NewBitReader(w.Bytes())
+	for _, want := range syms {
+		if got, err := h.Decode(r); err != nil || got != want {
+			t.Fatalf("decoded %d, %v, want %d", got, err, want)
+		}
+	}
+
+	// Incomplete codes are accepted, their unused codes do not decode
+	h, err = deflate.NewHuffman([]uint8{0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Decode(deflate.NewBitReader([]byte{0x03})); !errors.Is(err, deflate.ErrInvalidCode) {
+		t.Errorf("err = %v, want ErrInvalidCode", err)
+	}
+
+	for _, bad := range [][]uint8{{1, 1, 1}, {16}} {
+		if _, err := deflate.NewHuffman(bad); err == nil {
+			t.Errorf("lengths %v accepted", bad)
+		}
+	}
+}
+
+func TestBits(t *testing.T) {
+	widths := []uint{1, 3, 8, 13, 32, 5, 7}
+	values := []uint32{1, 5, 0xA5, 0x1234, 0xDEADBEEF, 0x11, 0x7F}
+
+	w := &deflate.BitWriter{}
+	for i, n := range widths {
+		w.WriteBits(n, values[i])
+	}
+	if w.Bits() != 69 || w.BoundaryBits() != 3 {
+		t.Errorf("wrote %d bits, %d to the boundary", w.Bits(), w.BoundaryBits())
+	}
+	w.WriteBits(w.BoundaryBits(), 0)
+	w.WriteBytes([]byte("aligned"))
+
+	data := w.Bytes()
+	r := deflate.NewBitReader(data)
+	for i, n := range widths {
+		if v, err := r.ReadBits(n); err != nil || v != values[i] {
+			t.Fatalf("read %d bits: %#x, %v, want %#x", n, v, err, values[i])
+		}
+	}
+	r.Skip(r.BoundaryBits())
+	if b, err := r.ReadBytes(7); err != nil || string(b) != "aligned" {
+		t.Errorf("read bytes %q, %v", b, err)
+	}
+	if _, err := r.ReadBits(1); !errors.Is(err, deflate.ErrUnexpectedEnd) {
+		t.Errorf("err = %v, want ErrUnexpectedEnd", err)
+	}
+
+	// Offsets of a ranged reader stay relative to the data
+	r = deflate.NewBitReaderAt(data, 4, 12)
+	if v, err := r.ReadBits(8); err != nil || v != (values[0]|values[1]<<1|values[2]<<4)>>4&0xFF {
+		t.Errorf("ranged read %#x, %v", v, err)
+	}
+	if r.Offset() != 12 || r.Remaining() != 0 {
+		t.Errorf("ranged reader at %d, %d left", r.Offset(), r.Remaining())
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	for _, tt := range []struct{ length, sym int }{{3, 0}, {10, 7}, {11, 8}, {12, 8}, {257, 27}, {258, 28}} {
+		if got := deflate.LengthSymbol(tt.length); got != tt.sym {
+			t.Errorf("LengthSymbol(%d) = %d, want %d", tt.length, got, tt.sym)
+		}
+	}
+	for _, tt := range []struct{ distance, sym int }{{1, 0}, {4, 3}, {5, 4}, {6, 4}, {24577, 29}, {32768, 29}} {
+		if got := deflate.DistanceSymbol(tt.distance); got != tt.sym {
+			t.Errorf("DistanceSymbol(%d) = %d, want %d", tt.distance, got, tt.sym)
+		}
+	}
+}
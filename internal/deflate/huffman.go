@@ -0,0 +1,173 @@
+package deflate
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxCodeBits is the longest Huffman code of the format.
+const MaxCodeBits = 15
+
+// ErrInvalidCode is returned when the input has no valid Huffman code.
+var ErrInvalidCode = errors.New("deflate: invalid huffman code")
+
+// Length and distance symbol tables of RFC 1951 3.2.5
+var (
+	LengthBase = [29]uint16{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+		35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258,
+	}
+	LengthExtra = [29]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+		3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0,
+	}
+	DistanceBase = [30]uint16{
+		1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193,
+		257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577,
+	}
+	DistanceExtra = [30]uint8{
+		0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6,
+		7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13,
+	}
+
+	// CodeLengthOrder is the order the code length code lengths are stored in
+	CodeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// Huffman is a canonical Huffman code usable for decoding and encoding.
+type Huffman struct {
+	lens    []uint8
+	codes   []uint16 // bit reversed, ready to be written LSB first
+	table   []uint16 // symbol<<4 | length, indexed by maxBits peeked bits
+	maxBits uint
+}
+
+// NewHuffman builds the canonical code for the code lengths lens. Over
+// subscribed codes are rejected, incomplete ones are accepted.
+func NewHuffman(lens []uint8) (*Huffman, error) {
+	var count [MaxCodeBits + 1]int
+	maxBits := uint(0)
+	for _, l := range lens {
+		if l > MaxCodeBits {
+			return nil, fmt.Errorf("deflate: code length %d too long", l)
+		}
+		count[l]++
+		maxBits = max(maxBits, uint(l))
+	}
+	count[0] = 0
+
+	left := 1
+	for l := 1; l <= MaxCodeBits; l++ {
+		left = left<<1 - count[l]
+		if left < 0 {
+			return nil, errors.New("deflate: over subscribed huffman code")
+		}
+	}
+
+	var next [MaxCodeBits + 2]int
+	code := 0
+	for l := 1; l <= MaxCodeBits; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	h := &Huffman{
+		lens:    lens,
+		codes:   make([]uint16, len(lens)),
+		table:   make([]uint16, 1<<maxBits),
+		maxBits: maxBits,
+	}
+	for sym, l := range lens {
+		if l == 0 {
+			continue
+		}
+		rev := reverse(uint16(next[l]), uint(l))
+		next[l]++
+		h.codes[sym] = rev
+		for i := int(rev); i < len(h.table); i += 1 << l {
+			h.table[i] = uint16(sym)<<4 | uint16(l)
+		}
+	}
+	return h, nil
+}
+
+func reverse(code uint16, n uint) uint16 {
+	var r uint16
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | code&1
+		code >>= 1
+	}
+	return r
+}
+
+// Decode reads one symbol.
+func (h *Huffman) Decode(r *BitReader) (int, error) {
+	entry := h.table[r.Peek(h.maxBits)]
+	n := uint(entry & 0xF)
+	if n == 0 {
+		return 0, ErrInvalidCode
+	}
+	if err := r.Skip(n); err != nil {
+		return 0, err
+	}
+	return int(entry >> 4), nil
+}
+
+// Encode writes the code of sym.
+func (h *Huffman) Encode(w *BitWriter, sym int) error {
+	if sym >= len(h.lens) || h.lens[sym] == 0 {
+		return fmt.Errorf("deflate: symbol %d has no code", sym)
+	}
+	w.WriteBits(uint(h.lens[sym]), uint32(h.codes[sym]))
+	return nil
+}
+
+var fixedLitLen, fixedDistance *Huffman
+
+func init() {
+	lens := make([]uint8, 288)
+	for i := range lens {
+		switch {
+		case i < 144:
+			lens[i] = 8
+		case i < 256:
+			lens[i] = 9
+		case i < 280:
+			lens[i] = 7
+		default:
+			lens[i] = 8
+		}
+	}
+	fixedLitLen, _ = NewHuffman(lens)
+
+	dist := make([]uint8, 30)
+	for i := range dist {
+		dist[i] = 5
+	}
+	fixedDistance, _ = NewHuffman(dist)
+}
+
+// FixedHuffman returns the literal/length and distance codes of fixed
+// Huffman blocks.
+func FixedHuffman() (litlen, distance *Huffman) {
+	return fixedLitLen, fixedDistance
+}
+
+// LengthSymbol returns the length symbol index (symbol - 257) for a match
+// length in [3, 258].
+func LengthSymbol(length int) int {
+	idx := 0
+	for idx+1 < len(LengthBase) && int(LengthBase[idx+1]) <= length {
+		idx++
+	}
+	return idx
+}
+
+// DistanceSymbol returns the distance symbol for a distance in [1, 32768].
+func DistanceSymbol(distance int) int {
+	idx := 0
+	for idx+1 < len(DistanceBase) && int(DistanceBase[idx+1]) <= distance {
+		idx++
+	}
+	return idx
+}
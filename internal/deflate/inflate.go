@@ -0,0 +1,170 @@
+package deflate
+
+import (
+	"errors"
+	"fmt"
+)
+
+// WindowSize is the longest back reference distance of the format.
+const WindowSize = 1 << 15
+
+// InflateBlock decodes the block at r, appending its output to out, and
+// reports whether it is the final block. out must end with the output
+// preceding the block, the last WindowSize bytes at least, which back
+// references copy from. r is left at the end of the block.
+func InflateBlock(r *BitReader, out []byte) (_ []byte, final bool, err error) {
+	header, err := r.ReadBits(3)
+	if err != nil {
+		return out, false, err
+	}
+	final = header&1 == 1
+
+	var litlen, distance *Huffman
+	switch header >> 1 {
+	case 0:
+		r.Skip(r.BoundaryBits())
+		lens, err := r.ReadBits(32)
+		if err != nil {
+			return out, false, err
+		}
+		length, nlength := lens&0xFFFF, lens>>16
+		if length^nlength != 0xFFFF {
+			return out, false, fmt.Errorf("deflate: bad uncompressed block length %d/%d", length, nlength)
+		}
+		data, err := r.ReadBytes(int(length))
+		if err != nil {
+			return out, false, err
+		}
+		return append(out, data...), final, nil
+	case 1:
+		litlen, distance = FixedHuffman()
+	case 2:
+		litlen, distance, err = readDynamicTables(r)
+		if err != nil {
+			return out, false, err
+		}
+	default:
+		return out, false, errors.New("deflate: invalid block type 3")
+	}
+
+	for {
+		sym, err := litlen.Decode(r)
+		if err != nil {
+			return out, false, err
+		}
+		if sym < 256 {
+			out = append(out, byte(sym))
+			continue
+		}
+		if sym == 256 {
+			return out, final, nil
+		}
+
+		idx := sym - 257
+		if idx >= len(LengthBase) {
+			return out, false, fmt.Errorf("deflate: invalid length symbol %d", sym)
+		}
+		extra, err := r.ReadBits(uint(LengthExtra[idx]))
+		if err != nil {
+			return out, false, err
+		}
+		length := int(LengthBase[idx]) + int(extra)
+
+		dsym, err := distance.Decode(r)
+		if err != nil {
+			return out, false, err
+		}
+		if dsym >= len(DistanceBase) {
+			return out, false, fmt.Errorf("deflate: invalid distance symbol %d", dsym)
+		}
+		extra, err = r.ReadBits(uint(DistanceExtra[dsym]))
+		if err != nil {
+			return out, false, err
+		}
+		dist := int(DistanceBase[dsym]) + int(extra)
+		if dist > len(out) {
+			return out, false, fmt.Errorf("deflate: distance %d before the start of the output", dist)
+		}
+
+		// Overlapping copies repeat the last dist bytes
+		start := len(out) - dist
+		for length > 0 {
+			n := min(length, dist)
+			out = append(out, out[start:start+n]...)
+			start += n
+			length -= n
+		}
+	}
+}
+
+// readDynamicTables reads the code tables at the start of a dynamic block.
+func readDynamicTables(r *BitReader) (litlen, distance *Huffman, err error) {
+	counts, err := r.ReadBits(14)
+	if err != nil {
+		return nil, nil, err
+	}
+	num_lit_len, num_distance, num_codes := int(counts&0x1F)+257, int(counts>>5&0x1F)+1, int(counts>>10)+4
+	if num_lit_len > 286 || num_distance > 30 {
+		return nil, nil, fmt.Errorf("deflate: bad dynamic block code counts %d/%d", num_lit_len, num_distance)
+	}
+
+	code_lens := make([]uint8, 19)
+	for i := 0; i < num_codes; i++ {
+		l, err := r.ReadBits(3)
+		if err != nil {
+			return nil, nil, err
+		}
+		code_lens[CodeLengthOrder[i]] = uint8(l)
+	}
+	codes, err := NewHuffman(code_lens)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lens := make([]uint8, 0, num_lit_len+num_distance)
+	for len(lens) < num_lit_len+num_distance {
+		sym, err := codes.Decode(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sym < 16 {
+			lens = append(lens, uint8(sym))
+			continue
+		}
+
+		var extra uint32
+		var repeat int
+		var value uint8
+		switch sym {
+		case 16:
+			if len(lens) == 0 {
+				return nil, nil, errors.New("deflate: code length repeat without previous length")
+			}
+			extra, err = r.ReadBits(2)
+			repeat, value = 3+int(extra), lens[len(lens)-1]
+		case 17:
+			extra, err = r.ReadBits(3)
+			repeat = 3 + int(extra)
+		default:
+			extra, err = r.ReadBits(7)
+			repeat = 11 + int(extra)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(lens)+repeat > num_lit_len+num_distance {
+			return nil, nil, errors.New("deflate: code lengths overflow")
+		}
+		for ; repeat > 0; repeat-- {
+			lens = append(lens, value)
+		}
+	}
+
+	if litlen, err = NewHuffman(lens[:num_lit_len]); err != nil {
+		return nil, nil, err
+	}
+	if distance, err = NewHuffman(lens[num_lit_len:]); err != nil {
+		return nil, nil, err
+	}
+	return litlen, distance, nil
+}
@@ -0,0 +1,142 @@
+// Package lz4 implements the LZ4 block format as used by lz4diff: partial
+// block decoding, and ports of liblz4 1.9.4's LZ4_compress_destSize and
+// LZ4_compress_HC_destSize. The compressors must produce byte for byte the
+// output of the C library, since the payload generator recompressed the
+// patched data with it and only records fixups against that output.
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrCorrupt is returned for malformed compressed blocks.
+var ErrCorrupt = errors.New("lz4: corrupt block")
+
+const (
+	minMatch     = 4
+	lastLiterals = 5
+	mfLimit      = 12
+	minLength    = mfLimit + 1
+
+	mlBits  = 4
+	mlMask  = 1<<mlBits - 1
+	runMask = 1<<(8-mlBits) - 1
+
+	distanceMax = 65535
+)
+
+// CompressBound returns the worst case compressed size of n bytes.
+func CompressBound(n int) int {
+	return n + n/255 + 16
+}
+
+// DecompressPartial decodes the block src into dst and stops once dst is
+// full, like LZ4_decompress_safe_partial with targetOutputSize ==
+// dstCapacity. It returns the number of bytes written, less than len(dst)
+// if the block ends early.
+func DecompressPartial(dst, src []byte) (int, error) {
+	ip, op := 0, 0
+	for op < len(dst) {
+		if ip >= len(src) {
+			return op, ErrCorrupt
+		}
+		token := src[ip]
+		ip++
+
+		length, n := readLength(src[ip:], int(token>>mlBits))
+		if n < 0 {
+			return op, ErrCorrupt
+		}
+		ip += n
+		if length > len(src)-ip {
+			return op, ErrCorrupt
+		}
+		op += copy(dst[op:], src[ip:ip+length])
+		ip += length
+		if op == len(dst) || ip == len(src) {
+			// Output full or last literals of the block
+			return op, nil
+		}
+
+		if len(src)-ip < 2 {
+			return op, ErrCorrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[ip:]))
+		ip += 2
+		if offset == 0 || offset > op {
+			return op, ErrCorrupt
+		}
+
+		length, n = readLength(src[ip:], int(token&mlMask))
+		if n < 0 {
+			return op, ErrCorrupt
+		}
+		ip += n
+		length += minMatch
+
+		// Overlapping copy, byte by byte
+		match := op - offset
+		for end := min(op+length, len(dst)); op < end; op++ {
+			dst[op] = dst[match]
+			match++
+		}
+	}
+	return op, nil
+}
+
+// readLength completes a 4 bit length of a token with its extension bytes.
+// It returns the length and the number of bytes read, -1 if src ran out.
+func readLength(src []byte, length int) (int, int) {
+	if length != runMask {
+		return length, 0
+	}
+	for n := 0; n < len(src); n++ {
+		length += int(src[n])
+		if src[n] != 255 {
+			return length, n + 1
+		}
+	}
+	return 0, -1
+}
+
+// putLength writes the extension bytes of a length that did not fit the
+// token, length being what is left after the token's 15.
+func putLength(dst []byte, op int, length int) int {
+	for ; length >= 255; length -= 255 {
+		dst[op] = 255
+		op++
+	}
+	dst[op] = byte(length)
+	return op + 1
+}
+
+// count returns how many bytes at a and b match, a stopping at limit.
+func count(src []byte, a, b, limit int) int {
+	start := a
+	for a+8 <= limit {
+		if diff := binary.LittleEndian.Uint64(src[a:]) ^ binary.LittleEndian.Uint64(src[b:]); diff != 0 {
+			return a - start + trailingZeroBytes(diff)
+		}
+		a += 8
+		b += 8
+	}
+	for a < limit && src[a] == src[b] {
+		a++
+		b++
+	}
+	return a - start
+}
+
+func trailingZeroBytes(v uint64) int {
+	n := 0
+	for v&0xff == 0 {
+		v >>= 8
+		n++
+	}
+	return n
+}
+
+func read32(src []byte, p int) uint32 {
+	return binary.LittleEndian.Uint32(src[p:])
+}
@@ -0,0 +1,216 @@
+package lz4
+
+import (
+	"encoding/binary"
+)
+
+const (
+	hashLog     = 12 // LZ4_MEMORY_USAGE 14
+	limit64K    = 64<<10 + mfLimit - 1
+	skipTrigger = 6
+)
+
+// CompressDestSize compresses as much of src as fits in dst with the default
+// (acceleration 1) LZ4 compressor, as LZ4_compress_destSize does. It returns
+// the compressed size and the number of bytes of src consumed.
+func CompressDestSize(dst, src []byte) (int, int) {
+	c := fastCompressor{
+		src:  src,
+		dst:  dst,
+		fill: len(dst) < CompressBound(len(src)),
+		u16:  len(src) < limit64K,
+	}
+	if c.u16 {
+		c.table = make([]uint32, 1<<(hashLog+1))
+	} else {
+		c.table = make([]uint32, 1<<hashLog)
+	}
+	return c.compress()
+}
+
+// fastCompressor is LZ4_compress_generic for a fresh stream without
+// dictionary, in either notLimited or fillOutput mode.
+type fastCompressor struct {
+	src, dst []byte
+	table    []uint32
+	fill     bool // fillOutput, stop at the end of dst
+	u16      bool // byU16 table of inputs under 64KB, byU32 otherwise
+}
+
+func (c *fastCompressor) hash(p int) uint32 {
+	if c.u16 {
+		return (read32(c.src, p) * 2654435761) >> (minMatch*8 - (hashLog + 1))
+	}
+	return uint32(((binary.LittleEndian.Uint64(c.src[p:]) << 24) * 889523592379) >> (64 - hashLog))
+}
+
+func (c *fastCompressor) compress() (int, int) {
+	src, dst := c.src, c.dst
+	iend := len(src)
+	mflimitPlusOne := iend - mfLimit + 1
+	matchlimit := iend - lastLiterals
+	olimit := len(dst)
+
+	if c.fill && olimit < 1 {
+		return 0, 0
+	}
+
+	ip, anchor, op := 0, 0, 0
+	var match, token, filledIp int
+	var forwardH uint32
+
+	if iend < minLength {
+		goto lastLiterals
+	}
+
+	c.table[c.hash(ip)] = 0
+	ip++
+	forwardH = c.hash(ip)
+
+	for {
+		// Find a match
+		{
+			forwardIp := ip
+			step := 1
+			searchMatchNb := 1 << skipTrigger
+			for {
+				h := forwardH
+				current := uint32(forwardIp)
+				matchIndex := c.table[h]
+				ip = forwardIp
+				forwardIp += step
+				step = searchMatchNb >> skipTrigger
+				searchMatchNb++
+
+				if forwardIp > mflimitPlusOne {
+					goto lastLiterals
+				}
+
+				match = int(matchIndex)
+				forwardH = c.hash(forwardIp)
+				c.table[h] = current
+
+				if !c.u16 && matchIndex+distanceMax < current {
+					continue // too far
+				}
+				if read32(src, match) == read32(src, ip) {
+					break
+				}
+			}
+		}
+
+		// Catch up
+		filledIp = ip
+		for ip > anchor && match > 0 && src[ip-1] == src[match-1] {
+			ip--
+			match--
+		}
+
+		// Encode literals
+		{
+			litLength := ip - anchor
+			token = op
+			op++
+			if c.fill && op+(litLength+240)/255+litLength+2+1+mfLimit-minMatch > olimit {
+				op--
+				goto lastLiterals
+			}
+			if litLength >= runMask {
+				dst[token] = runMask << mlBits
+				op = putLength(dst, op, litLength-runMask)
+			} else {
+				dst[token] = byte(litLength << mlBits)
+			}
+			op += copy(dst[op:], src[anchor:ip])
+		}
+
+	nextMatch:
+		if c.fill && op+2+1+mfLimit-minMatch > olimit {
+			// The match is too close to the end, rewind to last literals
+			op = token
+			goto lastLiterals
+		}
+
+		// Encode offset
+		binary.LittleEndian.PutUint16(dst[op:], uint16(ip-match))
+		op += 2
+
+		// Encode match length
+		{
+			matchCode := count(src, ip+minMatch, match+minMatch, matchlimit)
+			ip += matchCode + minMatch
+
+			if c.fill && op+1+lastLiterals+(matchCode+240)/255 > olimit {
+				// Match description too long, reduce it
+				newMatchCode := 15 - 1 + (olimit-op-1-lastLiterals)*255
+				ip -= matchCode - newMatchCode
+				matchCode = newMatchCode
+				if ip <= filledIp {
+					// Drop the positions hashed past the new ip
+					for ptr := ip; ptr <= filledIp; ptr++ {
+						c.table[c.hash(ptr)] = 0
+					}
+				}
+			}
+			if matchCode >= mlMask {
+				dst[token] += mlMask
+				matchCode -= mlMask
+				for ; matchCode >= 255; matchCode -= 255 {
+					dst[op] = 255
+					op++
+				}
+				dst[op] = byte(matchCode)
+				op++
+			} else {
+				dst[token] += byte(matchCode)
+			}
+		}
+
+		anchor = ip
+
+		// Test end of chunk
+		if ip >= mflimitPlusOne {
+			break
+		}
+
+		// Fill table
+		c.table[c.hash(ip-2)] = uint32(ip - 2)
+
+		// Test next position
+		{
+			h := c.hash(ip)
+			current := uint32(ip)
+			matchIndex := c.table[h]
+			match = int(matchIndex)
+			c.table[h] = current
+			if (c.u16 || matchIndex+distanceMax >= current) && read32(src, match) == read32(src, ip) {
+				token = op
+				op++
+				dst[token] = 0
+				goto nextMatch
+			}
+		}
+
+		// Prepare next loop
+		ip++
+		forwardH = c.hash(ip)
+	}
+
+lastLiterals:
+	lastRun := iend - anchor
+	if c.fill && op+lastRun+1+(lastRun+255-runMask)/255 > olimit {
+		// Adapt lastRun to fill dst
+		lastRun = olimit - op - 1
+		lastRun -= (lastRun + 256 - runMask) / 256
+	}
+	if lastRun >= runMask {
+		dst[op] = runMask << mlBits
+		op = putLength(dst, op+1, lastRun-runMask)
+	} else {
+		dst[op] = byte(lastRun << mlBits)
+		op++
+	}
+	op += copy(dst[op:], src[anchor:anchor+lastRun])
+
+	return op, anchor + lastRun
+}
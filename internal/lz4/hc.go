@@ -0,0 +1,730 @@
+package lz4
+
+import (
+	"encoding/binary"
+)
+
+const (
+	hcHashLog       = 15
+	hcDictionaryLog = 16
+
+	// Index of src[0], LZ4HC_init_internal starts a fresh stream at 64KB
+	hcBase = 64 << 10
+
+	// LZ4HC compression levels
+	HCLevelMin     = 3
+	HCLevelDefault = 9
+	HCLevelOptMin  = 10
+	HCLevelMax     = 12
+
+	optimalML       = mlMask - 1 + minMatch
+	optNum          = 1 << 12
+	trailingLiteral = 3
+)
+
+// Search parameters of each compression level, lz4hc.c's clTable
+var hcLevels = [HCLevelMax + 1]struct {
+	optimal      bool
+	nbSearches   int
+	targetLength int
+}{
+	{false, 2, 16}, // 0, unused
+	{false, 2, 16}, // 1, unused
+	{false, 2, 16}, // 2, unused
+	{false, 4, 16},
+	{false, 8, 16},
+	{false, 16, 16},
+	{false, 32, 16},
+	{false, 64, 16},
+	{false, 128, 16},
+	{false, 256, 16},
+	{true, 96, 64},
+	{true, 512, 128},
+	{true, 16384, optNum},
+}
+
+// CompressHCDestSize compresses as much of src as fits in dst with the LZ4HC
+// compressor at level, as LZ4_compress_HC_destSize does. Levels below 1 use
+// the default level 9. It returns the compressed size and the number of
+// bytes of src consumed.
+func CompressHCDestSize(dst, src []byte, level int) (int, int) {
+	if level < 1 {
+		level = HCLevelDefault
+	}
+	level = min(level, HCLevelMax)
+
+	c := &hcCompressor{
+		src:          src,
+		dst:          dst,
+		nextToUpdate: hcBase,
+	}
+	if len(dst) < 1 {
+		return 0, 0
+	}
+	params := hcLevels[level]
+	if params.optimal {
+		return c.compressOptimal(params.nbSearches, params.targetLength, level == HCLevelMax)
+	}
+	return c.compressHashChain(params.nbSearches)
+}
+
+// hcCompressor is a fresh LZ4HC stream compressing src without dictionary
+// in fillOutput mode. Positions are indexes into src, table indexes are
+// offset by hcBase.
+type hcCompressor struct {
+	src, dst []byte
+
+	hashTable    [1 << hcHashLog]uint32
+	chainTable   [1 << hcDictionaryLog]uint16
+	nextToUpdate uint32
+
+	ip, op, anchor int
+}
+
+func (c *hcCompressor) hashPtr(p int) uint32 {
+	return (read32(c.src, p) * 2654435761) >> (minMatch*8 - hcHashLog)
+}
+
+// insert adds the positions up to ip to the hash chains.
+func (c *hcCompressor) insert(ip int) {
+	target := uint32(ip) + hcBase
+	for idx := c.nextToUpdate; idx < target; idx++ {
+		h := c.hashPtr(int(idx - hcBase))
+		delta := idx - c.hashTable[h]
+		if delta > distanceMax {
+			delta = distanceMax
+		}
+		c.chainTable[uint16(idx)] = uint16(delta)
+		c.hashTable[h] = idx
+	}
+	c.nextToUpdate = target
+}
+
+// countBack returns how far (as a negative number) the match at match
+// extends backwards from ip, ip not going below iMin.
+func (c *hcCompressor) countBack(ip, match, iMin int) int {
+	back := 0
+	lowest := max(iMin-ip, -match)
+	for back > lowest && c.src[ip+back-1] == c.src[match+back-1] {
+		back--
+	}
+	return back
+}
+
+// countPattern returns how many bytes from ip repeat the little endian bytes
+// of pattern, a sample of a repetitive pattern of length 1, 2 or 4.
+func (c *hcCompressor) countPattern(ip, iEnd int, pattern uint32) int {
+	n := 0
+	for ip+n < iEnd && c.src[ip+n] == byte(pattern>>(8*(n&3))) {
+		n++
+	}
+	return n
+}
+
+// reverseCountPattern is countPattern backwards from ip, not going below
+// iLow.
+func (c *hcCompressor) reverseCountPattern(ip, iLow int, pattern uint32) int {
+	start := ip
+	for ip >= iLow+4 && read32(c.src, ip-4) == pattern {
+		ip -= 4
+	}
+	for shift := 24; ip > iLow && c.src[ip-1] == byte(pattern>>shift); shift -= 8 {
+		ip--
+	}
+	return start - ip
+}
+
+// protectDictEnd reports whether a match index is not within the last 3
+// bytes before dictLimit.
+func protectDictEnd(dictLimit, matchIndex uint32) bool {
+	return (dictLimit-1)-matchIndex >= 3
+}
+
+// insertAndGetWiderMatch searches the hash chain of ip for a match longer
+// than longest, which may start before ip down to iLowLimit. It returns the
+// new longest length with the match and start positions, or the values
+// passed in if nothing better was found.
+func (c *hcCompressor) insertAndGetWiderMatch(ip, iLowLimit, iHighLimit, longest, matchpos, startpos, maxNbAttempts int, patternAnalysis, chainSwap bool) (int, int, int) {
+	const prefixIdx = hcBase
+	src := c.src
+	ipIndex := uint32(ip) + prefixIdx
+	lowestMatchIndex := uint32(prefixIdx)
+	if prefixIdx+distanceMax+1 <= ipIndex {
+		lowestMatchIndex = ipIndex - distanceMax
+	}
+	lookBackLength := ip - iLowLimit
+	nbAttempts := maxNbAttempts
+	matchChainPos := uint32(0)
+	pattern := read32(src, ip)
+
+	const (
+		repUntested = iota
+		repNot
+		repConfirmed
+	)
+	repeat := repUntested
+	srcPatternLength := 0
+
+	c.insert(ip)
+	matchIndex := c.hashTable[c.hashPtr(ip)]
+
+	for matchIndex >= lowestMatchIndex && nbAttempts > 0 {
+		matchLength := 0
+		nbAttempts--
+
+		matchPtr := int(matchIndex - prefixIdx)
+		if binary.LittleEndian.Uint16(src[iLowLimit+longest-1:]) == binary.LittleEndian.Uint16(src[matchPtr-lookBackLength+longest-1:]) &&
+			read32(src, matchPtr) == pattern {
+			back := 0
+			if lookBackLength != 0 {
+				back = c.countBack(ip, matchPtr, iLowLimit)
+			}
+			matchLength = minMatch + count(src, ip+minMatch, matchPtr+minMatch, iHighLimit)
+			matchLength -= back
+			if matchLength > longest {
+				longest = matchLength
+				matchpos = matchPtr + back
+				startpos = ip + back
+			}
+		}
+
+		if chainSwap && matchLength == longest && matchIndex+uint32(longest) <= ipIndex {
+			// Better match, select a better chain
+			const kTrigger = 4
+			distanceToNextMatch := uint32(1)
+			end := longest - minMatch + 1
+			step := 1
+			accel := 1 << kTrigger
+			for pos := 0; pos < end; pos += step {
+				candidateDist := uint32(c.chainTable[uint16(matchIndex+uint32(pos))])
+				step = accel >> kTrigger
+				accel++
+				if candidateDist > distanceToNextMatch {
+					distanceToNextMatch = candidateDist
+					matchChainPos = uint32(pos)
+					accel = 1 << kTrigger
+				}
+			}
+			if distanceToNextMatch > 1 {
+				if distanceToNextMatch > matchIndex {
+					break
+				}
+				matchIndex -= distanceToNextMatch
+				continue
+			}
+		}
+
+		distNextMatch := uint32(c.chainTable[uint16(matchIndex)])
+		if patternAnalysis && distNextMatch == 1 && matchChainPos == 0 {
+			matchCandidateIdx := matchIndex - 1
+			// May be a repeated pattern
+			if repeat == repUntested {
+				if pattern&0xffff == pattern>>16 && pattern&0xff == pattern>>24 {
+					repeat = repConfirmed
+					srcPatternLength = c.countPattern(ip+4, iHighLimit, pattern) + 4
+				} else {
+					repeat = repNot
+				}
+			}
+			if repeat == repConfirmed && matchCandidateIdx >= lowestMatchIndex && protectDictEnd(prefixIdx, matchCandidateIdx) {
+				matchPtr := int(matchCandidateIdx - prefixIdx)
+				if read32(src, matchPtr) == pattern {
+					forwardPatternLength := c.countPattern(matchPtr+4, iHighLimit, pattern) + 4
+					backLength := c.reverseCountPattern(matchPtr, 0, pattern)
+					// Do not go further back than lowestMatchIndex
+					backLength = int(matchCandidateIdx - max(matchCandidateIdx-uint32(backLength), lowestMatchIndex))
+					currentSegmentLength := backLength + forwardPatternLength
+
+					if currentSegmentLength >= srcPatternLength && forwardPatternLength <= srcPatternLength {
+						// Best position, full pattern, might be followed by more match
+						newMatchIndex := matchCandidateIdx + uint32(forwardPatternLength) - uint32(srcPatternLength)
+						if protectDictEnd(prefixIdx, newMatchIndex) {
+							matchIndex = newMatchIndex
+						} else {
+							matchIndex = prefixIdx
+						}
+					} else {
+						// Farthest position in the current segment
+						newMatchIndex := matchCandidateIdx - uint32(backLength)
+						if !protectDictEnd(prefixIdx, newMatchIndex) {
+							matchIndex = prefixIdx
+						} else {
+							matchIndex = newMatchIndex
+							if lookBackLength == 0 {
+								maxML := min(currentSegmentLength, srcPatternLength)
+								if longest < maxML {
+									if ipIndex-matchIndex > distanceMax {
+										break
+									}
+									longest = maxML
+									matchpos = int(matchIndex - prefixIdx)
+									startpos = ip
+								}
+								distToNextPattern := uint32(c.chainTable[uint16(matchIndex)])
+								if distToNextPattern > matchIndex {
+									break
+								}
+								matchIndex -= distToNextPattern
+							}
+						}
+					}
+					continue
+				}
+			}
+		}
+
+		// Follow the current chain
+		matchIndex -= uint32(c.chainTable[uint16(matchIndex+matchChainPos)])
+	}
+
+	return longest, matchpos, startpos
+}
+
+// encodeSequence writes the literals since anchor and a match of
+// matchLength at match, advancing ip, op and anchor. With limit it reports
+// false instead of writing past oend.
+func (c *hcCompressor) encodeSequence(matchLength, match int, limit bool, oend int) bool {
+	dst := c.dst
+	token := c.op
+	c.op++
+
+	length := c.ip - c.anchor
+	if limit && c.op+length/255+length+2+1+lastLiterals > oend {
+		return false
+	}
+	if length >= runMask {
+		dst[token] = runMask << mlBits
+		c.op = putLength(dst, c.op, length-runMask)
+	} else {
+		dst[token] = byte(length << mlBits)
+	}
+	c.op += copy(dst[c.op:], c.src[c.anchor:c.ip])
+
+	binary.LittleEndian.PutUint16(dst[c.op:], uint16(c.ip-match))
+	c.op += 2
+
+	length = matchLength - minMatch
+	if limit && c.op+length/255+1+lastLiterals > oend {
+		return false
+	}
+	if length >= mlMask {
+		dst[token] += mlMask
+		c.op = putLength(dst, c.op, length-mlMask)
+	} else {
+		dst[token] += byte(length)
+	}
+
+	c.ip += matchLength
+	c.anchor = c.ip
+	return true
+}
+
+// lastLiterals writes the literals since anchor, as many as fit before
+// oend, and returns the compressed size and consumed input.
+func (c *hcCompressor) lastLiterals(oend int) (int, int) {
+	lastRunSize := len(c.src) - c.anchor
+	llAdd := (lastRunSize + 255 - runMask) / 255
+	if c.op+1+llAdd+lastRunSize > oend {
+		// Adapt lastRunSize to fill dst
+		lastRunSize = oend - c.op - 1
+		llAdd = (lastRunSize + 256 - runMask) / 256
+		lastRunSize -= llAdd
+	}
+	c.ip = c.anchor + lastRunSize
+
+	if lastRunSize >= runMask {
+		c.dst[c.op] = runMask << mlBits
+		c.op = putLength(c.dst, c.op+1, lastRunSize-runMask)
+	} else {
+		c.dst[c.op] = byte(lastRunSize << mlBits)
+		c.op++
+	}
+	c.op += copy(c.dst[c.op:], c.src[c.anchor:c.ip])
+
+	return c.op, c.ip
+}
+
+// overflow encodes what fits of the sequence that did not fit at opSaved,
+// shortening its match, before the last literals.
+func (c *hcCompressor) overflow(opSaved, ml, ref, oend int) {
+	ll := c.ip - c.anchor
+	llTotalCost := 1 + (ll+240)/255 + ll
+	maxLitPos := oend - 3 // 2 for offset, 1 for token
+	c.op = opSaved
+	if c.op+llTotalCost <= maxLitPos {
+		// ll validated, now adjust match length
+		bytesLeftForMl := maxLitPos - (c.op + llTotalCost)
+		maxMlSize := minMatch + mlMask - 1 + bytesLeftForMl*255
+		ml = min(ml, maxMlSize)
+		if oend+lastLiterals-(c.op+llTotalCost+2)-1+ml >= mfLimit {
+			c.encodeSequence(ml, ref, false, oend)
+		}
+	}
+}
+
+// compressHashChain is LZ4HC_compress_hashChain, used by levels 1 to 9.
+func (c *hcCompressor) compressHashChain(maxNbAttempts int) (int, int) {
+	inputSize := len(c.src)
+	patternAnalysis := maxNbAttempts > 128 // levels 9+
+
+	iend := inputSize
+	mflimit := iend - mfLimit
+	matchlimit := iend - lastLiterals
+
+	// Keep room for the last literals, LZ4 format restriction
+	oend := len(c.dst) - lastLiterals
+
+	var ml0, ml, ml2, ml3 int
+	var start0, ref0 int
+	ref, start2, ref2, start3, ref3 := 0, 0, 0, 0, 0
+	optr := 0
+
+	if inputSize < minLength {
+		goto lastLiterals
+	}
+
+	for c.ip <= mflimit {
+		ml, ref, _ = c.insertAndGetWiderMatch(c.ip, c.ip, matchlimit, minMatch-1, ref, c.ip, maxNbAttempts, patternAnalysis, false)
+		if ml < minMatch {
+			c.ip++
+			continue
+		}
+
+		// Saved, in case we would skip too much
+		start0, ref0, ml0 = c.ip, ref, ml
+
+	search2:
+		if c.ip+ml <= mflimit {
+			ml2, ref2, start2 = c.insertAndGetWiderMatch(c.ip+ml-2, c.ip, matchlimit, ml, ref2, start2, maxNbAttempts, patternAnalysis, false)
+		} else {
+			ml2 = ml
+		}
+
+		if ml2 == ml {
+			// No better match, encode ML1
+			optr = c.op
+			if !c.encodeSequence(ml, ref, true, oend) {
+				goto destOverflow
+			}
+			continue
+		}
+
+		if start0 < c.ip && start2 < c.ip+ml0 {
+			// Squeezing ML1 between ML0 (original ML1) and ML2
+			c.ip, ref, ml = start0, ref0, ml0
+		}
+
+		if start2-c.ip < 3 {
+			// First match too small, removed
+			ml, c.ip, ref = ml2, start2, ref2
+			goto search2
+		}
+
+	search3:
+		// Here ml2 > ml1 and ip1+3 <= ip2 (usually < ip1+ml1)
+		if start2-c.ip < optimalML {
+			newMl := min(ml, optimalML)
+			if c.ip+newMl > start2+ml2-minMatch {
+				newMl = start2 - c.ip + ml2 - minMatch
+			}
+			if correction := newMl - (start2 - c.ip); correction > 0 {
+				start2 += correction
+				ref2 += correction
+				ml2 -= correction
+			}
+		}
+
+		if start2+ml2 <= mflimit {
+			ml3, ref3, start3 = c.insertAndGetWiderMatch(start2+ml2-3, start2, matchlimit, ml2, ref3, start3, maxNbAttempts, patternAnalysis, false)
+		} else {
+			ml3 = ml2
+		}
+
+		if ml3 == ml2 {
+			// No better match, encode ML1 and ML2
+			if start2 < c.ip+ml {
+				ml = start2 - c.ip
+			}
+			optr = c.op
+			if !c.encodeSequence(ml, ref, true, oend) {
+				goto destOverflow
+			}
+			c.ip = start2
+			optr = c.op
+			if !c.encodeSequence(ml2, ref2, true, oend) {
+				ml, ref = ml2, ref2
+				goto destOverflow
+			}
+			continue
+		}
+
+		if start3 < c.ip+ml+3 {
+			// Not enough space for match 2, remove it
+			if start3 >= c.ip+ml {
+				// Can write Seq1 immediately, Seq2 is removed so Seq3
+				// becomes Seq1
+				if start2 < c.ip+ml {
+					correction := c.ip + ml - start2
+					start2 += correction
+					ref2 += correction
+					ml2 -= correction
+					if ml2 < minMatch {
+						start2, ref2, ml2 = start3, ref3, ml3
+					}
+				}
+
+				optr = c.op
+				if !c.encodeSequence(ml, ref, true, oend) {
+					goto destOverflow
+				}
+				c.ip, ref, ml = start3, ref3, ml3
+				start0, ref0, ml0 = start2, ref2, ml2
+				goto search2
+			}
+
+			start2, ref2, ml2 = start3, ref3, ml3
+			goto search3
+		}
+
+		// Three ascending matches, write the first one ML1
+		if start2 < c.ip+ml {
+			if start2-c.ip < optimalML {
+				ml = min(ml, optimalML)
+				if c.ip+ml > start2+ml2-minMatch {
+					ml = start2 - c.ip + ml2 - minMatch
+				}
+				if correction := ml - (start2 - c.ip); correction > 0 {
+					start2 += correction
+					ref2 += correction
+					ml2 -= correction
+				}
+			} else {
+				ml = start2 - c.ip
+			}
+		}
+		optr = c.op
+		if !c.encodeSequence(ml, ref, true, oend) {
+			goto destOverflow
+		}
+
+		// ML2 becomes ML1, ML3 becomes ML2, find a new ML3
+		c.ip, ref, ml = start2, ref2, ml2
+		start2, ref2, ml2 = start3, ref3, ml3
+		goto search3
+	}
+
+lastLiterals:
+	return c.lastLiterals(oend + lastLiterals)
+
+destOverflow:
+	c.overflow(optr, ml, ref, oend)
+	goto lastLiterals
+}
+
+// hcMatch is a match found by the optimal parser, off 0 meaning none.
+type hcMatch struct {
+	off, len int
+}
+
+func (c *hcCompressor) findLongerMatch(ip, iHighLimit, minLen, nbSearches int) hcMatch {
+	matchLength, matchPtr, _ := c.insertAndGetWiderMatch(ip, ip, iHighLimit, minLen, 0, ip, nbSearches, true, true)
+	if matchLength <= minLen {
+		return hcMatch{}
+	}
+	return hcMatch{off: ip - matchPtr, len: matchLength}
+}
+
+func literalsPrice(litlen int) int {
+	price := litlen
+	if litlen >= runMask {
+		price += 1 + (litlen-runMask)/255
+	}
+	return price
+}
+
+func sequencePrice(litlen, mlen int) int {
+	price := 1 + 2 + literalsPrice(litlen) // token + 16 bit offset
+	if mlen >= mlMask+minMatch {
+		price += 1 + (mlen-(mlMask+minMatch))/255
+	}
+	return price
+}
+
+type hcOptimal struct {
+	price, off, mlen, litlen int
+}
+
+// compressOptimal is LZ4HC_compress_optimal, used by levels 10 to 12.
+func (c *hcCompressor) compressOptimal(nbSearches, sufficientLen int, fullUpdate bool) (int, int) {
+	opt := make([]hcOptimal, optNum+trailingLiteral)
+
+	iend := len(c.src)
+	mflimit := iend - mfLimit
+	matchlimit := iend - lastLiterals
+	opSaved := 0
+	ovml, ovref := minMatch, 0
+
+	// Keep room for the last literals, LZ4 format restriction
+	oend := len(c.dst) - lastLiterals
+	sufficientLen = min(sufficientLen, optNum-1)
+
+	for c.ip <= mflimit {
+		llen := c.ip - c.anchor
+		var bestMlen, bestOff, cur int
+		lastMatchPos := 0
+
+		firstMatch := c.findLongerMatch(c.ip, matchlimit, minMatch-1, nbSearches)
+		if firstMatch.len == 0 {
+			c.ip++
+			continue
+		}
+
+		if firstMatch.len > sufficientLen {
+			// Good enough, immediate encoding
+			matchPos := c.ip - firstMatch.off
+			opSaved = c.op
+			if !c.encodeSequence(firstMatch.len, matchPos, true, oend) {
+				ovml, ovref = firstMatch.len, matchPos
+				goto destOverflow
+			}
+			continue
+		}
+
+		// Set prices for the first positions (literals)
+		for rPos := 0; rPos < minMatch; rPos++ {
+			opt[rPos] = hcOptimal{price: literalsPrice(llen + rPos), mlen: 1, litlen: llen + rPos}
+		}
+		// Set prices using the initial match
+		for mlen := minMatch; mlen <= firstMatch.len; mlen++ {
+			opt[mlen] = hcOptimal{price: sequencePrice(llen, mlen), off: firstMatch.off, mlen: mlen, litlen: llen}
+		}
+		lastMatchPos = firstMatch.len
+		for addLit := 1; addLit <= trailingLiteral; addLit++ {
+			opt[lastMatchPos+addLit] = hcOptimal{price: opt[lastMatchPos].price + literalsPrice(addLit), mlen: 1, litlen: addLit}
+		}
+
+		// Check further positions
+		for cur = 1; cur < lastMatchPos; cur++ {
+			curPtr := c.ip + cur
+			if curPtr > mflimit {
+				break
+			}
+
+			if fullUpdate {
+				// Not useful to search here if the next position has the
+				// same or lower cost, unless cost rises sharply after
+				if opt[cur+1].price <= opt[cur].price && opt[cur+minMatch].price < opt[cur].price+3 {
+					continue
+				}
+			} else if opt[cur+1].price <= opt[cur].price {
+				continue
+			}
+
+			var newMatch hcMatch
+			if fullUpdate {
+				newMatch = c.findLongerMatch(curPtr, matchlimit, minMatch-1, nbSearches)
+			} else {
+				// Only test matches of minimum length
+				newMatch = c.findLongerMatch(curPtr, matchlimit, lastMatchPos-cur, nbSearches)
+			}
+			if newMatch.len == 0 {
+				continue
+			}
+
+			if newMatch.len > sufficientLen || newMatch.len+cur >= optNum {
+				// Immediate encoding
+				bestMlen = newMatch.len
+				bestOff = newMatch.off
+				lastMatchPos = cur + 1
+				goto encode
+			}
+
+			// Before the match, set prices with literals at the beginning
+			{
+				baseLitlen := opt[cur].litlen
+				for litlen := 1; litlen < minMatch; litlen++ {
+					price := opt[cur].price - literalsPrice(baseLitlen) + literalsPrice(baseLitlen+litlen)
+					pos := cur + litlen
+					if price < opt[pos].price {
+						opt[pos] = hcOptimal{price: price, mlen: 1, litlen: baseLitlen + litlen}
+					}
+				}
+			}
+
+			// Set prices using the match at cur
+			for ml := minMatch; ml <= newMatch.len; ml++ {
+				pos := cur + ml
+				var price, ll int
+				if opt[cur].mlen == 1 {
+					ll = opt[cur].litlen
+					if cur > ll {
+						price = opt[cur-ll].price
+					}
+					price += sequencePrice(ll, ml)
+				} else {
+					price = opt[cur].price + sequencePrice(0, ml)
+				}
+
+				if pos > lastMatchPos+trailingLiteral || price <= opt[pos].price {
+					if ml == newMatch.len && lastMatchPos < pos {
+						lastMatchPos = pos
+					}
+					opt[pos] = hcOptimal{price: price, off: newMatch.off, mlen: ml, litlen: ll}
+				}
+			}
+			// Complete the following positions with literals
+			for addLit := 1; addLit <= trailingLiteral; addLit++ {
+				opt[lastMatchPos+addLit] = hcOptimal{price: opt[lastMatchPos].price + literalsPrice(addLit), mlen: 1, litlen: addLit}
+			}
+		}
+
+		bestMlen = opt[lastMatchPos].mlen
+		bestOff = opt[lastMatchPos].off
+		cur = lastMatchPos - bestMlen
+
+	encode:
+		// Reverse traversal, looking for the shortest path
+		{
+			candidatePos := cur
+			selectedMatchLength := bestMlen
+			selectedOffset := bestOff
+			for {
+				nextMatchLength := opt[candidatePos].mlen
+				nextOffset := opt[candidatePos].off
+				opt[candidatePos].mlen = selectedMatchLength
+				opt[candidatePos].off = selectedOffset
+				selectedMatchLength = nextMatchLength
+				selectedOffset = nextOffset
+				if nextMatchLength > candidatePos {
+					break
+				}
+				candidatePos -= nextMatchLength
+			}
+		}
+
+		// Encode all recorded sequences in order
+		for rPos := 0; rPos < lastMatchPos; {
+			ml := opt[rPos].mlen
+			offset := opt[rPos].off
+			if ml == 1 {
+				// Literal
+				c.ip++
+				rPos++
+				continue
+			}
+			rPos += ml
+			opSaved = c.op
+			if !c.encodeSequence(ml, c.ip-offset, true, oend) {
+				ovml, ovref = ml, c.ip-offset
+				goto destOverflow
+			}
+		}
+	}
+
+lastLiterals:
+	return c.lastLiterals(oend + lastLiterals)
+
+destOverflow:
+	c.overflow(opSaved, ovml, ovref, oend)
+	goto lastLiterals
+}
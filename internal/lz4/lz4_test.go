@@ -0,0 +1,127 @@
+package lz4_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/affggh/payload_extract/internal/lz4"
+)
+
+// testInput returns n bytes of LZ4 friendly data: copies of earlier data,
+// runs of a byte and small literals.
+func testInput(n int, seed uint32) []byte {
+	data := make([]byte, 0, n)
+	x := seed
+	next := func() uint32 {
+		x = x*1664525 + 1013904223
+		return x >> 8
+	}
+	for len(data) < n {
+		switch r := next() % 8; {
+		case r < 3 && len(data) > 16:
+			start := int(next()) % len(data)
+			length := 4 + int(next()%200)
+			for i := 0; i < length && len(data) < n; i++ {
+				data = append(data, data[start+i])
+			}
+		case r < 4:
+			b := byte(next())
+			for i := int(next() % 300); i > 0 && len(data) < n; i-- {
+				data = append(data, b)
+			}
+		default:
+			for i := int(next() % 16); i >= 0 && len(data) < n; i-- {
+				data = append(data, byte(next()%64))
+			}
+		}
+	}
+	return data
+}
+
+// Output of liblz4 1.9.4 for testInput: LZ4_compress_destSize for level 0,
+// LZ4_compress_HC_destSize otherwise. hash is the first 8 bytes of the
+// SHA-256 of the compressed block.
+var referenceBlocks = []struct {
+	n        int
+	seed     uint32
+	level    int
+	target   int
+	size     int
+	consumed int
+	hash     string
+}{
+	{16384, 1, 0, 4096, 2247, 16384, "d83a2a73aaf5f22e"},
+	{16384, 1, 1, 4096, 2019, 16384, "d9bcbdc7f1d038b0"},
+	{16384, 1, 9, 4096, 1923, 16384, "c3c4b27b5c5ef796"},
+	{16384, 1, 12, 4096, 1923, 16384, "ec0d793a0b6377d9"},
+	{65536, 2, 0, 4096, 4096, 31380, "6b850521ab075489"},
+	{65536, 2, 0, 65809, 8916, 65536, "f1e9d6ec472daf96"},
+	{65536, 2, 1, 4096, 4096, 37235, "392d3946aba7d83f"},
+	{65536, 2, 9, 4096, 4096, 38983, "079f10ac17271098"},
+	{65536, 2, 9, 65809, 6653, 65536, "539465e9e2bd15a5"},
+	{65536, 2, 12, 4096, 4096, 38983, "e3cf757048d12bc4"},
+	{65536, 2, 12, 65809, 6650, 65536, "2a9d4db033494971"},
+	{200000, 3, 0, 4096, 4096, 30983, "2f93122ed355456e"},
+	{200000, 3, 0, 200800, 29278, 200000, "3a16504cd6a99bac"},
+	{200000, 3, 1, 200800, 24203, 200000, "dcd54aa36c925083"},
+	{200000, 3, 9, 4096, 4096, 38755, "e6d85238bdc470ce"},
+	{200000, 3, 9, 200800, 22679, 200000, "d922e2029c7c851a"},
+	{200000, 3, 12, 4096, 4096, 38763, "0f49f62ebab6c169"},
+	{200000, 3, 12, 200800, 22624, 200000, "7391f4b9a67baf10"},
+}
+
+func TestCompressMatchesReference(t *testing.T) {
+	for _, ref := range referenceBlocks {
+		src := testInput(ref.n, ref.seed)
+		dst := make([]byte, ref.target)
+		var size, consumed int
+		if ref.level == 0 {
+			size, consumed = lz4.CompressDestSize(dst, src)
+		} else {
+			size, consumed = lz4.CompressHCDestSize(dst, src, ref.level)
+		}
+		hash := sha256.Sum256(dst[:size])
+		if size != ref.size || consumed != ref.consumed || hex.EncodeToString(hash[:8]) != ref.hash {
+			t.Errorf("n %d level %d target %d: got %d bytes from %d (%x), want %d from %d (%s)",
+				ref.n, ref.level, ref.target, size, consumed, hash[:8], ref.size, ref.consumed, ref.hash)
+			continue
+		}
+
+		out := make([]byte, consumed)
+		n, err := lz4.DecompressPartial(out, dst[:size])
+		if err != nil || n != consumed || !bytes.Equal(out, src[:consumed]) {
+			t.Errorf("n %d level %d target %d: round trip failed: %d bytes, %v", ref.n, ref.level, ref.target, n, err)
+		}
+	}
+}
+
+func TestDecompressPartial(t *testing.T) {
+	src := testInput(20000, 4)
+	dst := make([]byte, lz4.CompressBound(len(src)))
+	size, _ := lz4.CompressHCDestSize(dst, src, lz4.HCLevelDefault)
+	block := dst[:size]
+
+	// Stops once the output is full
+	out := make([]byte, 5000)
+	if n, err := lz4.DecompressPartial(out, block); err != nil || n != len(out) || !bytes.Equal(out, src[:len(out)]) {
+		t.Errorf("partial decode: %d bytes, %v", n, err)
+	}
+
+	// A larger output is only filled up to the end of the block
+	out = make([]byte, len(src)+100)
+	if n, err := lz4.DecompressPartial(out, block); err != nil || n != len(src) {
+		t.Errorf("short block: %d bytes, %v", n, err)
+	}
+
+	// Truncated blocks do not fill the output, offsets before the output
+	// are rejected
+	if n, err := lz4.DecompressPartial(make([]byte, len(src)), block[:size/2]); err == nil && n == len(src) {
+		t.Error("truncated block decoded in full")
+	}
+	if _, err := lz4.DecompressPartial(make([]byte, 100), []byte{0x10, 'a', 0x10, 0x00, 0x00}); !errors.Is(err, lz4.ErrCorrupt) {
+		t.Errorf("bad offset: err = %v, want ErrCorrupt", err)
+	}
+}
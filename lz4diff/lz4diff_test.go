@@ -0,0 +1,177 @@
+package lz4diff_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/affggh/payload_extract/lz4diff"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testData returns n bytes of text compressing about 4:1 with LZ4.
+func testData(n int, seed int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < n; i++ {
+		fmt.Fprintf(&b, "entry %05d: %s\n", i*seed, strings.Repeat(string(rune('a'+(i+seed)%26)), 24))
+	}
+	return b.Bytes()[:n]
+}
+
+// bsdf2 returns an uncompressed BSDF2 patch from old to new made of a single
+// diff and extra entry.
+func bsdf2(old, new []byte) []byte {
+	var patch bytes.Buffer
+	offtout := func(x int) {
+		binary.Write(&patch, binary.LittleEndian, int64(x))
+	}
+	diff := min(len(old), len(new))
+	patch.WriteString("BSDF2\x00\x00\x00")
+	offtout(24)
+	offtout(diff)
+	offtout(len(new))
+	offtout(diff)
+	offtout(len(new) - diff)
+	offtout(0)
+	for i := 0; i < diff; i++ {
+		patch.WriteByte(new[i] - old[i])
+	}
+	patch.Write(new[diff:])
+	return patch.Bytes()
+}
+
+func appendBytes(b []byte, num protowire.Number, data []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, data)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func compressedFile(file *lz4diff.CompressedFile) []byte {
+	var b []byte
+	for _, block := range file.Blocks {
+		var info []byte
+		info = appendVarint(info, 1, block.UncompressedOffset)
+		info = appendVarint(info, 2, block.UncompressedLength)
+		info = appendVarint(info, 3, block.CompressedLength)
+		if block.Hash != nil {
+			info = appendBytes(info, 4, block.Hash)
+		}
+		if block.PostfixBspatch != nil {
+			info = appendBytes(info, 5, block.PostfixBspatch)
+		}
+		b = appendBytes(b, 1, info)
+	}
+	var algo []byte
+	algo = appendVarint(algo, 1, uint64(file.Algo))
+	algo = appendVarint(algo, 2, uint64(file.Level))
+	b = appendBytes(b, 2, algo)
+	if file.ZeroPadding {
+		b = appendVarint(b, 3, 1)
+	}
+	return b
+}
+
+func makePatch(src, dst *lz4diff.CompressedFile, innerType int, inner []byte) []byte {
+	var header []byte
+	header = appendBytes(header, 1, compressedFile(src))
+	header = appendBytes(header, 2, compressedFile(dst))
+	header = appendVarint(header, 3, uint64(innerType))
+
+	patch := []byte("LZ4DIFF")
+	patch = binary.BigEndian.AppendUint32(patch, 1)
+	patch = binary.BigEndian.AppendUint32(patch, uint32(len(header)))
+	patch = append(patch, header...)
+	return append(patch, inner...)
+}
+
+// blocks lays out 16KB clusters compressed to 4KB, the last one stored.
+func blocks(n int) []lz4diff.Block {
+	var blocks []lz4diff.Block
+	for off := 0; off < n; off += 16384 {
+		blocks = append(blocks, lz4diff.Block{
+			UncompressedOffset: uint64(off),
+			UncompressedLength: 16384,
+			CompressedLength:   4096,
+		})
+	}
+	last := &blocks[len(blocks)-1]
+	last.UncompressedLength = uint64(n) - last.UncompressedOffset
+	last.CompressedLength = last.UncompressedLength
+	return blocks
+}
+
+func TestPatch(t *testing.T) {
+	srcPlain := append(testData(3*16384, 1), bytes.Repeat([]byte{0x5a}, 4096)...)
+	srcFile := &lz4diff.CompressedFile{Blocks: blocks(len(srcPlain)), Algo: lz4diff.AlgoLZ4HC, Level: 9, ZeroPadding: true}
+	src, err := lz4diff.Compress(srcPlain, srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(src) != 3*4096+4096 || src[0] != 0 {
+		t.Fatalf("source has %d bytes, want zero padded 4KB clusters", len(src))
+	}
+	if plain, err := lz4diff.Decompress(src, srcFile); err != nil || !bytes.Equal(plain, srcPlain) {
+		t.Fatalf("source round trip failed: %v", err)
+	}
+	// Lengths no LZ4 block reaches are refused before allocating them
+	huge := *srcFile
+	huge.Blocks = append([]lz4diff.Block{}, srcFile.Blocks...)
+	huge.Blocks[1].UncompressedLength = 1 << 50
+	if _, err := lz4diff.Decompress(src, &huge); !errors.Is(err, lz4diff.ErrCorrupt) {
+		t.Errorf("err = %v, want ErrCorrupt", err)
+	}
+
+	dstPlain := append(testData(2*16384, 2), "trailing data"...)
+	dstFile := &lz4diff.CompressedFile{Blocks: blocks(2 * 16384)[:1], Algo: lz4diff.AlgoLZ4}
+	dstFile.Blocks = append(dstFile.Blocks, lz4diff.Block{UncompressedOffset: 16384, UncompressedLength: 16384, CompressedLength: 6000})
+	recompressed, err := lz4diff.Compress(dstPlain, dstFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The real second block differs from our recompression by one byte
+	want := append([]byte{}, recompressed...)
+	want[4096+10] ^= 0xff
+	hash := sha256.Sum256(recompressed[4096 : 4096+6000])
+	dstFile.Blocks[1].Hash = hash[:]
+	dstFile.Blocks[1].PostfixBspatch = bsdf2(recompressed[4096:4096+6000], want[4096:4096+6000])
+
+	patch := makePatch(srcFile, dstFile, lz4diff.InnerBSDIFF, bsdf2(srcPlain, dstPlain))
+	header, _, err := lz4diff.ParseHeader(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Src.Blocks) != 4 || !header.Src.ZeroPadding || header.Dst.Algo != lz4diff.AlgoLZ4 {
+		t.Errorf("unexpected header %+v", header)
+	}
+
+	got, err := lz4diff.Patch(src, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("patched data differs")
+	}
+	if size, err := lz4diff.NewSize(patch); err != nil || size != int64(len(want)) {
+		t.Errorf("NewSize = %d, %v, want %d", size, err, len(want))
+	}
+
+	// A postfix patch made for another recompression is refused
+	dstFile.Blocks[1].Hash = make([]byte, 32)
+	patch = makePatch(srcFile, dstFile, lz4diff.InnerBSDIFF, bsdf2(srcPlain, dstPlain))
+	if _, err := lz4diff.Patch(src, patch); !errors.Is(err, lz4diff.ErrRecompress) {
+		t.Errorf("err = %v, want ErrRecompress", err)
+	}
+
+	if _, err := lz4diff.Patch(src, append([]byte("LZ4DIFX"), patch[7:]...)); !errors.Is(err, lz4diff.ErrCorrupt) {
+		t.Errorf("err = %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,408 @@
+// Package lz4diff applies the patches of the LZ4DIFF_BSDIFF and
+// LZ4DIFF_PUFFDIFF operations, used for LZ4 compressed EROFS images. The
+// source blocks are LZ4 decompressed, patched with the inner bsdiff or
+// puffdiff patch, and recompressed with the algorithm recorded for the
+// destination. Blocks our compressor does not reproduce exactly are fixed up
+// by a per block "postfix" bsdiff patch.
+package lz4diff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/affggh/payload_extract/bsdiff"
+	"github.com/affggh/payload_extract/internal/lz4"
+	"github.com/affggh/payload_extract/puffin"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	magic   = "LZ4DIFF"
+	version = 1
+
+	// Leading zeros of a zero padded EROFS cluster are skipped within the
+	// first block only
+	blockSize = 4096
+
+	// Output bytes an LZ4 block decodes to per compressed byte at most, each
+	// length extension byte adding 255
+	maxRatio = 255
+)
+
+// Inner patch types of Lz4diffHeader.inner_type
+const (
+	InnerBSDIFF   = 0
+	InnerPUFFDIFF = 1
+)
+
+// Compression algorithms of CompressionAlgorithm.type
+const (
+	AlgoUncompressed = 0
+	AlgoLZ4          = 1
+	AlgoLZ4HC        = 2
+)
+
+var (
+	// ErrCorrupt is returned for malformed patches.
+	ErrCorrupt = errors.New("lz4diff: corrupt patch")
+	// ErrRecompress is returned when recompressing the patched data does not
+	// give the blocks the patch was generated against.
+	ErrRecompress = errors.New("lz4diff: recompressed block differs")
+)
+
+// Block is one compressed cluster of a file. Compressed blocks are laid out
+// back to back, blocks not smaller than their uncompressed data are stored.
+type Block struct {
+	UncompressedOffset uint64
+	UncompressedLength uint64
+	CompressedLength   uint64
+	// SHA-256 of the recompressed block, before the postfix patch
+	Hash []byte
+	// bsdiff patch from the recompressed block to the real one
+	PostfixBspatch []byte
+}
+
+// IsCompressed reports whether the block holds LZ4 data.
+func (b *Block) IsCompressed() bool {
+	return b.CompressedLength < b.UncompressedLength
+}
+
+// CompressedFile describes the LZ4 blocks of the source or destination.
+type CompressedFile struct {
+	Blocks      []Block
+	Algo        int
+	Level       int
+	ZeroPadding bool
+}
+
+// Header is the decoded Lz4diffHeader message of a patch.
+type Header struct {
+	Src       CompressedFile
+	Dst       CompressedFile
+	InnerType int
+}
+
+// The Lz4diffHeader protobuf of update_engine's lz4diff.proto:
+//
+//	message CompressedBlockInfo {
+//	  uint64 uncompressed_offset = 1;
+//	  uint64 uncompressed_length = 2;
+//	  uint64 compressed_length = 3;
+//	  bytes sha256_hash = 4;
+//	  bytes postfix_bspatch = 5;
+//	}
+//	message CompressionAlgorithm { Type type = 1; uint32 level = 2; }
+//	message CompressedFile {
+//	  repeated CompressedBlockInfo block_info = 1;
+//	  CompressionAlgorithm algo = 2;
+//	  bool zero_padding_enabled = 3;
+//	}
+//	message Lz4diffHeader {
+//	  CompressedFile src_info = 1;
+//	  CompressedFile dst_info = 2;
+//	  InnerPatchType inner_type = 3;
+//	}
+
+// walkMessage calls fn for each field of a protobuf message, passing the
+// varint value or the bytes of length delimited fields.
+func walkMessage(b []byte, fn func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrCorrupt, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrCorrupt, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := fn(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseBlock(data []byte) (Block, error) {
+	var block Block
+	err := walkMessage(data, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			block.UncompressedOffset = v
+		case 2:
+			block.UncompressedLength = v
+		case 3:
+			block.CompressedLength = v
+		case 4:
+			block.Hash = data
+		case 5:
+			block.PostfixBspatch = data
+		}
+		return nil
+	})
+	return block, err
+}
+
+func parseCompressedFile(data []byte) (CompressedFile, error) {
+	var file CompressedFile
+	err := walkMessage(data, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			block, err := parseBlock(data)
+			if err != nil {
+				return err
+			}
+			file.Blocks = append(file.Blocks, block)
+		case 2:
+			return walkMessage(data, func(num protowire.Number, v uint64, _ []byte) error {
+				switch num {
+				case 1:
+					file.Algo = int(v)
+				case 2:
+					file.Level = int(v)
+				}
+				return nil
+			})
+		case 3:
+			file.ZeroPadding = v != 0
+		}
+		return nil
+	})
+	return file, err
+}
+
+// ParseHeader decodes the header of an lz4diff patch and returns it with the
+// offset of the inner patch.
+func ParseHeader(patch []byte) (*Header, int, error) {
+	offset := len(magic) + 8
+	if len(patch) < offset || string(patch[:len(magic)]) != magic {
+		return nil, 0, fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	if v := binary.BigEndian.Uint32(patch[len(magic):]); v != version {
+		return nil, 0, fmt.Errorf("lz4diff: unsupported version %d", v)
+	}
+	size := binary.BigEndian.Uint32(patch[len(magic)+4:])
+	if uint64(size) > uint64(len(patch)-offset) {
+		return nil, 0, fmt.Errorf("%w: header size %d out of range", ErrCorrupt, size)
+	}
+
+	header := new(Header)
+	err := walkMessage(patch[offset:offset+int(size)], func(num protowire.Number, v uint64, data []byte) error {
+		var err error
+		switch num {
+		case 1:
+			header.Src, err = parseCompressedFile(data)
+		case 2:
+			header.Dst, err = parseCompressedFile(data)
+		case 3:
+			header.InnerType = int(v)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, offset + int(size), nil
+}
+
+// Decompress decompresses the blocks of file in data. Data past the last
+// block is copied as is.
+func Decompress(data []byte, file *CompressedFile) ([]byte, error) {
+	var out []byte
+	offset := uint64(0)
+	for i, block := range file.Blocks {
+		if block.CompressedLength > uint64(len(data))-offset {
+			return nil, fmt.Errorf("%w: block %d exceeds the source", ErrCorrupt, i)
+		}
+		cluster := data[offset : offset+block.CompressedLength]
+		offset += block.CompressedLength
+
+		if !block.IsCompressed() {
+			out = append(out, cluster...)
+			continue
+		}
+
+		if file.ZeroPadding {
+			margin := 0
+			for margin < min(blockSize, len(cluster)) && cluster[margin] == 0 {
+				margin++
+			}
+			cluster = cluster[margin:]
+		}
+
+		// The lengths come from the patch, cap them before allocating
+		if block.UncompressedLength > maxRatio*uint64(len(cluster)) {
+			return nil, fmt.Errorf("%w: block %d of %d bytes cannot decompress to %d bytes", ErrCorrupt, i, len(cluster), block.UncompressedLength)
+		}
+		start := len(out)
+		out = append(out, make([]byte, block.UncompressedLength)...)
+		n, err := lz4.DecompressPartial(out[start:], cluster)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", i, err)
+		}
+		if uint64(n) != block.UncompressedLength {
+			return nil, fmt.Errorf("%w: block %d decompresses to %d bytes, want %d", ErrCorrupt, i, n, block.UncompressedLength)
+		}
+	}
+	return append(out, data[offset:]...), nil
+}
+
+// Compress compresses data into the blocks of file, each block filling its
+// compressed length exactly. Data past the last block is copied as is.
+func Compress(data []byte, file *CompressedFile) ([]byte, error) {
+	var out []byte
+	end := uint64(0)
+	for i, block := range file.Blocks {
+		if block.UncompressedOffset != end {
+			return nil, fmt.Errorf("%w: block %d at %d, want %d", ErrCorrupt, i, block.UncompressedOffset, end)
+		}
+		end += block.UncompressedLength
+		if end > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: block %d exceeds the data", ErrCorrupt, i)
+		}
+		src := data[block.UncompressedOffset:end]
+
+		if !block.IsCompressed() {
+			out = append(out, src...)
+			continue
+		}
+
+		compressed := make([]byte, block.CompressedLength)
+		var n, consumed int
+		switch file.Algo {
+		case AlgoLZ4:
+			n, consumed = lz4.CompressDestSize(compressed, src)
+		case AlgoLZ4HC:
+			n, consumed = lz4.CompressHCDestSize(compressed, src, file.Level)
+		default:
+			return nil, fmt.Errorf("lz4diff: unsupported compression algorithm %d", file.Algo)
+		}
+		if n == 0 || consumed != len(src) {
+			return nil, fmt.Errorf("%w: block %d compressed %d of %d bytes", ErrRecompress, i, consumed, len(src))
+		}
+
+		if file.ZeroPadding {
+			// Compressed data ends the cluster
+			copy(compressed[len(compressed)-n:], compressed[:n])
+			clear(compressed[:len(compressed)-n])
+		}
+		out = append(out, compressed...)
+	}
+	return append(out, data[end:]...), nil
+}
+
+// applyPostfix checks the recompressed blocks of file against their hashes
+// and applies their postfix patches.
+func applyPostfix(data []byte, file *CompressedFile) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	offset := uint64(0)
+	for i, block := range file.Blocks {
+		if block.CompressedLength > uint64(len(data))-offset {
+			return nil, fmt.Errorf("%w: block %d exceeds the data", ErrCorrupt, i)
+		}
+		cluster := data[offset : offset+block.CompressedLength]
+		offset += block.CompressedLength
+
+		if len(block.Hash) != 0 {
+			if got := sha256.Sum256(cluster); !bytes.Equal(got[:], block.Hash) {
+				return nil, fmt.Errorf("%w: block %d has sha256 %x, want %x", ErrRecompress, i, got, block.Hash)
+			}
+		}
+		if len(block.PostfixBspatch) == 0 {
+			out = append(out, cluster...)
+			continue
+		}
+
+		fixed, err := bsdiff.Patch(cluster, block.PostfixBspatch)
+		if err != nil {
+			return nil, fmt.Errorf("block %d postfix: %w", i, err)
+		}
+		if uint64(len(fixed)) != block.CompressedLength {
+			return nil, fmt.Errorf("%w: block %d postfix patch gives %d bytes, want %d", ErrCorrupt, i, len(fixed), block.CompressedLength)
+		}
+		out = append(out, fixed...)
+	}
+	return append(out, data[offset:]...), nil
+}
+
+// NewSize returns the size of the output of patch: the output of the inner
+// patch with the destination blocks recompressed.
+func NewSize(patch []byte) (int64, error) {
+	header, offset, err := ParseHeader(patch)
+	if err != nil {
+		return 0, err
+	}
+
+	var patched int64
+	switch header.InnerType {
+	case InnerBSDIFF:
+		patched, err = bsdiff.NewSize(patch[offset:])
+	case InnerPUFFDIFF:
+		patched, err = puffin.NewSize(patch[offset:])
+	default:
+		return 0, fmt.Errorf("lz4diff: unsupported inner patch type %d", header.InnerType)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Stored blocks keep their size, as in Compress
+	size, end := patched, uint64(0)
+	for i, block := range header.Dst.Blocks {
+		end += block.UncompressedLength
+		if end < block.UncompressedLength || end > uint64(patched) {
+			return 0, fmt.Errorf("%w: block %d exceeds the data", ErrCorrupt, i)
+		}
+		if block.IsCompressed() {
+			size -= int64(block.UncompressedLength - block.CompressedLength)
+		}
+	}
+	return size, nil
+}
+
+// Patch applies an lz4diff patch to src and returns the destination data.
+func Patch(src []byte, patch []byte) ([]byte, error) {
+	header, offset, err := ParseHeader(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, err := Decompress(src, &header.Src)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+
+	var patched []byte
+	switch header.InnerType {
+	case InnerBSDIFF:
+		patched, err = bsdiff.Patch(decompressed, patch[offset:])
+	case InnerPUFFDIFF:
+		patched, err = puffin.Patch(decompressed, patch[offset:])
+	default:
+		return nil, fmt.Errorf("lz4diff: unsupported inner patch type %d", header.InnerType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recompressed, err := Compress(patched, &header.Dst)
+	if err != nil {
+		return nil, err
+	}
+	return applyPostfix(recompressed, &header.Dst)
+}
@@ -0,0 +1,280 @@
+package payload_extract_go
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+// Default amount of decoded operation data kept by a PartitionReader
+const defaultPartitionCacheSize = 32 << 20
+
+// partitionExtent maps a range of the partition image to the decoded output
+// of one operation.
+type partitionExtent struct {
+	offset    int64 // byte offset in the partition image
+	length    int64
+	operation int   // index in PartitionUpdate.operations
+	opOffset  int64 // byte offset in the decoded operation output
+}
+
+// PartitionReader gives random access to a partition image without
+// extracting it. A read fetches and decodes only the operations whose
+// destination extents cover the requested range, and keeps recently decoded
+// operations in a small cache. Blocks no operation writes, ZERO and DISCARD
+// operations read as zeros.
+//
+// ReadAt is safe for concurrent use, Read and Seek share one position.
+type PartitionReader struct {
+	payload   *Payload
+	partition *update_engine.PartitionUpdate
+	size      int64
+
+	extents []partitionExtent // sorted by offset
+
+	mu        sync.Mutex
+	pos       int64
+	cacheSize int64
+	cacheUsed int64
+	cacheLRU  *list.List // of *cachedOperation, most recent first
+	cached    map[int]*list.Element
+}
+
+type cachedOperation struct {
+	operation int
+	data      []byte
+}
+
+// OpenPartition returns a PartitionReader for the partition named name.
+func (payload *Payload) OpenPartition(name string) (*PartitionReader, error) {
+	partition := payload.Partition(name)
+	if partition == nil {
+		return nil, fmt.Errorf("partition %s not found in payload", name)
+	}
+	return NewPartitionReader(payload, partition)
+}
+
+// NewPartitionReader returns a PartitionReader for partition of payload.
+func NewPartitionReader(payload *Payload, partition *update_engine.PartitionUpdate) (*PartitionReader, error) {
+	block_size := int64(payload.BlockSize())
+
+	r := &PartitionReader{
+		payload:   payload,
+		partition: partition,
+		size:      int64(partition.GetNewPartitionInfo().GetSize()),
+		cacheSize: defaultPartitionCacheSize,
+		cacheLRU:  list.New(),
+		cached:    make(map[int]*list.Element),
+	}
+	if r.size == 0 {
+		r.size = partitionSize(partition, int(block_size))
+	}
+
+	for idx, operation := range partition.GetOperations() {
+		switch operation.GetType() {
+		case update_engine.InstallOperation_ZERO,
+			update_engine.InstallOperation_DISCARD:
+			continue // read as holes
+		}
+
+		op_offset := int64(0)
+		for _, ext := range operation.GetDstExtents() {
+			length := int64(ext.GetNumBlocks()) * block_size
+			r.extents = append(r.extents, partitionExtent{
+				offset:    int64(ext.GetStartBlock()) * block_size,
+				length:    length,
+				operation: idx,
+				opOffset:  op_offset,
+			})
+			op_offset += length
+		}
+	}
+	sort.Slice(r.extents, func(i, j int) bool {
+		return r.extents[i].offset < r.extents[j].offset
+	})
+
+	return r, nil
+}
+
+// SetCacheSize sets how many bytes of decoded operations are kept around.
+func (r *PartitionReader) SetCacheSize(size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cacheSize = size
+	r.evict()
+}
+
+// Size returns the partition image size.
+func (r *PartitionReader) Size() int64 {
+	return r.size
+}
+
+// Partition returns the partition being read.
+func (r *PartitionReader) Partition() *update_engine.PartitionUpdate {
+	return r.partition
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *PartitionReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("PartitionReader.ReadAt: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	want := len(p)
+	if remain := r.size - off; int64(want) > remain {
+		want = int(remain)
+	}
+
+	n := 0
+	for n < want {
+		cur := off + int64(n)
+
+		// Last extent starting at or before cur
+		i := sort.Search(len(r.extents), func(i int) bool {
+			return r.extents[i].offset > cur
+		}) - 1
+
+		if i < 0 || cur >= r.extents[i].offset+r.extents[i].length {
+			// Hole up to the next extent
+			end := off + int64(want)
+			if i+1 < len(r.extents) {
+				end = min(end, r.extents[i+1].offset)
+			}
+			clear(p[n : n+int(end-cur)])
+			n += int(end - cur)
+			continue
+		}
+
+		ext := r.extents[i]
+		data, err := r.decoded(ext.operation)
+		if err != nil {
+			return n, err
+		}
+
+		start := ext.opOffset + cur - ext.offset
+		end := min(ext.opOffset+ext.length, start+int64(want-n))
+		n += copy(p[n:], data[start:end])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (r *PartitionReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+
+	n, err := r.ReadAt(p, pos)
+
+	r.mu.Lock()
+	r.pos = pos + int64(n)
+	r.mu.Unlock()
+
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *PartitionReader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("PartitionReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("PartitionReader.Seek: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// decoded returns the decoded output of the operation at idx, from the cache
+// if possible.
+func (r *PartitionReader) decoded(idx int) ([]byte, error) {
+	r.mu.Lock()
+	if elem, ok := r.cached[idx]; ok {
+		r.cacheLRU.MoveToFront(elem)
+		r.mu.Unlock()
+		return elem.Value.(*cachedOperation).data, nil
+	}
+	r.mu.Unlock()
+
+	operation := r.partition.GetOperations()[idx]
+	data, err := r.decode(operation)
+	if err != nil {
+		return nil, fmt.Errorf("partition %s: operation %d: %w", r.partition.GetPartitionName(), idx, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cached[idx]; !ok {
+		r.cached[idx] = r.cacheLRU.PushFront(&cachedOperation{operation: idx, data: data})
+		r.cacheUsed += int64(len(data))
+		r.evict()
+	}
+	return data, nil
+}
+
+// evict drops least recently used operations until the cache fits, always
+// keeping the most recent one. Must be called with mu held.
+func (r *PartitionReader) evict() {
+	for r.cacheUsed > r.cacheSize && r.cacheLRU.Len() > 1 {
+		elem := r.cacheLRU.Back()
+		cached := elem.Value.(*cachedOperation)
+		r.cacheLRU.Remove(elem)
+		delete(r.cached, cached.operation)
+		r.cacheUsed -= int64(len(cached.data))
+	}
+}
+
+func (r *PartitionReader) decode(operation *update_engine.InstallOperation) ([]byte, error) {
+	data, err := r.payload.readOperationData(operation)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDataHash(operation, data, r.payload.dataOffset); err != nil {
+		return nil, err
+	}
+
+	zreader, err := newBlobReader(operation.GetType(), data)
+	if err != nil {
+		return nil, err
+	}
+	defer zreader.Close()
+
+	decoded, err := io.ReadAll(zreader)
+	if err != nil {
+		return nil, err
+	}
+
+	dst_length := extentsSize(operation.GetDstExtents(), r.payload.BlockSize())
+	if err := checkDataLength(int64(len(decoded)), dst_length, r.payload.BlockSize()); err != nil {
+		return nil, err
+	}
+	// Output ending within the last block is zero padded
+	if int64(len(decoded)) < dst_length {
+		decoded = append(decoded, make([]byte, dst_length-int64(len(decoded)))...)
+	}
+	return decoded, nil
+}
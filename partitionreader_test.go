@@ -0,0 +1,60 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+func TestPartitionReader(t *testing.T) {
+	tp := newTestPayload(4096)
+	boot := testImage(4096, 24, 3)
+	part := tp.addPartition("boot", boot)
+	tp.addImageOps(part, boot[:4096*16], 4)
+	// One operation scattered over two destination extents
+	scattered := append(append([]byte{}, boot[4096*20:4096*24]...), boot[4096*16:4096*20]...)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, scattered, ext(20, 4), ext(16, 4))
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := payload.OpenPartition("boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetCacheSize(4096 * 4)
+
+	if r.Size() != int64(len(boot)) {
+		t.Fatalf("size = %d, want %d", r.Size(), len(boot))
+	}
+
+	for _, tc := range []struct{ off, n int64 }{
+		{0, 100}, {4095, 2}, {4096 * 3, 4096 * 6}, {4096*16 - 10, 4096*4 + 20}, {4096*24 - 7, 7}, {0, 4096 * 24},
+	} {
+		buf := make([]byte, tc.n)
+		if _, err := r.ReadAt(buf, tc.off); err != nil {
+			t.Fatalf("ReadAt(%d, %d): %v", tc.off, tc.n, err)
+		}
+		if !bytes.Equal(buf, boot[tc.off:tc.off+tc.n]) {
+			t.Errorf("ReadAt(%d, %d) returned wrong data", tc.off, tc.n)
+		}
+	}
+
+	if _, err := r.ReadAt(make([]byte, 10), int64(len(boot))-5); err != io.EOF {
+		t.Errorf("read past end err = %v, want io.EOF", err)
+	}
+
+	r.Seek(4096*10, io.SeekStart)
+	all, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(all, boot[4096*10:]) {
+		t.Error("sequential read returned wrong data")
+	}
+}
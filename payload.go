@@ -3,6 +3,8 @@ package payload_extract_go
 import (
 	"bytes"
 	"compress/bzip2"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,14 +13,12 @@ import (
 	"os"
 	"path"
 	"slices"
-	"sort"
 	"sync"
 
 	"github.com/DataDog/zstd"
 	"github.com/affggh/payload_extract/update_engine"
 	"github.com/panjf2000/ants/v2"
 	xz "github.com/remyoudompheng/go-liblzma"
-	"github.com/schollz/progressbar/v3"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -52,54 +52,226 @@ func (p *PayloadHdr) Decode(data []byte) error {
 	}
 
 	_, err := binary.Decode(data, binary.BigEndian, p)
+	if p.Version == 1 {
+		p.ManifestSigLen = 0
+	}
 	return err
 }
 
 func (p *PayloadHdr) HdrSize() int {
+	if p.Version == 1 {
+		return hdrSizeV1
+	}
 	return binary.Size(*p)
 }
 
-func InitPayloadInfo(reader io.ReadSeeker) (*update_engine.DeltaArchiveManifest, error) {
+// Size of a version 1 header, which has no ManifestSigLen
+const hdrSizeV1 = 20
+
+// Bounds of the metadata lengths of a payload whose size is not known ahead,
+// well above what update_engine generates
+const (
+	maxManifestLen    = 256 << 20
+	maxManifestSigLen = 1 << 20
+)
+
+// Data blobs are allocated in chunks of at most this size as they are read
+const maxBlobChunk = 64 << 20
+
+// ErrHashMismatch is wrapped by errors reporting data that does not match the
+// hash recorded in the manifest.
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// Payload is a parsed payload.bin. It keeps the header, manifest and metadata
+// signature together with the absolute offset of the data blobs, so every tool
+// working on the payload shares one parse instead of seeking a shared reader.
+type Payload struct {
+	reader io.ReaderAt
+	size   int64
+
+	hdr         PayloadHdr
+	manifest    *update_engine.DeltaArchiveManifest
+	metadataSig []byte
+
+	metadataSize int64 // header + manifest, the range covered by the metadata signature
+	dataOffset   int64 // absolute offset of the first data blob
+}
+
+// Open parses the payload header, manifest and metadata signature from reader.
+// size is the total size of the payload in bytes.
+func Open(reader io.ReaderAt, size int64) (*Payload, error) {
+	p := &Payload{
+		reader: reader,
+		size:   size,
+	}
+
+	var err error
+	sr := io.NewSectionReader(reader, 0, size)
+	p.hdr, p.manifest, p.metadataSig, err = readPayloadMetadata(sr, size)
+	if err != nil {
+		return nil, err
+	}
+
+	p.metadataSize = int64(p.hdr.HdrSize()) + int64(p.hdr.ManifestLen)
+	p.dataOffset = p.metadataSize + int64(p.hdr.ManifestSigLen)
+	if p.dataOffset > size {
+		return nil, BadPayload("metadata exceeds payload size")
+	}
+
+	if p.manifest.SignaturesOffset != nil && p.SignatureOffset()+p.SignatureSize() > size {
+		return nil, BadPayload("payload signature exceeds payload size")
+	}
+
+	return p, nil
+}
+
+// Header returns the parsed payload header.
+func (p *Payload) Header() PayloadHdr {
+	return p.hdr
+}
+
+// Manifest returns the parsed DeltaArchiveManifest.
+func (p *Payload) Manifest() *update_engine.DeltaArchiveManifest {
+	return p.manifest
+}
+
+// MetadataSignature returns the raw serialized Signatures message stored
+// right after the manifest.
+func (p *Payload) MetadataSignature() []byte {
+	return p.metadataSig
+}
+
+// MetadataSize returns the size of header + manifest.
+func (p *Payload) MetadataSize() int64 {
+	return p.metadataSize
+}
+
+// DataOffset returns the absolute offset where the data blobs begin.
+// InstallOperation.data_offset is relative to it.
+func (p *Payload) DataOffset() int64 {
+	return p.dataOffset
+}
+
+// SignatureOffset returns the absolute offset of the payload signature blob.
+func (p *Payload) SignatureOffset() int64 {
+	return p.dataOffset + int64(p.manifest.GetSignaturesOffset())
+}
+
+// SignatureSize returns the size of the payload signature blob, zero if the
+// payload is not signed.
+func (p *Payload) SignatureSize() int64 {
+	return int64(p.manifest.GetSignaturesSize())
+}
+
+// Size returns the total payload size.
+func (p *Payload) Size() int64 {
+	return p.size
+}
+
+// Reader returns the underlying payload reader.
+func (p *Payload) Reader() io.ReaderAt {
+	return p.reader
+}
+
+// BlockSize returns the manifest block size.
+func (p *Payload) BlockSize() int {
+	return int(p.manifest.GetBlockSize())
+}
+
+// Partitions returns the partitions matching partitions_name in manifest
+// order, or every partition if partitions_name is empty.
+func (p *Payload) Partitions(partitions_name []string) []*update_engine.PartitionUpdate {
+	if len(partitions_name) == 0 {
+		return p.manifest.Partitions
+	}
+
+	var parts []*update_engine.PartitionUpdate
+	for _, part := range p.manifest.Partitions {
+		if slices.Contains(partitions_name, part.GetPartitionName()) {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// Partition returns the partition named name, or nil if there is none.
+func (p *Payload) Partition(name string) *update_engine.PartitionUpdate {
+	for _, part := range p.manifest.Partitions {
+		if part.GetPartitionName() == name {
+			return part
+		}
+	}
+	return nil
+}
+
+// readPayloadMetadata reads the header, manifest and metadata signature of a
+// payload of size bytes, or of unknown size if size is negative.
+func readPayloadMetadata(reader io.Reader, size int64) (PayloadHdr, *update_engine.DeltaArchiveManifest, []byte, error) {
 	hdr := PayloadHdr{}
 
-	binary.Read(reader, binary.BigEndian, &hdr)
+	// Version 1 headers have no metadata signature length
+	buf := make([]byte, hdr.HdrSize())
+	if _, err := io.ReadFull(reader, buf[:hdrSizeV1]); err != nil {
+		return hdr, nil, nil, BadPayload(err)
+	}
+	if !bytes.Equal(buf[:len(PAYLOAD_MAGIC)], []byte(PAYLOAD_MAGIC)) {
+		return hdr, nil, nil, BadPayload("invalid magic")
+	}
+	if binary.BigEndian.Uint64(buf[4:]) >= 2 {
+		if _, err := io.ReadFull(reader, buf[hdrSizeV1:]); err != nil {
+			return hdr, nil, nil, BadPayload(err)
+		}
+	}
+	if err := hdr.Decode(buf); err != nil {
+		return hdr, nil, nil, err
+	}
 
 	//fmt.Printf("%v\n", hdr)
 
-	if !bytes.Equal(hdr.Magic[:], []byte(PAYLOAD_MAGIC)) {
-		return nil, BadPayload("invalid magic")
-	}
 	if hdr.Version != 2 {
 		Logger.Println("Warning: payload version is", hdr.Version, "which is not equal to 2!")
 	}
 	if hdr.ManifestLen == 0 {
-		return nil, BadPayload("manifest length is zero")
+		return hdr, nil, nil, BadPayload("manifest length is zero")
 	}
-	if hdr.ManifestSigLen == 0 {
-		return nil, BadPayload("manifest signature length is zero")
+	if hdr.Version >= 2 && hdr.ManifestSigLen == 0 {
+		return hdr, nil, nil, BadPayload("manifest signature length is zero")
+	}
+	// The lengths are allocated before anything checks them
+	if size >= 0 {
+		remaining := uint64(max(size-int64(hdr.HdrSize()), 0))
+		if hdr.ManifestLen > remaining || uint64(hdr.ManifestSigLen) > remaining-hdr.ManifestLen {
+			return hdr, nil, nil, BadPayload("metadata exceeds payload size")
+		}
+	} else if hdr.ManifestLen > maxManifestLen || hdr.ManifestSigLen > maxManifestSigLen {
+		return hdr, nil, nil, BadPayload(fmt.Sprintf("manifest length %d or signature length %d too large", hdr.ManifestLen, hdr.ManifestSigLen))
 	}
 
 	manifest := new(update_engine.DeltaArchiveManifest)
-	buf := make([]byte, hdr.ManifestLen)
-	_, err := reader.Read(buf)
-	if err != nil {
-		return nil, err
+	buf = make([]byte, hdr.ManifestLen)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return hdr, nil, nil, BadPayload(err)
 	}
 
-	if err = proto.Unmarshal(buf, manifest); err != nil {
-		return nil, err
+	if err := proto.Unmarshal(buf, manifest); err != nil {
+		return hdr, nil, nil, BadPayload(err)
 	}
 
-	if manifest.GetMinorVersion() != 0 {
-		//return nil, BadPayload("delta payloads are not supported, please use a full payload file")
-		Logger.Println("detect delta payloads may not supported, please use a full payload file")
+	sig := make([]byte, hdr.ManifestSigLen)
+	if _, err := io.ReadFull(reader, sig); err != nil {
+		return hdr, nil, nil, BadPayload(err)
 	}
 
-	// Skip signature
-	reader.Seek(int64(hdr.ManifestSigLen), io.SeekCurrent)
-	//io.CopyN(io.Discard, reader, int64(hdr.ManifestSigLen))
+	return hdr, manifest, sig, nil
+}
 
-	return manifest, nil
+// InitPayloadInfo parses the payload metadata from reader and leaves it
+// positioned at the first data blob.
+//
+// Deprecated: use Open, which also keeps the header and signatures.
+func InitPayloadInfo(reader io.ReadSeeker) (*update_engine.DeltaArchiveManifest, error) {
+	_, manifest, _, err := readPayloadMetadata(reader, -1)
+	return manifest, err
 }
 
 func PrintPartitionsInfo(manifest *update_engine.DeltaArchiveManifest, partitions_name []string) {
@@ -128,12 +300,7 @@ func PrintPartitionsInfo(manifest *update_engine.DeltaArchiveManifest, partition
 		}
 	}
 	for _, p := range parts {
-		partition_size := func() int64 {
-			last_operation, _ := last(p.Operations)
-			last_extents, _ := last(last_operation.DstExtents)
-
-			return int64((*last_extents.StartBlock + *last_extents.NumBlocks) * uint64(*manifest.BlockSize))
-		}()
+		partition_size := partitionSize(p, int(manifest.GetBlockSize()))
 
 		fmt.Printf("\t\t %-14s%d\n", *p.PartitionName, partition_size)
 	}
@@ -163,224 +330,441 @@ func write_zero(writer io.WriterAt, size int64, offset int64) (int64, error) {
 	return total_write, nil
 }
 
+// checkDataHash compares the blob of operation against its data_sha256_hash.
+// Operations without a recorded hash pass.
+func checkDataHash(operation *update_engine.InstallOperation, data []byte, base_offset int64) error {
+	want := operation.GetDataSha256Hash()
+	if len(want) == 0 {
+		return nil
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], want) {
+		return fmt.Errorf("%w: data at payload offset %d (data_offset %d, length %d) has sha256 %x, want %x",
+			ErrHashMismatch, base_offset+int64(operation.GetDataOffset()), operation.GetDataOffset(), len(data), got, want)
+	}
+	return nil
+}
+
+// newBlobReader returns a reader decompressing the data blob of a
+// REPLACE, REPLACE_BZ, REPLACE_XZ or ZSTD operation.
+func newBlobReader(op_type update_engine.InstallOperation_Type, data []byte) (io.ReadCloser, error) {
+	var breader = bytes.NewReader(data)
+	switch op_type {
+	case update_engine.InstallOperation_REPLACE:
+		return io.NopCloser(breader), nil
+	case update_engine.InstallOperation_REPLACE_BZ:
+		return io.NopCloser(bzip2.NewReader(breader)), nil
+	case update_engine.InstallOperation_REPLACE_XZ:
+		return xz.NewReader(breader)
+	case update_engine.InstallOperation_ZSTD:
+		return zstd.NewReader(breader), nil // lzma, zstd need close
+	}
+	return nil, BadPayload("unexpcted data type " + op_type.String())
+}
+
 func extractOperationToFile(
 	operation *update_engine.InstallOperation,
 	writer io.WriterAt,
-	out_offset int64,
 	block_size int,
 	data []byte,
-	progress_bar *progressbar.ProgressBar,
-	wg *sync.WaitGroup,
+	source io.ReaderAt,
+	punch_holes bool,
+	progress ProgressReporter,
+	name string,
 ) error {
-	defer wg.Done()
 	var write_len int
 	var err error
 	switch *operation.Type {
 	case update_engine.InstallOperation_REPLACE:
-		write_len, err = writer.WriteAt(data, out_offset)
+		write_len, err = writeExtents(writer, operation.GetDstExtents(), data, block_size)
 		if err != nil {
 			return err
 		}
-	case update_engine.InstallOperation_ZERO:
-		for _, ext := range operation.GetDstExtents() {
-			out_seek := *ext.StartBlock * uint64(block_size)
-			num_blocks := *ext.NumBlocks
-
-			xlen, err := write_zero(writer, int64(num_blocks), int64(out_seek))
-			if err != nil {
-				return err
-			}
-			write_len += int(xlen)
+	case update_engine.InstallOperation_ZERO,
+		update_engine.InstallOperation_DISCARD:
+		write_len, err = zeroExtents(writer, operation.GetDstExtents(), block_size, punch_holes)
+		if err != nil {
+			return err
 		}
 	case update_engine.InstallOperation_REPLACE_BZ,
 		update_engine.InstallOperation_REPLACE_XZ,
 		update_engine.InstallOperation_ZSTD:
-		var zreader io.Reader
-		var breader = bytes.NewReader(data)
-		if *operation.Type == update_engine.InstallOperation_REPLACE_BZ {
-			zreader = bzip2.NewReader(breader)
-		} else if *operation.Type == update_engine.InstallOperation_REPLACE_XZ {
-			zreader, err = xz.NewReader(breader)
-			if err != nil {
-				return err
-			}
-
-		} else if *operation.Type == update_engine.InstallOperation_ZSTD {
-			zreader = zstd.NewReader(breader)
+		zreader, err := newBlobReader(operation.GetType(), data)
+		if err != nil {
+			return err
 		}
+		defer zreader.Close()
 
-		closer, ok := zreader.(io.Closer)
-		if ok { // lzma, zstd need close
-			defer closer.Close()
+		w := newExtentWriter(writer, operation.GetDstExtents(), block_size)
+		if _, err := io.Copy(w, zreader); err != nil {
+			return err
 		}
-
-		w := io.NewOffsetWriter(writer, out_offset)
-		if l, err := io.Copy(w, zreader); err != nil {
+		if err := w.Finish(); err != nil {
+			return err
+		}
+		write_len = int(w.Written())
+	case update_engine.InstallOperation_SOURCE_COPY:
+		src_data, err := readSourceExtents(operation, source, block_size)
+		if err != nil {
+			return err
+		}
+		write_len, err = writeExtents(writer, operation.GetDstExtents(), src_data, block_size)
+		if err != nil {
+			return err
+		}
+	case update_engine.InstallOperation_SOURCE_BSDIFF,
+		update_engine.InstallOperation_BROTLI_BSDIFF,
+		update_engine.InstallOperation_PUFFDIFF,
+		update_engine.InstallOperation_ZUCCHINI,
+		update_engine.InstallOperation_LZ4DIFF_BSDIFF,
+		update_engine.InstallOperation_LZ4DIFF_PUFFDIFF:
+		write_len, err = applyDiffOperation(operation, writer, block_size, data, source)
+		if err != nil {
 			return err
-		} else {
-			write_len = int(l)
 		}
 	default:
 		return BadPayload("unexpcted data type")
 	}
 
-	progress_bar.Add(write_len)
+	progress.BytesWritten(name, int64(write_len))
 	return nil
 }
 
-func extractPartitionFromPayload(
+// readOperationData reads the data blob of operation, which must lie within
+// the payload. Streams are sized from the manifest itself, so the blob is
+// grown as it is read rather than allocated up front.
+func (p *Payload) readOperationData(operation *update_engine.InstallOperation) ([]byte, error) {
+	offset, length := operation.GetDataOffset(), operation.GetDataLength()
+	if data_size := uint64(max(p.size-p.dataOffset, 0)); offset > data_size || length > data_size-offset {
+		return nil, BadPayload(fmt.Sprintf("data at %d+%d exceeds the payload", offset, length))
+	}
+
+	var data []byte
+	for uint64(len(data)) < length {
+		chunk := int(min(length-uint64(len(data)), maxBlobChunk))
+		data = slices.Grow(data, chunk)
+		n, err := readFullAt(p.reader, data[len(data):len(data)+chunk], p.dataOffset+int64(offset)+int64(len(data)))
+		data = data[:len(data)+n]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// readFullAt reads len(buf) bytes at off, retrying short reads from readers
+// that do not fill the whole buffer in one ReadAt.
+func readFullAt(reader io.ReaderAt, buf []byte, off int64) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := reader.ReadAt(buf[total:], off+int64(total))
+		total += n
+		if total == len(buf) {
+			break
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return total, err
+		}
+		if n == 0 {
+			return total, io.ErrNoProgress
+		}
+	}
+	return total, nil
+}
+
+// readSeekerAt adapts an io.ReadSeeker without ReadAt to io.ReaderAt.
+type readSeekerAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (r *readSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r.rs, p)
+}
+
+// ExtractOptions controls Payload.Extract.
+type ExtractOptions struct {
+	// Partitions to extract, every partition if empty
+	Partitions []string
+	// Output directory, removed and recreated before extracting
+	OutDir string
+	// Thread pool workers
+	Workers int
+	// Progress receives progress events, nil discards them
+	Progress ProgressReporter
+	// Skip checking operation blobs against data_sha256_hash
+	SkipDataHash bool
+	// Source images of the previous build, required by delta payloads
+	Source SourceProvider
+	// Punch holes for ZERO and DISCARD operations instead of writing zeros,
+	// leaving sparse images where the filesystem supports it
+	PunchHoles bool
+	// Leave all-zero blocks of the output as holes instead of writing them
+	Sparse bool
+	// Format of the <name>.img files, raw by default
+	Format OutputFormat
+	// Split sparse images into <name>.img.0, <name>.img.1, ... files of at
+	// most this many bytes, like simg2simg, 0 for a single <name>.img
+	SimgMaxSize int64
+	// Append a CRC32 chunk with the image checksum to sparse images
+	SimgCRC bool
+	// Lay out the logical partitions of dynamic_partition_metadata in a
+	// super.img of this size instead of separate images, 0 to disable
+	SuperSize int64
+	// Metadata slots of super.img, 2 if 0
+	SuperMetadataSlots int
+	// Write the partitions named here to the block device mapped to them
+	// instead of an image, see ParseDeviceMap
+	Devices map[string]string
+	// Open block devices with O_DIRECT
+	DirectIO bool
+	// Compress images to <name>.img<Codec.Extension()>, streaming them in
+	// order instead of writing in place
+	Codec Codec
+	// Compression level of Codec, its default if 0
+	CodecLevel int
+	// Uncompressed size of the independently compressed frames of seekable
+	// zstd images, 2MiB if 0
+	ZstdFrameSize int
+}
+
+// ExtractPartitionsFromPayload parses the payload from reader and extracts
+// partitions_name (or every partition if empty) into out_dir.
+func ExtractPartitionsFromPayload(
 	reader io.ReadSeeker,
-	block_size int,
-	partition *update_engine.PartitionUpdate,
-	out_path string,
-	total_size int,
-	bar *progressbar.ProgressBar,
-	pool *ants.Pool,
+	partitions_name []string,
+	out_dir string,
+	max_workers int,
 ) error {
-	fd, err := os.Create(out_path)
+	size, err := reader.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
 
-	err = fd.Truncate(int64(total_size))
+	reader_at, ok := reader.(io.ReaderAt)
+	if !ok {
+		reader_at = &readSeekerAt{rs: reader}
+	}
+
+	payload, err := Open(reader_at, size)
 	if err != nil {
-		defer os.Remove(out_path)
 		return err
 	}
 
-	curr_data_offset := int64(0)
+	return payload.ExtractPartitions(partitions_name, out_dir, max_workers)
+}
 
-	operations := partition.Operations
-	sort.Slice(operations, func(i, j int) bool {
-		return *operations[i].DataOffset < *operations[j].DataOffset
+// ExtractPartitions extracts partitions_name (or every partition if empty)
+// into out_dir as <name>.img.
+func (payload *Payload) ExtractPartitions(
+	partitions_name []string,
+	out_dir string,
+	max_workers int,
+) error {
+	return payload.Extract(context.Background(), ExtractOptions{
+		Partitions: partitions_name,
+		OutDir:     out_dir,
+		Workers:    max_workers,
+		Progress:   NewTerminalProgress(os.Stderr),
 	})
+}
 
-	var wg sync.WaitGroup
-	//p, _ := ants.NewPool(runtime.NumCPU())
-	//Logger.Println("Process", partition.GetPartitionName(), "with threads:", runtime.NumCPU())
-	//defer p.Release()
+// Extract extracts the partitions selected by opts into opts.OutDir as
+// <name>.img (compressed with opts.Codec), or to their device of opts.Devices,
+// or into super.img with opts.SuperSize. Partitions are extracted together in
+// one pass over the payload data, read in data offset order, except
+// compressed and sparse images which are streamed one partition at a time,
+// from a seekable payload only. A failing
+// partition does not stop the others, the returned error joins the failures
+// of every partition. Cancelling ctx stops reading the payload, drains the
+// queued operations and returns ctx.Err().
+func (payload *Payload) Extract(ctx context.Context, opts ExtractOptions) error {
+	all_parts := payload.Partitions(opts.Partitions)
+	block_size := payload.BlockSize()
+
+	// Options are checked before OutDir is cleared
+	if opts.Codec != CodecNone && opts.Format != FormatRaw {
+		return errors.New("compressed images are only written raw")
+	}
+	if opts.Codec != CodecNone && payload.sequential() {
+		return fmt.Errorf("%w: compressed images are streamed in partition order", ErrNotSeekable)
+	}
+	if opts.Format == FormatSparseImage && payload.sequential() {
+		return fmt.Errorf("%w: sparse images are streamed in partition order", ErrNotSeekable)
+	}
+	var super *superLayout
+	if opts.SuperSize != 0 {
+		if opts.Format != FormatRaw {
+			return errors.New("super images are only written raw")
+		}
+		var err error
+		if super, err = payload.planSuper(all_parts, opts); err != nil {
+			return err
+		}
+	}
 
-	for _, operation := range operations {
-		data_len := *operation.DataLength
-		data_offset := *operation.DataOffset
+	// OutDir is left alone when every partition goes to a device
+	to_out_dir := super != nil || slices.ContainsFunc(all_parts, func(p *update_engine.PartitionUpdate) bool {
+		_, ok := opts.Devices[p.GetPartitionName()]
+		return !ok
+	})
+	if to_out_dir {
+		if err := os.RemoveAll(opts.OutDir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(opts.OutDir, 0777); err != nil {
+			return err
+		}
+	}
 
-		reader.Seek(int64(data_offset)-curr_data_offset, io.SeekCurrent)
+	progress := opts.Progress
+	if progress == nil {
+		progress = NopProgress{}
+	}
 
-		//data, err := io.ReadAll(io.LimitReader(reader, int64(data_len)))
-		//if err != nil {
-		//	return err
-		//}
-		data := make([]byte, data_len)
-		_, err = reader.Read(data)
-		if err != nil {
+	pool, err := ants.NewPool(opts.Workers)
+	if err != nil {
+		return err
+	}
+	defer pool.Release()
+
+	var super_fd *os.File
+	if super != nil {
+		if super_fd, err = createSuper(super, opts); err != nil {
 			return err
 		}
+	}
+
+	var errs []error
+	var targets []*partitionTarget
+	var streamed []*partitionTarget
+	for idx, p := range all_parts {
+		total_length := partitionSize(p, block_size)
 
-		curr_data_offset = int64(data_offset + data_len)
-		wg.Add(1)
-		err = pool.Submit(func() {
-			err := extractOperationToFile(
-				operation,
-				fd,
-				int64(operation.GetDstExtents()[0].GetStartBlock()*uint64(block_size)),
-				block_size,
-				data,
-				bar,
-				&wg,
-			)
+		var source io.ReaderAt
+		if needsSource(p) {
+			if opts.Source == nil {
+				errs = append(errs, fmt.Errorf("partition %s: delta update needs a source image", p.GetPartitionName()))
+				continue
+			}
+			source, err = opts.Source.OpenSource(p.GetPartitionName())
 			if err != nil {
-				Logger.Printf("Error: %v", err)
+				errs = append(errs, fmt.Errorf("partition %s: %w", p.GetPartitionName(), err))
+				continue
 			}
-		})
+		}
+
+		var target *partitionTarget
+		if device_path, ok := opts.Devices[p.GetPartitionName()]; ok {
+			target, err = payload.deviceTarget(p, opts, device_path)
+		} else if offset, ok := super.partition(p.GetPartitionName()); ok {
+			// The super image was truncated, its blocks are holes
+			target = &partitionTarget{writer: newSparseWriter(io.NewOffsetWriter(super_fd, offset), block_size)}
+		} else if opts.Codec != CodecNone || opts.Format == FormatSparseImage {
+			// Compressed and sparse images are streamed, not written in place
+			streamed = append(streamed, &partitionTarget{partition: p, index: idx, source: source})
+			continue
+		} else {
+			target, err = payload.imageTarget(opts, path.Join(opts.OutDir, *p.PartitionName+".img"), total_length)
+		}
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("partition %s: %w", p.GetPartitionName(), err))
+			continue
 		}
+		target.partition, target.index, target.size, target.source = p, idx, total_length, source
+		targets = append(targets, target)
 	}
-	wg.Wait()
-
-	return nil
-}
 
-// go1.18+
-func last[T any](s []T) (T, bool) {
-	if len(s) == 0 {
-		var zero T
-		return zero, false
+	// Every partition written in place is extracted in one pass over the
+	// payload data
+	extractPlan(ctx, payload, block_size, targets, len(all_parts), !opts.SkipDataHash, progress, pool)
+	for _, t := range targets {
+		if t.err != nil {
+			errs = append(errs, fmt.Errorf("partition %s: %w", t.partition.GetPartitionName(), t.err))
+		}
 	}
-	return s[len(s)-1], true
-}
 
-func ExtractPartitionsFromPayload(
-	reader io.ReadSeeker,
-	partitions_name []string,
-	out_dir string,
-	max_workers int,
-) {
-	reader.Seek(0, io.SeekStart)
-
-	os.RemoveAll(out_dir)
-	os.MkdirAll(out_dir, 0777)
+	for _, t := range streamed {
+		if ctx.Err() != nil {
+			break
+		}
 
-	manifest, err := InitPayloadInfo(reader)
-	if err != nil {
-		log.Fatalln(err)
+		p := t.partition
+		progress.PartitionStarted(p.GetPartitionName(), t.index, len(all_parts), imageSize(p, block_size))
+		out_path := path.Join(opts.OutDir, *p.PartitionName+".img")
+		if opts.Format == FormatSparseImage {
+			err = payload.extractSparseImage(ctx, p, opts, out_path, t.source, progress, pool)
+		} else {
+			err = payload.extractCompressed(ctx, p, opts, out_path+opts.Codec.Extension(), t.source, progress, pool)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("partition %s: %w", p.GetPartitionName(), err))
+		}
+		progress.PartitionFinished(p.GetPartitionName())
 	}
 
-	baseoff, _ := reader.Seek(0, io.SeekCurrent)
-
-	var all_parts []*update_engine.PartitionUpdate
-	if len(partitions_name) == 0 { // Extract all
-		all_parts = manifest.Partitions
-	} else {
-		for _, p := range manifest.Partitions {
-			if slices.Contains(partitions_name, *p.PartitionName) {
-				all_parts = append(all_parts, p)
-			}
+	if super_fd != nil {
+		if err := super_fd.Close(); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	block_size := *manifest.BlockSize
-
-	pool, _ := ants.NewPool(max_workers)
-	defer pool.Release()
+	if err := ctx.Err(); err != nil && !errors.Is(errors.Join(errs...), err) {
+		errs = append(errs, err)
+	}
 
-	fmt.Println("Processing with threads:", max_workers)
+	return errors.Join(errs...)
+}
 
-	for idx, p := range all_parts {
-		reader.Seek(baseoff, io.SeekStart)
-
-		total_length := func() int64 {
-			last_operation, _ := last(p.Operations)
-			last_extents, _ := last(last_operation.DstExtents)
-
-			return int64((*last_extents.StartBlock + *last_extents.NumBlocks) * uint64(block_size))
-		}()
-
-		bar := progressbar.NewOptions64(total_length,
-			progressbar.OptionSetWriter(os.Stderr), //you should install "github.com/k0kubun/go-ansi"
-			progressbar.OptionEnableColorCodes(true),
-			progressbar.OptionShowBytes(true),
-			progressbar.OptionShowTotalBytes(true),
-			progressbar.OptionClearOnFinish(),
-			progressbar.OptionSetWidth(15),
-			progressbar.OptionSetDescription(fmt.Sprintf("[cyan][%d/%d][reset] Partition %-12s size: %-10d ...", idx+1, len(all_parts), p.GetPartitionName(), total_length)),
-			progressbar.OptionSetTheme(progressbar.Theme{
-				Saucer:        "[green]#[reset]",
-				SaucerHead:    "[green]>[reset]",
-				SaucerPadding: "_",
-				BarStart:      "[",
-				BarEnd:        "]",
-			}))
-
-		fmt.Println("Extracting", *p.PartitionName, "...")
-		err := extractPartitionFromPayload(reader, int(block_size), p, path.Join(out_dir, *p.PartitionName+".img"), int(total_length), bar, pool)
-		if err != nil {
-			log.Println(err)
+// imageTarget creates the raw image at out_path, to be extracted by
+// extractPlan.
+func (payload *Payload) imageTarget(opts ExtractOptions, out_path string, size int64) (*partitionTarget, error) {
+	fd, err := createImage(out_path, size)
+	if err != nil {
+		return nil, err
+	}
+	target := &partitionTarget{writer: fd, punch_holes: opts.PunchHoles}
+	if opts.Sparse {
+		target.writer = newSparseWriter(fd, payload.BlockSize())
+	}
+	target.finish = func(err error) error {
+		if close_err := fd.Close(); err == nil {
+			err = close_err
 		}
+		return err
+	}
+	return target, nil
+}
 
-		bar.Finish()
+// createImage creates the file at out_path, truncated to size bytes.
+func createImage(out_path string, size int64) (*os.File, error) {
+	fd, err := os.Create(out_path)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.Truncate(size); err != nil {
+		fd.Close()
+		os.Remove(out_path)
+		return nil, err
 	}
+	return fd, nil
+}
 
-	fmt.Println("Done!")
+// partitionSize returns the size of the partition image, computed from the
+// end of the furthest destination extent.
+func partitionSize(p *update_engine.PartitionUpdate, block_size int) int64 {
+	end := uint64(0)
+	for _, operation := range p.Operations {
+		for _, ext := range operation.DstExtents {
+			end = max(end, ext.GetStartBlock()+ext.GetNumBlocks())
+		}
+	}
+	return int64(end * uint64(block_size))
 }
@@ -1,15 +1,24 @@
 package payload_extract_go_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"net/http"
 	_ "net/http/pprof"
 
+	"github.com/DataDog/zstd"
 	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
 )
 
 func TestPayloadZip(t *testing.T) {
@@ -41,7 +50,9 @@ func TestPayloadZip(t *testing.T) {
 	}
 	defer fd.Close()
 
-	payload_extract.ExtractPartitionsFromPayload(fd, []string{"system"}, "out2", runtime.NumCPU())
+	if err := payload_extract.ExtractPartitionsFromPayload(fd, []string{"system"}, "out2", runtime.NumCPU()); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestPayloadInfo(t *testing.T) {
@@ -60,3 +71,426 @@ func TestPayloadInfo(t *testing.T) {
 
 	payload_extract.PrintPartitionsInfo(manifest, []string{})
 }
+
+func TestOpen(t *testing.T) {
+	tp := newTestPayload(4096)
+	image := testImage(4096, 16, 1)
+	tp.addImageOps(tp.addPartition("boot", image), image, 4)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := payload.Header()
+	if hdr.Version != 2 {
+		t.Errorf("version = %d, want 2", hdr.Version)
+	}
+	if got, want := payload.DataOffset(), payload.MetadataSize()+int64(hdr.ManifestSigLen); got != want {
+		t.Errorf("data offset = %d, want %d", got, want)
+	}
+	if int64(len(payload.MetadataSignature())) != int64(hdr.ManifestSigLen) {
+		t.Errorf("metadata signature length = %d, want %d", len(payload.MetadataSignature()), hdr.ManifestSigLen)
+	}
+	if got := payload.SignatureOffset() + payload.SignatureSize(); got != int64(len(data)) {
+		t.Errorf("payload signature ends at %d, want %d", got, len(data))
+	}
+	if payload.Partition("boot") == nil || len(payload.Partitions([]string{"system"})) != 0 {
+		t.Error("unexpected partition lookup result")
+	}
+
+	if _, err := payload_extract.Open(bytes.NewReader(data[:20]), 20); err == nil {
+		t.Error("expected error for truncated payload")
+	}
+
+	// Lengths past the payload are rejected before they are allocated
+	for _, lengths := range []struct {
+		manifest  uint64
+		signature uint32
+	}{{1 << 62, hdr.ManifestSigLen}, {hdr.ManifestLen, 1<<32 - 1}} {
+		corrupt := bytes.Clone(data)
+		binary.BigEndian.PutUint64(corrupt[12:], lengths.manifest)
+		binary.BigEndian.PutUint32(corrupt[20:], lengths.signature)
+		if _, err := payload_extract.Open(bytes.NewReader(corrupt), int64(len(corrupt))); err == nil {
+			t.Errorf("expected error for lengths %v", lengths)
+		}
+		if _, err := payload_extract.OpenStream(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("stream: expected error for lengths %v", lengths)
+		}
+	}
+}
+
+func TestExtractPartitions(t *testing.T) {
+	tp := newTestPayload(4096)
+	boot := testImage(4096, 16, 1)
+	tp.addImageOps(tp.addPartition("boot", boot), boot, 4)
+	vendor := testImage(4096, 9, 2)
+	tp.addImageOps(tp.addPartition("vendor", vendor), vendor, 2)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	if err := payload.ExtractPartitions(nil, out, 4); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{"boot": boot, "vendor": vendor} {
+		got, err := os.ReadFile(filepath.Join(out, name+".img"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: extracted image differs", name)
+		}
+	}
+}
+
+func TestExtractBadOptions(t *testing.T) {
+	tp := newTestPayload(4096)
+	image := testImage(4096, 4, 1)
+	tp.addImageOps(tp.addPartition("boot", image), image, 4)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid options fail before the output directory is cleared
+	out := t.TempDir()
+	keep := filepath.Join(out, "keep")
+	if err := os.WriteFile(keep, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, opts := range map[string]payload_extract.ExtractOptions{
+		"codec":    {Codec: payload_extract.CodecZstd, Format: payload_extract.FormatSparseImage},
+		"super":    {SuperSize: 1 << 20, Format: payload_extract.FormatSparseImage},
+		"metadata": {SuperSize: 1 << 20},
+	} {
+		opts.OutDir = out
+		if err := payload.Extract(context.Background(), opts); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		if _, err := os.Stat(keep); err != nil {
+			t.Fatalf("%s: output directory cleared: %v", name, err)
+		}
+	}
+}
+
+func TestExtractPartitionsError(t *testing.T) {
+	tp := newTestPayload(4096)
+	boot := testImage(4096, 8, 1)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:4096*4], ext(0, 4))
+	tp.addOp(part, update_engine.InstallOperation_ZSTD, []byte("not zstd data"), ext(4, 4))
+	data := tp.bytes()
+
+	err := payload_extract.ExtractPartitionsFromPayload(bytes.NewReader(data), nil, t.TempDir(), 2)
+	if err == nil {
+		t.Fatal("expected error for corrupted operation")
+	}
+	if !strings.Contains(err.Error(), "partition boot") || !strings.Contains(err.Error(), "operation 1") {
+		t.Errorf("error does not name partition and operation: %v", err)
+	}
+}
+
+func TestExtractCanceled(t *testing.T) {
+	tp := newTestPayload(4096)
+	boot := testImage(4096, 16, 1)
+	tp.addImageOps(tp.addPartition("boot", boot), boot, 1)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = payload.Extract(ctx, payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	tp := newTestPayload(4096)
+	boot := testImage(4096, 8, 1)
+	tp.addImageOps(tp.addPartition("boot", boot), boot, 2)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events bytes.Buffer
+	err = payload.Extract(context.Background(), payload_extract.ExtractOptions{
+		OutDir:   t.TempDir(),
+		Workers:  2,
+		Progress: payload_extract.NewJSONProgress(&events),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	written := int64(0)
+	dec := json.NewDecoder(&events)
+	for dec.More() {
+		var ev struct {
+			Event string
+			Bytes int64
+		}
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		counts[ev.Event]++
+		written += ev.Bytes
+	}
+	if counts["partition_started"] != 1 || counts["partition_finished"] != 1 || counts["operation_done"] != 4 {
+		t.Errorf("unexpected events: %v", counts)
+	}
+	if written != int64(len(boot)) {
+		t.Errorf("bytes written = %d, want %d", written, len(boot))
+	}
+}
+
+func TestTerminalProgress(t *testing.T) {
+	var out bytes.Buffer
+	progress := payload_extract.NewTerminalProgress(&out)
+
+	// system and vendor start while boot is drawn, vendor ends first
+	progress.PartitionStarted("boot", 0, 3, 100)
+	progress.PartitionStarted("system", 1, 3, 100)
+	progress.PartitionStarted("vendor", 2, 3, 100)
+	progress.BytesWritten("system", 50)
+	progress.BytesWritten("vendor", 100)
+	progress.PartitionFinished("vendor")
+	progress.BytesWritten("boot", 50)
+	progress.BytesWritten("boot", 50)
+	progress.PartitionFinished("boot")
+	progress.BytesWritten("system", 50)
+	progress.PartitionFinished("system")
+
+	// Every partition is drawn after the previous one, and only then
+	text := out.String()
+	last := 0
+	for _, name := range []string{"boot", "system", "vendor"} {
+		start := strings.Index(text, "Extracting "+name)
+		if start < last {
+			t.Fatalf("%s drawn out of order:\n%q", name, text)
+		}
+		if strings.Contains(text[:start], "Partition "+name) {
+			t.Errorf("%s bar drawn before it started:\n%q", name, text)
+		}
+		last = start
+	}
+	if strings.Contains(text[strings.Index(text, "Extracting system"):], "Partition boot") {
+		t.Errorf("boot bar drawn after it finished:\n%q", text)
+	}
+}
+
+func TestExtractDataHashMismatch(t *testing.T) {
+	tp := newTestPayload(4096)
+	boot := testImage(4096, 8, 1)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:4096*4], ext(0, 4))
+	op := tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[4096*4:], ext(4, 4))
+	op.DataSha256Hash[0] ^= 0xff
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = payload.Extract(context.Background(), payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2})
+	if !errors.Is(err, payload_extract.ErrHashMismatch) || !strings.Contains(err.Error(), "operation 1") {
+		t.Errorf("err = %v, want hash mismatch of operation 1", err)
+	}
+
+	err = payload.Extract(context.Background(), payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2, SkipDataHash: true})
+	if err != nil {
+		t.Errorf("extract with SkipDataHash: %v", err)
+	}
+}
+
+func TestVerifyImages(t *testing.T) {
+	tp := newTestPayload(4096)
+	boot := testImage(4096, 8, 1)
+	tp.addImageOps(tp.addPartition("boot", boot), boot, 2)
+	vendor := testImage(4096, 4, 2)
+	tp.addImageOps(tp.addPartition("vendor", vendor), vendor, 2)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := payload.Extract(context.Background(), payload_extract.ExtractOptions{OutDir: out, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := payload.VerifyImages(context.Background(), out, nil)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("verify: %v, %d results", err, len(results))
+	}
+
+	// Corrupt one byte of vendor
+	fd, err := os.OpenFile(filepath.Join(out, "vendor.img"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte{^vendor[100]}, 100)
+	fd.Close()
+
+	results, err = payload.VerifyImages(context.Background(), out, nil)
+	if !errors.Is(err, payload_extract.ErrHashMismatch) {
+		t.Errorf("err = %v, want hash mismatch", err)
+	}
+	if !results[0].OK() || results[1].OK() {
+		t.Errorf("unexpected results: boot %v vendor %v", results[0].Err, results[1].Err)
+	}
+}
+
+func TestExtractScatteredExtents(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 8, 1)
+	concat := func(blocks ...[2]int) []byte {
+		var data []byte
+		for _, b := range blocks {
+			data = append(data, boot[b[0]*bs:b[1]*bs]...)
+		}
+		return data
+	}
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, concat([2]int{6, 8}, [2]int{0, 1}), ext(6, 2), ext(0, 1))
+	compressed, err := zstd.Compress(nil, concat([2]int{4, 6}, [2]int{1, 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.addOp(part, update_engine.InstallOperation_ZSTD, compressed, ext(4, 2), ext(1, 3))
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := payload.Extract(context.Background(), payload_extract.ExtractOptions{OutDir: out, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "boot.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, boot) {
+		t.Error("extracted image differs")
+	}
+
+	// Output longer than the extents, or short of a whole block, is refused
+	for _, length := range []int{3*bs + 1, 2 * bs} {
+		tp := newTestPayload(bs)
+		part := tp.addPartition("boot", boot)
+		tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:length], ext(4, 1), ext(0, 2))
+		data := tp.bytes()
+
+		payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = payload.Extract(context.Background(), payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2})
+		if !errors.Is(err, payload_extract.ErrDataLength) {
+			t.Errorf("%d bytes: err = %v, want ErrDataLength", length, err)
+		}
+	}
+}
+
+func TestExtractZeroDiscard(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 8, 1)
+	clear(boot[bs : 4*bs])
+	clear(boot[6*bs:])
+
+	for _, punch := range []bool{false, true} {
+		tp := newTestPayload(bs)
+		part := tp.addPartition("boot", boot)
+		tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:bs], ext(0, 1))
+		tp.addOp(part, update_engine.InstallOperation_ZERO, nil, ext(1, 3))
+		tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[4*bs:6*bs], ext(4, 2))
+		tp.addOp(part, update_engine.InstallOperation_DISCARD, nil, ext(6, 2))
+		data := tp.bytes()
+
+		payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := t.TempDir()
+		opts := payload_extract.ExtractOptions{OutDir: out, Workers: 2, PunchHoles: punch}
+		if err := payload.Extract(context.Background(), opts); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(out, "boot.img"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, boot) {
+			t.Errorf("punch holes %v: extracted image differs", punch)
+		}
+	}
+}
+
+func TestExtractSparse(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 64, 1)
+	// Zero blocks within REPLACE and ZSTD blobs, and a ZERO operation
+	clear(boot[2*bs : 14*bs])
+	clear(boot[18*bs : 30*bs])
+	clear(boot[40*bs:])
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:16*bs], ext(0, 16))
+	compressed, err := zstd.Compress(nil, boot[16*bs:40*bs])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.addOp(part, update_engine.InstallOperation_ZSTD, compressed, ext(16, 24))
+	tp.addOp(part, update_engine.InstallOperation_ZERO, nil, ext(40, 24))
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := payload.Extract(context.Background(), payload_extract.ExtractOptions{OutDir: out, Workers: 2, Sparse: true}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "boot.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, boot) {
+		t.Error("extracted image differs")
+	}
+
+	size, allocated, err := payload_extract.DiskUsage(filepath.Join(out, "boot.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(boot)) {
+		t.Errorf("size = %d, want %d", size, len(boot))
+	}
+	if runtime.GOOS == "linux" && allocated >= size {
+		t.Errorf("allocated %d of %d bytes, want holes", allocated, size)
+	}
+}
@@ -0,0 +1,221 @@
+package payload_extract_go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/affggh/payload_extract/update_engine"
+	"github.com/panjf2000/ants/v2"
+)
+
+// partitionTarget is the output of a partition extracted by extractPlan.
+type partitionTarget struct {
+	partition   *update_engine.PartitionUpdate
+	index       int   // among the selected partitions, for progress
+	size        int64 // for progress
+	writer      io.WriterAt
+	source      io.ReaderAt
+	punch_holes bool
+	// finish releases the output once every operation ended, given their
+	// joined errors, and returns the error of the partition
+	finish func(err error) error
+
+	started   bool
+	remaining atomic.Int64 // operations not ended yet
+	failed    atomic.Bool  // remaining operations are skipped
+
+	errs_mu sync.Mutex
+	errs    []error
+
+	once sync.Once
+	err  error // set once ended
+}
+
+func (t *partitionTarget) addError(idx int, err error, progress ProgressReporter) {
+	err = fmt.Errorf("operation %d: %w", idx, err)
+	progress.Error(t.partition.GetPartitionName(), err)
+
+	t.errs_mu.Lock()
+	defer t.errs_mu.Unlock()
+	t.errs = append(t.errs, err)
+}
+
+// cancel fails the target with the error of a cancelled context, unless it
+// failed already.
+func (t *partitionTarget) cancel(err error) {
+	if !t.failed.Swap(true) {
+		t.errs_mu.Lock()
+		defer t.errs_mu.Unlock()
+		t.errs = append(t.errs, err)
+	}
+}
+
+// end finishes the target, the first call only.
+func (t *partitionTarget) end(progress ProgressReporter) {
+	t.once.Do(func() {
+		t.errs_mu.Lock()
+		err := errors.Join(t.errs...)
+		t.errs_mu.Unlock()
+		if t.finish != nil {
+			err = t.finish(err)
+		}
+		t.err = err
+		if t.started {
+			progress.PartitionFinished(t.partition.GetPartitionName())
+		}
+	})
+}
+
+// operationDone ends the target after its last operation.
+func (t *partitionTarget) operationDone(progress ProgressReporter) {
+	if t.remaining.Add(-1) == 0 {
+		t.end(progress)
+	}
+}
+
+// plannedOperation is an operation of a target, placed at offset in the
+// payload data.
+type plannedOperation struct {
+	target *partitionTarget
+	index  int
+	offset uint64
+}
+
+// planOperations merges the operations of targets in payload data order.
+// Operations without data stay behind the previous operation of their
+// partition, or ahead of its first blob, so partitions are mostly extracted
+// one after another as the payload lays them out.
+func planOperations(targets []*partitionTarget) []plannedOperation {
+	var plan []plannedOperation
+	for _, t := range targets {
+		operations := t.partition.GetOperations()
+		offset := uint64(0)
+		for _, operation := range operations {
+			if operation.GetDataLength() != 0 {
+				offset = operation.GetDataOffset()
+				break
+			}
+		}
+		for idx, operation := range operations {
+			if operation.GetDataLength() != 0 {
+				offset = operation.GetDataOffset()
+			}
+			plan = append(plan, plannedOperation{target: t, index: idx, offset: offset})
+		}
+	}
+	sort.SliceStable(plan, func(i, j int) bool {
+		return plan[i].offset < plan[j].offset
+	})
+	return plan
+}
+
+// extractPlan extracts the operations of every target in a single pass over
+// the payload data, read front to back, so sequential readers are read once.
+// Each target ends with its last operation and gets its error in err, a
+// failing target does not stop the others. Targets are started, as seen by
+// progress, with their first operation out of count partitions.
+func extractPlan(
+	ctx context.Context,
+	payload *Payload,
+	block_size int,
+	targets []*partitionTarget,
+	count int,
+	verify_data bool,
+	progress ProgressReporter,
+	pool *ants.Pool,
+) {
+	for _, t := range targets {
+		t.remaining.Store(int64(len(t.partition.GetOperations())))
+	}
+
+	var wg sync.WaitGroup
+	for _, planned := range planOperations(targets) {
+		if ctx.Err() != nil {
+			break
+		}
+
+		t := planned.target
+		name := t.partition.GetPartitionName()
+		if !t.started {
+			t.started = true
+			progress.PartitionStarted(name, t.index, count, t.size)
+		}
+		// The data of failed partitions is not worth reading
+		if t.failed.Load() {
+			t.operationDone(progress)
+			continue
+		}
+
+		idx := planned.index
+		operation := t.partition.GetOperations()[idx]
+		data, err := payload.readOperationData(operation)
+		if err != nil {
+			t.failed.Store(true)
+			t.addError(idx, err, progress)
+			t.operationDone(progress)
+			continue
+		}
+
+		wg.Add(1)
+		err = pool.Submit(func() {
+			defer wg.Done()
+			defer t.operationDone(progress)
+			// ants recovers panics on its own, hiding them from the caller
+			defer func() {
+				if r := recover(); r != nil {
+					t.failed.Store(true)
+					t.addError(idx, fmt.Errorf("panic: %v", r), progress)
+				}
+			}()
+			// Drain queued operations once cancelled or failed
+			if err := ctx.Err(); err != nil {
+				t.cancel(err)
+				return
+			}
+			if t.failed.Load() {
+				return
+			}
+
+			if verify_data {
+				if err := checkDataHash(operation, data, payload.dataOffset); err != nil {
+					t.failed.Store(true)
+					t.addError(idx, err, progress)
+					return
+				}
+			}
+
+			err := extractOperationToFile(operation, t.writer, block_size, data, t.source, t.punch_holes, progress, name)
+			if err != nil {
+				t.failed.Store(true)
+				t.addError(idx, err, progress)
+				return
+			}
+			progress.OperationDone(name, idx)
+		})
+		if err != nil {
+			wg.Done()
+			t.failed.Store(true)
+			t.addError(idx, err, progress)
+			t.operationDone(progress)
+		}
+	}
+	wg.Wait()
+
+	// Partitions without operations, or left unfinished by cancellation
+	for _, t := range targets {
+		if err := ctx.Err(); err != nil {
+			if t.remaining.Load() != 0 {
+				t.cancel(err)
+			}
+		} else if !t.started {
+			t.started = true
+			progress.PartitionStarted(t.partition.GetPartitionName(), t.index, count, t.size)
+		}
+		t.end(progress)
+	}
+}
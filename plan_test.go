@@ -0,0 +1,166 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
+	"google.golang.org/protobuf/proto"
+)
+
+// forwardReader is a ReaderAt failing reads that go back before the end of
+// the previous one, as a sequential source would.
+type forwardReader struct {
+	data []byte
+
+	mu    sync.Mutex
+	pos   int64
+	reads int
+}
+
+func (r *forwardReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off < r.pos {
+		return 0, fmt.Errorf("read at %d after reading up to %d", off, r.pos)
+	}
+	r.pos = off + int64(len(p))
+	r.reads++
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestExtractSinglePass(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 12, 1)
+	clear(boot[4*bs : 6*bs])
+	vendor := testImage(bs, 9, 2)
+	system := testImage(bs, 6, 3)
+
+	// The blobs of boot and vendor are interleaved
+	tp := newTestPayload(bs)
+	boot_part := tp.addPartition("boot", boot)
+	vendor_part := tp.addPartition("vendor", vendor)
+	system_part := tp.addPartition("system", system)
+	tp.addOp(vendor_part, update_engine.InstallOperation_REPLACE, vendor[6*bs:], ext(6, 3))
+	tp.addOp(boot_part, update_engine.InstallOperation_REPLACE, boot[:4*bs], ext(0, 4))
+	tp.addOp(vendor_part, update_engine.InstallOperation_REPLACE, vendor[:6*bs], ext(0, 6))
+	tp.addOp(boot_part, update_engine.InstallOperation_ZERO, nil, ext(4, 2))
+	tp.addOp(boot_part, update_engine.InstallOperation_REPLACE, boot[6*bs:], ext(6, 6))
+	bad := tp.addOp(system_part, update_engine.InstallOperation_REPLACE, system[:3*bs], ext(0, 3))
+	tp.addOp(system_part, update_engine.InstallOperation_REPLACE, system[3*bs:], ext(3, 3))
+	bad.DataSha256Hash[0] ^= 0xff
+	data := tp.bytes()
+
+	reader := &forwardReader{data: data}
+	payload, err := payload_extract.Open(reader, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := reader.reads
+
+	opts := payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2}
+	err = payload.Extract(context.Background(), opts)
+	// The failing partition does not stop the others
+	if !errors.Is(err, payload_extract.ErrHashMismatch) {
+		t.Errorf("err = %v, want ErrHashMismatch", err)
+	}
+	// Every blob read at most once, front to back
+	if reads := reader.reads - opened; reads > 6 {
+		t.Errorf("%d payload reads, want at most 6", reads)
+	}
+	if bytes.Contains([]byte(err.Error()), []byte("after reading")) {
+		t.Errorf("payload read backwards: %v", err)
+	}
+	checkImage(t, opts.OutDir, "boot", boot)
+	checkImage(t, opts.OutDir, "vendor", vendor)
+
+	// Only system failed
+	for _, name := range []string{"boot", "vendor"} {
+		if bytes.Contains([]byte(err.Error()), []byte("partition "+name)) {
+			t.Errorf("error mentions %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(opts.OutDir, "system.img")); err != nil {
+		t.Error(err)
+	}
+}
+
+// panicProgress panics when an operation is done, as a crashing operation
+// would in a pool worker.
+type panicProgress struct {
+	payload_extract.NopProgress
+}
+
+func (panicProgress) OperationDone(string, int) {
+	panic("operation crashed")
+}
+
+func TestExtractPanic(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 8, 1)
+	tp := newTestPayload(bs)
+	tp.addImageOps(tp.addPartition("boot", boot), boot, 4)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2, Progress: panicProgress{}}
+	err = payload.Extract(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "panic: operation crashed") {
+		t.Errorf("Extract err = %v, want the panic", err)
+	}
+	err = payload.ExtractTar(context.Background(), io.Discard, opts)
+	if err == nil || !strings.Contains(err.Error(), "panic: operation crashed") {
+		t.Errorf("ExtractTar err = %v, want the panic", err)
+	}
+}
+
+func TestExtractOversizedData(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 8, 1)
+	tp := newTestPayload(bs)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:4*bs], ext(0, 4))
+	op := tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[4*bs:], ext(4, 4))
+	// Allocating the blob as is would crash the process
+	op.DataLength = proto.Uint64(1 << 62)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2}
+	if err := payload.Extract(context.Background(), opts); err == nil {
+		t.Error("Extract: expected error")
+	}
+	if err := payload.ExtractTar(context.Background(), io.Discard, opts); err == nil {
+		t.Error("ExtractTar: expected error")
+	}
+	r, err := payload.OpenPartition("boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadAt(make([]byte, bs), 4*bs); err == nil {
+		t.Error("ReadAt: expected error")
+	}
+
+	stream, err := payload_extract.OpenStream(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Extract(context.Background(), opts); err == nil {
+		t.Error("stream Extract: expected error")
+	}
+}
@@ -0,0 +1,193 @@
+package payload_extract_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// ProgressReporter receives extraction progress events. BytesWritten,
+// OperationDone and Error are called from pool workers, implementations must
+// be safe for concurrent use.
+type ProgressReporter interface {
+	// PartitionStarted is called before the first operation of a partition,
+	// index is zero based within count selected partitions.
+	PartitionStarted(name string, index, count int, size int64)
+	// BytesWritten is called after an operation wrote n bytes of output.
+	BytesWritten(name string, n int64)
+	// OperationDone is called after the operation at index in the manifest
+	// partition operation list finished successfully.
+	OperationDone(name string, index int)
+	// PartitionFinished is called once all operations of a partition ended,
+	// whether or not they failed.
+	PartitionFinished(name string)
+	// Error is called for every failure attributed to a partition.
+	Error(name string, err error)
+}
+
+// NopProgress discards every progress event.
+type NopProgress struct{}
+
+func (NopProgress) PartitionStarted(string, int, int, int64) {}
+func (NopProgress) BytesWritten(string, int64)               {}
+func (NopProgress) OperationDone(string, int)                {}
+func (NopProgress) PartitionFinished(string)                 {}
+func (NopProgress) Error(string, error)                      {}
+
+// TerminalProgress draws a colored progress bar per partition. Partitions
+// extracted together are shown one at a time, in the order they started: a
+// partition started while another one's bar is drawn waits for it to finish,
+// its bar then starts with the bytes written meanwhile.
+type TerminalProgress struct {
+	w io.Writer
+
+	mu      sync.Mutex
+	current *terminalPartition
+	bar     *progressbar.ProgressBar
+	waiting []*terminalPartition
+}
+
+// terminalPartition is a started partition and its progress so far.
+type terminalPartition struct {
+	name         string
+	index, count int
+	size         int64
+	written      int64
+	finished     bool
+}
+
+// NewTerminalProgress creates a TerminalProgress drawing bars on w.
+func NewTerminalProgress(w io.Writer) *TerminalProgress {
+	return &TerminalProgress{w: w}
+}
+
+// next draws the bar of the first waiting partition, finishing right away
+// those which finished while waiting. Must be called with mu held.
+func (t *TerminalProgress) next() {
+	for t.bar == nil && len(t.waiting) > 0 {
+		p := t.waiting[0]
+		t.waiting = t.waiting[1:]
+
+		fmt.Fprintln(t.w, "Extracting", p.name, "...")
+		bar := progressbar.NewOptions64(p.size,
+			progressbar.OptionSetWriter(t.w), //you should install "github.com/k0kubun/go-ansi"
+			progressbar.OptionEnableColorCodes(true),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionShowTotalBytes(true),
+			progressbar.OptionClearOnFinish(),
+			progressbar.OptionSetWidth(15),
+			progressbar.OptionSetDescription(fmt.Sprintf("[cyan][%d/%d][reset] Partition %-12s size: %-10d ...", p.index+1, p.count, p.name, p.size)),
+			progressbar.OptionSetTheme(progressbar.Theme{
+				Saucer:        "[green]#[reset]",
+				SaucerHead:    "[green]>[reset]",
+				SaucerPadding: "_",
+				BarStart:      "[",
+				BarEnd:        "]",
+			}))
+		if p.written != 0 {
+			bar.Add64(p.written)
+		}
+		if p.finished {
+			bar.Finish()
+			continue
+		}
+		t.current, t.bar = p, bar
+	}
+}
+
+// waitingPartition returns the waiting partition named name, if any. Must be
+// called with mu held.
+func (t *TerminalProgress) waitingPartition(name string) *terminalPartition {
+	for _, p := range t.waiting {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (t *TerminalProgress) PartitionStarted(name string, index, count int, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waiting = append(t.waiting, &terminalPartition{name: name, index: index, count: count, size: size})
+	t.next()
+}
+
+func (t *TerminalProgress) BytesWritten(name string, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil && t.current.name == name {
+		t.bar.Add64(n)
+	} else if p := t.waitingPartition(name); p != nil {
+		p.written += n
+	}
+}
+
+func (t *TerminalProgress) OperationDone(name string, index int) {}
+
+func (t *TerminalProgress) PartitionFinished(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil && t.current.name == name {
+		t.bar.Finish()
+		t.current, t.bar = nil, nil
+		t.next()
+	} else if p := t.waitingPartition(name); p != nil {
+		p.finished = true
+	}
+}
+
+func (t *TerminalProgress) Error(name string, err error) {
+	Logger.Printf("Error: %s: %v", name, err)
+}
+
+// JSONProgress writes one JSON object per event, newline delimited, for
+// machine consumption.
+type JSONProgress struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONProgress creates a JSONProgress writing events to w.
+func NewJSONProgress(w io.Writer) *JSONProgress {
+	return &JSONProgress{enc: json.NewEncoder(w)}
+}
+
+type jsonProgressEvent struct {
+	Event     string `json:"event"`
+	Partition string `json:"partition"`
+	Index     *int   `json:"index,omitempty"`
+	Count     int    `json:"count,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (j *JSONProgress) emit(ev jsonProgressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(ev)
+}
+
+func (j *JSONProgress) PartitionStarted(name string, index, count int, size int64) {
+	j.emit(jsonProgressEvent{Event: "partition_started", Partition: name, Index: &index, Count: count, Size: size})
+}
+
+func (j *JSONProgress) BytesWritten(name string, n int64) {
+	j.emit(jsonProgressEvent{Event: "bytes_written", Partition: name, Bytes: n})
+}
+
+func (j *JSONProgress) OperationDone(name string, index int) {
+	j.emit(jsonProgressEvent{Event: "operation_done", Partition: name, Index: &index})
+}
+
+func (j *JSONProgress) PartitionFinished(name string) {
+	j.emit(jsonProgressEvent{Event: "partition_finished", Partition: name})
+}
+
+func (j *JSONProgress) Error(name string, err error) {
+	j.emit(jsonProgressEvent{Event: "error", Partition: name, Error: err.Error()})
+}
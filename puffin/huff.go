@@ -0,0 +1,265 @@
+package puffin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/affggh/payload_extract/internal/deflate"
+)
+
+// Kinds of puff stream elements
+const (
+	elemLiterals = iota
+	elemLenDist
+	elemEndOfBlock
+)
+
+// puffReader walks the elements of a puff stream.
+type puffReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *puffReader) next(n int) ([]byte, error) {
+	if n > len(r.data)-r.pos {
+		return nil, errCorruptPuff
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *puffReader) u16() (int, error) {
+	b, err := r.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(b)), nil
+}
+
+func (r *puffReader) metadata() ([]byte, error) {
+	n, err := r.u16()
+	if err != nil {
+		return nil, err
+	}
+	return r.next(n + 1)
+}
+
+// element returns the next literals, length/distance or end of block.
+func (r *puffReader) element() (kind int, literals []byte, length, distance int, err error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, nil, 0, 0, err
+	}
+	c := int(b[0])
+
+	if c&0x80 == 0 {
+		n := c + 1
+		if c == maxSmallLiterals {
+			if n, err = r.u16(); err != nil {
+				return 0, nil, 0, 0, err
+			}
+			n += maxSmallLiterals + 1
+		}
+		literals, err = r.next(n)
+		return elemLiterals, literals, 0, 0, err
+	}
+
+	length = c&0x7F + 3
+	if c == 0xFF {
+		b, err := r.next(1)
+		if err != nil {
+			return 0, nil, 0, 0, err
+		}
+		length = int(b[0]) + 130
+		if length == endOfBlockLength {
+			return elemEndOfBlock, nil, 0, 0, nil
+		}
+	}
+	if distance, err = r.u16(); err != nil {
+		return 0, nil, 0, 0, err
+	}
+	return elemLenDist, nil, length, distance + 1, nil
+}
+
+// huffDeflate writes the deflate blocks of a whole puff back to w.
+func huffDeflate(puff []byte, w *deflate.BitWriter) error {
+	r := &puffReader{data: puff}
+	for r.pos < len(r.data) {
+		meta, err := r.metadata()
+		if err != nil {
+			return err
+		}
+		header := meta[0]
+		final, typ := uint32(header>>7), uint32(header>>5&3)
+		w.WriteBits(1, final)
+		w.WriteBits(2, typ)
+
+		var litlen, distance *deflate.Huffman
+		switch typ {
+		case blockUncompressed:
+			w.WriteBits(w.BoundaryBits(), uint32(header&0x1F))
+			kind, literals, _, _, err := r.element()
+			if err != nil {
+				return err
+			}
+			switch kind {
+			case elemLiterals:
+				if len(literals) > 0xFFFF {
+					return errCorruptPuff
+				}
+				w.WriteBits(16, uint32(len(literals)))
+				w.WriteBits(16, ^uint32(len(literals)))
+				w.WriteBytes(literals)
+				if kind, _, _, _, err = r.element(); err != nil {
+					return err
+				}
+				if kind != elemEndOfBlock {
+					return errors.New("puffin: uncompressed block did not end properly")
+				}
+			case elemEndOfBlock:
+				w.WriteBits(16, 0)
+				w.WriteBits(16, 0xFFFF)
+			default:
+				return errors.New("puffin: uncompressed block did not end properly")
+			}
+			continue
+
+		case blockFixed:
+			litlen, distance = deflate.FixedHuffman()
+
+		case blockDynamic:
+			if litlen, distance, err = writeDynamicHeader(meta[1:], w); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("puffin: invalid block type %d", typ)
+		}
+
+		if err := huffSymbols(r, w, litlen, distance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDynamicHeader writes the code tables of a dynamic block from their
+// puff form.
+func writeDynamicHeader(meta []byte, w *deflate.BitWriter) (litlen, distance *deflate.Huffman, err error) {
+	if len(meta) < 3 {
+		return nil, nil, errCorruptPuff
+	}
+	num_lit_len, num_distance, num_codes := int(meta[0])+257, int(meta[1])+1, int(meta[2])+4
+	if num_lit_len > maxLitLenCodes || num_distance > maxDistanceCodes || num_codes > 19 {
+		return nil, nil, errCorruptPuff
+	}
+	w.WriteBits(5, uint32(meta[0]))
+	w.WriteBits(5, uint32(meta[1]))
+	w.WriteBits(4, uint32(meta[2]))
+	meta = meta[3:]
+
+	if len(meta) < (num_codes+1)/2 {
+		return nil, nil, errCorruptPuff
+	}
+	code_lens := make([]uint8, 19)
+	for i := 0; i < num_codes; i++ {
+		l := meta[i/2] >> 4
+		if i%2 == 1 {
+			l = meta[i/2] & 0x0F
+		}
+		code_lens[deflate.CodeLengthOrder[i]] = l
+		w.WriteBits(3, uint32(l))
+	}
+	meta = meta[(num_codes+1)/2:]
+	codes, err := deflate.NewHuffman(code_lens)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lens := make([]uint8, 0, num_lit_len+num_distance)
+	for _, b := range meta {
+		if len(lens) >= num_lit_len+num_distance {
+			return nil, nil, errCorruptPuff
+		}
+		var sym, repeat int
+		var extra_bits uint
+		var extra uint32
+		var value uint8
+		switch {
+		case b < 16:
+			sym, repeat, value = int(b), 1, b
+		case b < 20:
+			if len(lens) == 0 {
+				return nil, nil, errCorruptPuff
+			}
+			sym, extra_bits, extra = 16, 2, uint32(b-16)
+			repeat, value = 3+int(extra), lens[len(lens)-1]
+		case b < 28:
+			sym, extra_bits, extra = 17, 3, uint32(b-20)
+			repeat = 3 + int(extra)
+		default:
+			sym, extra_bits, extra = 18, 7, uint32(b-28)
+			repeat = 11 + int(extra)
+		}
+		if extra >= 1<<extra_bits && extra_bits > 0 || len(lens)+repeat > num_lit_len+num_distance {
+			return nil, nil, errCorruptPuff
+		}
+		if err := codes.Encode(w, sym); err != nil {
+			return nil, nil, err
+		}
+		w.WriteBits(extra_bits, extra)
+		for ; repeat > 0; repeat-- {
+			lens = append(lens, value)
+		}
+	}
+	if len(lens) != num_lit_len+num_distance {
+		return nil, nil, errCorruptPuff
+	}
+
+	if litlen, err = deflate.NewHuffman(lens[:num_lit_len]); err != nil {
+		return nil, nil, err
+	}
+	if distance, err = deflate.NewHuffman(lens[num_lit_len:]); err != nil {
+		return nil, nil, err
+	}
+	return litlen, distance, nil
+}
+
+// huffSymbols writes the elements of a compressed block up to its end.
+func huffSymbols(r *puffReader, w *deflate.BitWriter, litlen, distance *deflate.Huffman) error {
+	for {
+		kind, literals, length, dist, err := r.element()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case elemLiterals:
+			for _, b := range literals {
+				if err := litlen.Encode(w, int(b)); err != nil {
+					return err
+				}
+			}
+
+		case elemLenDist:
+			if length > 258 || dist > 32768 {
+				return errCorruptPuff
+			}
+			idx := deflate.LengthSymbol(length)
+			if err := litlen.Encode(w, idx+257); err != nil {
+				return err
+			}
+			w.WriteBits(uint(deflate.LengthExtra[idx]), uint32(length-int(deflate.LengthBase[idx])))
+
+			idx = deflate.DistanceSymbol(dist)
+			if err := distance.Encode(w, idx); err != nil {
+				return err
+			}
+			w.WriteBits(uint(deflate.DistanceExtra[idx]), uint32(dist-int(deflate.DistanceBase[idx])))
+
+		case elemEndOfBlock:
+			return litlen.Encode(w, 256)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// Package puffin applies puffdiff patches. A puffdiff patch is a bsdiff or
+// Zucchini patch between the "puffed" source and destination, where every
+// deflate stream has been replaced with a canonical representation of its
+// blocks. Applying it puffs the source, patches it and deflates ("huffs") the
+// result back at the recorded locations.
+package puffin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/affggh/payload_extract/bsdiff"
+	"github.com/affggh/payload_extract/zucchini"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const magic = "PUF1"
+
+// Puff stream bytes per byte of deflate data at most, the shortest symbols of
+// 1 or 2 bits becoming a literal byte or a 4 byte length/distance pair
+const maxPuffRatio = 32
+
+// Patch algorithms of PatchHeader.type
+const (
+	PatchBSDIFF   = 0
+	PatchZUCCHINI = 1
+)
+
+// ErrCorrupt is returned for malformed patches.
+var ErrCorrupt = errors.New("puffin: corrupt patch")
+
+// StreamInfo describes the deflates of a source or destination.
+type StreamInfo struct {
+	Deflates   []BitExtent
+	Puffs      []ByteExtent
+	PuffLength uint64
+}
+
+// Header is the decoded PatchHeader message of a puffdiff patch.
+type Header struct {
+	Version int32
+	Src     StreamInfo
+	Dst     StreamInfo
+	Type    int
+}
+
+// The PatchHeader protobuf of puffin's puffin.proto:
+//
+//	message BitExtent { uint64 offset = 1; uint64 length = 2; }
+//	message StreamInfo {
+//	  repeated BitExtent deflates = 1;
+//	  repeated BitExtent puffs = 2;     // in bits, always byte aligned
+//	  uint64 puff_length = 3;
+//	}
+//	message PatchHeader {
+//	  int32 version = 1;
+//	  StreamInfo src = 2;
+//	  StreamInfo dst = 3;
+//	  PatchType type = 4;
+//	}
+
+// walkMessage calls fn for each field of a protobuf message, passing the
+// varint value or the bytes of length delimited fields.
+func walkMessage(b []byte, fn func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrCorrupt, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrCorrupt, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := fn(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseExtent(data []byte) (offset, length uint64, err error) {
+	err = walkMessage(data, func(num protowire.Number, v uint64, _ []byte) error {
+		switch num {
+		case 1:
+			offset = v
+		case 2:
+			length = v
+		}
+		return nil
+	})
+	return offset, length, err
+}
+
+func parseStreamInfo(data []byte) (StreamInfo, error) {
+	var info StreamInfo
+	err := walkMessage(data, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			offset, length, err := parseExtent(data)
+			if err != nil {
+				return err
+			}
+			info.Deflates = append(info.Deflates, BitExtent{Offset: offset, Length: length})
+		case 2:
+			offset, length, err := parseExtent(data)
+			if err != nil {
+				return err
+			}
+			info.Puffs = append(info.Puffs, ByteExtent{Offset: offset / 8, Length: length / 8})
+		case 3:
+			info.PuffLength = v
+		}
+		return nil
+	})
+	return info, err
+}
+
+// ParseHeader decodes the header of a puffdiff patch and returns it with the
+// offset of the embedded patch.
+func ParseHeader(patch []byte) (*Header, int, error) {
+	if len(patch) < len(magic)+4 || string(patch[:len(magic)]) != magic {
+		return nil, 0, fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	size := binary.BigEndian.Uint32(patch[len(magic):])
+	offset := len(magic) + 4
+	if uint64(size) > uint64(len(patch)-offset) {
+		return nil, 0, fmt.Errorf("%w: header size %d out of range", ErrCorrupt, size)
+	}
+
+	header := new(Header)
+	err := walkMessage(patch[offset:offset+int(size)], func(num protowire.Number, v uint64, data []byte) error {
+		var err error
+		switch num {
+		case 1:
+			header.Version = int32(v)
+		case 2:
+			header.Src, err = parseStreamInfo(data)
+		case 3:
+			header.Dst, err = parseStreamInfo(data)
+		case 4:
+			header.Type = int(v)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, offset + int(size), nil
+}
+
+// size returns the size of the data the puff stream of info huffs to.
+func (info *StreamInfo) size() (uint64, error) {
+	if len(info.Deflates) != len(info.Puffs) {
+		return 0, fmt.Errorf("%w: %d deflates but %d puffs", ErrCorrupt, len(info.Deflates), len(info.Puffs))
+	}
+	size := info.PuffLength
+	if n := len(info.Puffs); n > 0 {
+		last := info.Puffs[n-1].Offset + info.Puffs[n-1].Length
+		if last < info.Puffs[n-1].Offset || last > info.PuffLength {
+			return 0, fmt.Errorf("%w: puff %d out of range", ErrCorrupt, n-1)
+		}
+		size = info.Deflates[n-1].end()/8 + info.PuffLength - last
+	}
+	// The puff length is allocated by the inner patch, keep it in proportion
+	if info.PuffLength/maxPuffRatio > size {
+		return 0, fmt.Errorf("%w: puff length %d for %d bytes", ErrCorrupt, info.PuffLength, size)
+	}
+	return size, nil
+}
+
+// NewSize returns the size of the output of patch.
+func NewSize(patch []byte) (int64, error) {
+	header, _, err := ParseHeader(patch)
+	if err != nil {
+		return 0, err
+	}
+	size, err := header.Dst.size()
+	if err != nil {
+		return 0, err
+	}
+	if size > math.MaxInt64 {
+		return 0, fmt.Errorf("%w: bad new size %d", ErrCorrupt, size)
+	}
+	return int64(size), nil
+}
+
+// innerNewSize returns the size of the output of the embedded patch.
+func innerNewSize(typ int, patch []byte) (int64, error) {
+	switch typ {
+	case PatchBSDIFF:
+		return bsdiff.NewSize(patch)
+	case PatchZUCCHINI:
+		return zucchini.NewSize(patch)
+	}
+	return 0, fmt.Errorf("puffin: unsupported patch type %d", typ)
+}
+
+// Patch applies a puffdiff patch to src and returns the destination data.
+func Patch(src []byte, patch []byte) ([]byte, error) {
+	header, offset, err := ParseHeader(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	src_puff, src_puffs, err := PuffStream(src, header.Src.Deflates)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(src_puff)) != header.Src.PuffLength {
+		return nil, fmt.Errorf("%w: source puffs to %d bytes, want %d", ErrCorrupt, len(src_puff), header.Src.PuffLength)
+	}
+	for i, p := range src_puffs {
+		if i >= len(header.Src.Puffs) || header.Src.Puffs[i] != p {
+			return nil, fmt.Errorf("%w: source puff %d does not match the header", ErrCorrupt, i)
+		}
+	}
+
+	// The embedded patch sizes its output, check it before patching
+	if _, err := header.Dst.size(); err != nil {
+		return nil, err
+	}
+	inner_size, err := innerNewSize(header.Type, patch[offset:])
+	if err != nil {
+		return nil, err
+	}
+	if uint64(inner_size) != header.Dst.PuffLength {
+		return nil, fmt.Errorf("%w: patch gives %d bytes of puff stream, want %d", ErrCorrupt, inner_size, header.Dst.PuffLength)
+	}
+
+	var dst_puff []byte
+	switch header.Type {
+	case PatchBSDIFF:
+		dst_puff, err = bsdiff.Patch(src_puff, patch[offset:])
+	case PatchZUCCHINI:
+		dst_puff, err = zucchini.Apply(src_puff, patch[offset:])
+	default:
+		return nil, fmt.Errorf("puffin: unsupported patch type %d", header.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(dst_puff)) != header.Dst.PuffLength {
+		return nil, fmt.Errorf("%w: patched puff stream has %d bytes, want %d", ErrCorrupt, len(dst_puff), header.Dst.PuffLength)
+	}
+
+	return HuffStream(dst_puff, header.Dst.Deflates, header.Dst.Puffs)
+}
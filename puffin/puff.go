@@ -0,0 +1,280 @@
+package puffin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/affggh/payload_extract/internal/deflate"
+)
+
+// Puff stream encoding, as written by puffin's BufferPuffWriter:
+//
+//	block metadata  u16 BE (length - 1), metadata bytes
+//	literals        0LLLLLLL (length - 1) for up to 127 literals, else
+//	                0x7F, u16 BE (length - 128), then the literal bytes
+//	length/distance 1LLLLLLL (length - 3) for lengths below 130, else
+//	                0xFF, (length - 130), then u16 BE (distance - 1)
+//	end of block    0xFF, 129
+//
+// The first metadata byte is the block header: final bit << 7 | type << 5,
+// uncompressed blocks keep the bits skipped up to the byte boundary in the
+// low bits. Dynamic blocks follow it with HLIT - 257, HDIST - 1, HCLEN - 4,
+// the code length code lengths two per byte (high nibble first) and one byte
+// per code length symbol: 0-15 as is, 16 + extra for 16, 20 + extra for 17
+// and 28 + extra for 18.
+const (
+	maxSmallLiterals = 127
+	maxLiterals      = 65535 + 128
+	endOfBlockLength = 259
+	maxLitLenCodes   = 286
+	maxDistanceCodes = 30
+
+	blockUncompressed = 0
+	blockFixed        = 1
+	blockDynamic      = 2
+)
+
+var errCorruptPuff = errors.New("puffin: corrupt puff stream")
+
+// puffWriter accumulates a puff stream.
+type puffWriter struct {
+	out  []byte
+	lits []byte
+}
+
+func (w *puffWriter) literal(b byte) {
+	w.lits = append(w.lits, b)
+	if len(w.lits) == maxLiterals {
+		w.flushLiterals()
+	}
+}
+
+func (w *puffWriter) flushLiterals() {
+	n := len(w.lits)
+	switch {
+	case n == 0:
+		return
+	case n <= maxSmallLiterals:
+		w.out = append(w.out, byte(n-1))
+	default:
+		w.out = append(w.out, 0x7F)
+		w.out = binary.BigEndian.AppendUint16(w.out, uint16(n-maxSmallLiterals-1))
+	}
+	w.out = append(w.out, w.lits...)
+	w.lits = w.lits[:0]
+}
+
+func (w *puffWriter) lenDist(length, distance int) {
+	w.flushLiterals()
+	if length < 130 {
+		w.out = append(w.out, 0x80|byte(length-3))
+	} else {
+		w.out = append(w.out, 0xFF, byte(length-130))
+	}
+	w.out = binary.BigEndian.AppendUint16(w.out, uint16(distance-1))
+}
+
+func (w *puffWriter) endOfBlock() {
+	w.flushLiterals()
+	w.out = append(w.out, 0xFF, endOfBlockLength-130)
+}
+
+func (w *puffWriter) metadata(m []byte) {
+	w.flushLiterals()
+	w.out = binary.BigEndian.AppendUint16(w.out, uint16(len(m)-1))
+	w.out = append(w.out, m...)
+}
+
+// puffDeflate converts deflate blocks read from r into their puff form,
+// stopping after a final block or when less than a byte of input is left.
+func puffDeflate(r *deflate.BitReader, w *puffWriter) error {
+	for r.Remaining() >= 8 {
+		final, err := puffBlock(r, w)
+		if err != nil {
+			return err
+		}
+		if final {
+			break
+		}
+	}
+	w.flushLiterals()
+	return nil
+}
+
+// puffBlock converts one deflate block and reports whether it is the final
+// one.
+func puffBlock(r *deflate.BitReader, w *puffWriter) (bool, error) {
+	header, err := r.ReadBits(3)
+	if err != nil {
+		return false, err
+	}
+	final, typ := header&1, header>>1
+	block_header := byte(final<<7 | typ<<5)
+
+	var litlen, distance *deflate.Huffman
+	switch typ {
+	case blockUncompressed:
+		skipped, _ := r.ReadBits(r.BoundaryBits())
+		lens, err := r.ReadBits(32)
+		if err != nil {
+			return false, err
+		}
+		length, nlength := lens&0xFFFF, lens>>16
+		if length^nlength != 0xFFFF {
+			return false, fmt.Errorf("puffin: bad uncompressed block length %d/%d", length, nlength)
+		}
+		data, err := r.ReadBytes(int(length))
+		if err != nil {
+			return false, err
+		}
+		w.metadata([]byte{block_header | byte(skipped)})
+		w.lits = append(w.lits, data...)
+		w.endOfBlock()
+		return final == 1, nil
+
+	case blockFixed:
+		litlen, distance = deflate.FixedHuffman()
+		w.metadata([]byte{block_header})
+
+	case blockDynamic:
+		meta := []byte{block_header}
+		litlen, distance, meta, err = readDynamicHeader(r, meta)
+		if err != nil {
+			return false, err
+		}
+		w.metadata(meta)
+
+	default:
+		return false, fmt.Errorf("puffin: invalid deflate block type %d", typ)
+	}
+
+	return final == 1, puffSymbols(r, w, litlen, distance)
+}
+
+// readDynamicHeader reads the code tables of a dynamic block, appending their
+// puff form to meta.
+func readDynamicHeader(r *deflate.BitReader, meta []byte) (litlen, distance *deflate.Huffman, _ []byte, err error) {
+	counts, err := r.ReadBits(14)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hlit, hdist, hclen := counts&0x1F, counts>>5&0x1F, counts>>10
+	num_lit_len, num_distance, num_codes := int(hlit)+257, int(hdist)+1, int(hclen)+4
+	if num_lit_len > maxLitLenCodes || num_distance > maxDistanceCodes {
+		return nil, nil, nil, fmt.Errorf("puffin: bad dynamic block code counts %d/%d", num_lit_len, num_distance)
+	}
+	meta = append(meta, byte(hlit), byte(hdist), byte(hclen))
+
+	code_lens := make([]uint8, 19)
+	for i := 0; i < num_codes; i++ {
+		l, err := r.ReadBits(3)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		code_lens[deflate.CodeLengthOrder[i]] = uint8(l)
+		if i%2 == 0 {
+			meta = append(meta, byte(l<<4))
+		} else {
+			meta[len(meta)-1] |= byte(l)
+		}
+	}
+	codes, err := deflate.NewHuffman(code_lens)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	lens := make([]uint8, 0, num_lit_len+num_distance)
+	for len(lens) < num_lit_len+num_distance {
+		sym, err := codes.Decode(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if sym < 16 {
+			meta = append(meta, byte(sym))
+			lens = append(lens, uint8(sym))
+			continue
+		}
+
+		var extra uint32
+		var repeat int
+		var value uint8
+		switch sym {
+		case 16:
+			if len(lens) == 0 {
+				return nil, nil, nil, errors.New("puffin: code length repeat without previous length")
+			}
+			extra, err = r.ReadBits(2)
+			repeat, value = 3+int(extra), lens[len(lens)-1]
+			meta = append(meta, byte(16+extra))
+		case 17:
+			extra, err = r.ReadBits(3)
+			repeat = 3 + int(extra)
+			meta = append(meta, byte(20+extra))
+		default:
+			extra, err = r.ReadBits(7)
+			repeat = 11 + int(extra)
+			meta = append(meta, byte(28+extra))
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(lens)+repeat > num_lit_len+num_distance {
+			return nil, nil, nil, errors.New("puffin: code lengths overflow")
+		}
+		for ; repeat > 0; repeat-- {
+			lens = append(lens, value)
+		}
+	}
+
+	litlen, err = deflate.NewHuffman(lens[:num_lit_len])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	distance, err = deflate.NewHuffman(lens[num_lit_len:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return litlen, distance, meta, nil
+}
+
+// puffSymbols converts the symbols of a compressed block up to its end.
+func puffSymbols(r *deflate.BitReader, w *puffWriter, litlen, distance *deflate.Huffman) error {
+	for {
+		sym, err := litlen.Decode(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sym < 256:
+			w.literal(byte(sym))
+			continue
+		case sym == 256:
+			w.endOfBlock()
+			return nil
+		}
+
+		idx := sym - 257
+		if idx >= len(deflate.LengthBase) {
+			return fmt.Errorf("puffin: invalid length symbol %d", sym)
+		}
+		extra, err := r.ReadBits(uint(deflate.LengthExtra[idx]))
+		if err != nil {
+			return err
+		}
+		length := int(deflate.LengthBase[idx]) + int(extra)
+
+		dsym, err := distance.Decode(r)
+		if err != nil {
+			return err
+		}
+		if dsym >= len(deflate.DistanceBase) {
+			return fmt.Errorf("puffin: invalid distance symbol %d", dsym)
+		}
+		extra, err = r.ReadBits(uint(deflate.DistanceExtra[dsym]))
+		if err != nil {
+			return err
+		}
+		w.lenDist(length, int(deflate.DistanceBase[dsym])+int(extra))
+	}
+}
@@ -0,0 +1,195 @@
+package puffin_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/affggh/payload_extract/puffin"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		// Compressible but not trivially
+		data[i] = byte(i/7) ^ byte(i%13)*seed
+	}
+	return data
+}
+
+// deflateData compresses data, forcing a sync flush (an empty stored block)
+// halfway through.
+func deflateData(data []byte, level int) []byte {
+	var out bytes.Buffer
+	w, _ := flate.NewWriter(&out, level)
+	w.Write(data[:len(data)/2])
+	w.Flush()
+	w.Write(data[len(data)/2:])
+	w.Close()
+	return out.Bytes()
+}
+
+// container joins raw chunks and deflate streams, returning the deflate
+// sub-blocks found in the result.
+func container(t *testing.T, parts ...[]byte) ([]byte, []puffin.BitExtent) {
+	t.Helper()
+	var data []byte
+	var deflates []puffin.BitExtent
+	for i, part := range parts {
+		if i%2 == 1 {
+			blocks, err := puffin.FindDeflateSubBlocks(append(data, part...), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			deflates = append(deflates, blocks...)
+		}
+		data = append(data, part...)
+	}
+	return data, deflates
+}
+
+func TestPuffHuff(t *testing.T) {
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.HuffmanOnly} {
+		data, deflates := container(t,
+			[]byte("head"),
+			deflateData(testData(200000, 3), level),
+			[]byte("middle"),
+			deflateData([]byte("short fixed block"), level),
+			[]byte("tail"),
+		)
+		if len(deflates) < 3 {
+			t.Errorf("level %d: only %d deflate blocks", level, len(deflates))
+		}
+
+		puff, puffs, err := puffin.PuffStream(data, deflates)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		huffed, err := puffin.HuffStream(puff, deflates, puffs)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if !bytes.Equal(huffed, data) {
+			t.Errorf("level %d: huffed data differs", level)
+		}
+	}
+}
+
+func appendExtent(b []byte, num protowire.Number, offset, length uint64) []byte {
+	var ext []byte
+	ext = protowire.AppendTag(ext, 1, protowire.VarintType)
+	ext = protowire.AppendVarint(ext, offset)
+	ext = protowire.AppendTag(ext, 2, protowire.VarintType)
+	ext = protowire.AppendVarint(ext, length)
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, ext)
+}
+
+func streamInfo(deflates []puffin.BitExtent, puffs []puffin.ByteExtent, puffLength int) []byte {
+	var b []byte
+	for _, d := range deflates {
+		b = appendExtent(b, 1, d.Offset, d.Length)
+	}
+	for _, p := range puffs {
+		b = appendExtent(b, 2, p.Offset*8, p.Length*8)
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(puffLength))
+}
+
+// bsdf2 returns an uncompressed BSDF2 patch from old to new made of a single
+// diff and extra entry.
+func bsdf2(old, new []byte) []byte {
+	var patch bytes.Buffer
+	offtout := func(x int) {
+		binary.Write(&patch, binary.LittleEndian, int64(x))
+	}
+	diff := min(len(old), len(new))
+	patch.WriteString("BSDF2\x00\x00\x00")
+	offtout(24)
+	offtout(diff)
+	offtout(len(new))
+	offtout(diff)
+	offtout(len(new) - diff)
+	offtout(0)
+	for i := 0; i < diff; i++ {
+		patch.WriteByte(new[i] - old[i])
+	}
+	patch.Write(new[diff:])
+	return patch.Bytes()
+}
+
+func makePatch(t *testing.T, src, dst []byte, srcDeflates, dstDeflates []puffin.BitExtent) []byte {
+	t.Helper()
+	srcPuff, srcPuffs, err := puffin.PuffStream(src, srcDeflates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstPuff, dstPuffs, err := puffin.PuffStream(dst, dstDeflates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header []byte
+	header = protowire.AppendTag(header, 1, protowire.VarintType)
+	header = protowire.AppendVarint(header, 1)
+	header = protowire.AppendTag(header, 2, protowire.BytesType)
+	header = protowire.AppendBytes(header, streamInfo(srcDeflates, srcPuffs, len(srcPuff)))
+	header = protowire.AppendTag(header, 3, protowire.BytesType)
+	header = protowire.AppendBytes(header, streamInfo(dstDeflates, dstPuffs, len(dstPuff)))
+
+	patch := []byte("PUF1")
+	patch = binary.BigEndian.AppendUint32(patch, uint32(len(header)))
+	patch = append(patch, header...)
+	return append(patch, bsdf2(srcPuff, dstPuff)...)
+}
+
+func TestPatch(t *testing.T) {
+	content := testData(100000, 5)
+	src, srcDeflates := container(t, []byte("v1"), deflateData(content, flate.DefaultCompression), []byte("end"))
+
+	content[5000]++
+	content = append(content, "more content"...)
+	dst, dstDeflates := container(t, []byte("version 2"), deflateData(content, flate.BestSpeed), []byte("end"))
+
+	patch := makePatch(t, src, dst, srcDeflates, dstDeflates)
+
+	header, offset, err := puffin.ParseHeader(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Src.Deflates) != len(srcDeflates) || len(header.Dst.Puffs) != len(dstDeflates) {
+		t.Errorf("header has %d/%d extents, want %d/%d", len(header.Src.Deflates), len(header.Dst.Puffs), len(srcDeflates), len(dstDeflates))
+	}
+
+	got, err := puffin.Patch(src, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dst) {
+		t.Error("patched data differs")
+	}
+	if size, err := puffin.NewSize(patch); err != nil || size != int64(len(dst)) {
+		t.Errorf("NewSize = %d, %v, want %d", size, err, len(dst))
+	}
+
+	// An embedded patch not sized as the puff stream fails before patching
+	huge := bytes.Clone(patch)
+	binary.LittleEndian.PutUint64(huge[offset+24:], 1<<50)
+	if _, err := puffin.Patch(src, huge); !errors.Is(err, puffin.ErrCorrupt) {
+		t.Errorf("err = %v, want ErrCorrupt", err)
+	}
+
+	// A different source does not puff to the recorded layout
+	other, _ := container(t, []byte("v1"), deflateData(testData(100000, 6), flate.DefaultCompression), []byte("end"))
+	if _, err := puffin.Patch(other, patch); err == nil {
+		t.Error("expected error patching a different source")
+	}
+
+	if _, err := puffin.Patch(src, append([]byte("PUF2"), patch[4:]...)); !errors.Is(err, puffin.ErrCorrupt) {
+		t.Errorf("err = %v, want ErrCorrupt", err)
+	}
+}
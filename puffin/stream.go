@@ -0,0 +1,168 @@
+package puffin
+
+import (
+	"fmt"
+
+	"github.com/affggh/payload_extract/internal/deflate"
+)
+
+// BitExtent is a range of bits, locating a deflate block in a stream.
+type BitExtent struct {
+	Offset, Length uint64
+}
+
+// ByteExtent is a range of bytes, locating a puff in a puff stream.
+type ByteExtent struct {
+	Offset, Length uint64
+}
+
+func (e BitExtent) end() uint64 {
+	return e.Offset + e.Length
+}
+
+// gapBytes is the number of puff stream bytes holding the bits [from, to)
+// between two deflates. The partial bytes at both ends take one byte each,
+// shifted down to bit 0, unless the deflates touch.
+func gapBytes(from, to uint64) uint64 {
+	if from == to {
+		return 0
+	}
+	return (to+7)/8 - from/8
+}
+
+// appendGap appends the bits [from, to) of data in their puff form.
+func appendGap(out []byte, data []byte, from, to uint64) []byte {
+	if from%8 == 0 && to%8 == 0 {
+		return append(out, data[from/8:to/8]...)
+	}
+	r := deflate.NewBitReaderAt(data, int64(from), int64(to))
+	for r.Remaining() > 0 {
+		n := r.BoundaryBits()
+		if n == 0 {
+			n = 8
+		}
+		b, _ := r.ReadBits(uint(min(int64(n), r.Remaining())))
+		out = append(out, byte(b))
+	}
+	return out
+}
+
+// writeGap writes the puff form gap of the bits [from, to) back as bits.
+func writeGap(w *deflate.BitWriter, gap []byte, from, to uint64) {
+	if from%8 == 0 && to%8 == 0 {
+		w.WriteBytes(gap)
+		return
+	}
+	left := to - from
+	for _, b := range gap {
+		n := uint64(w.BoundaryBits())
+		if n == 0 {
+			n = 8
+		}
+		n = min(n, left)
+		w.WriteBits(uint(n), uint32(b))
+		left -= n
+	}
+}
+
+func checkDeflates(deflates []BitExtent, size uint64) error {
+	prev := uint64(0)
+	for i, d := range deflates {
+		if d.Offset < prev || d.end() > size*8 || d.Length == 0 {
+			return fmt.Errorf("puffin: deflate %d (%d+%d bits) out of order or range", i, d.Offset, d.Length)
+		}
+		prev = d.end()
+	}
+	return nil
+}
+
+// PuffStream replaces every deflate of data with its puff and returns the
+// puff stream with the location of each puff in it.
+func PuffStream(data []byte, deflates []BitExtent) ([]byte, []ByteExtent, error) {
+	if err := checkDeflates(deflates, uint64(len(data))); err != nil {
+		return nil, nil, err
+	}
+
+	var out []byte
+	puffs := make([]ByteExtent, 0, len(deflates))
+	prev := uint64(0)
+	for i, d := range deflates {
+		out = appendGap(out, data, prev, d.Offset)
+
+		// The reader spans the bytes holding the deflate, like puffin
+		r := deflate.NewBitReaderAt(data, int64(d.Offset), int64((d.end()+7)/8*8))
+		w := &puffWriter{out: out}
+		if err := puffDeflate(r, w); err != nil {
+			return nil, nil, fmt.Errorf("puffin: deflate %d at bit %d: %w", i, d.Offset, err)
+		}
+		if uint64(r.Offset()) != d.end() {
+			return nil, nil, fmt.Errorf("puffin: deflate %d at bit %d has %d bits, want %d", i, d.Offset, uint64(r.Offset())-d.Offset, d.Length)
+		}
+		puffs = append(puffs, ByteExtent{Offset: uint64(len(out)), Length: uint64(len(w.out) - len(out))})
+		out = w.out
+		prev = d.end()
+	}
+	out = appendGap(out, data, prev, uint64(len(data))*8)
+	return out, puffs, nil
+}
+
+// HuffStream turns a puff stream back into the original data, deflating
+// each puff at the location of its deflate.
+func HuffStream(puff []byte, deflates []BitExtent, puffs []ByteExtent) ([]byte, error) {
+	if len(deflates) != len(puffs) {
+		return nil, fmt.Errorf("puffin: %d deflates but %d puffs", len(deflates), len(puffs))
+	}
+
+	// Data after the last puff is copied as is
+	size := uint64(len(puff))
+	if n := len(puffs); n > 0 {
+		last := puffs[n-1].Offset + puffs[n-1].Length
+		if last > size {
+			return nil, fmt.Errorf("puffin: puff %d out of range", n-1)
+		}
+		size = deflates[n-1].end()/8 + size - last
+	}
+	if err := checkDeflates(deflates, size); err != nil {
+		return nil, err
+	}
+
+	w := &deflate.BitWriter{}
+	prev, pos := uint64(0), uint64(0)
+	for i, d := range deflates {
+		p := puffs[i]
+		if want := gapBytes(prev, d.Offset); p.Offset < pos || p.Offset-pos != want || p.Offset+p.Length > uint64(len(puff)) {
+			return nil, fmt.Errorf("puffin: puff %d (%d+%d) does not match deflate %d", i, p.Offset, p.Length, i)
+		}
+		writeGap(w, puff[pos:p.Offset], prev, d.Offset)
+
+		if err := huffDeflate(puff[p.Offset:p.Offset+p.Length], w); err != nil {
+			return nil, fmt.Errorf("puffin: puff %d: %w", i, err)
+		}
+		if uint64(w.Bits()) != d.end() {
+			return nil, fmt.Errorf("puffin: puff %d huffed to %d bits, want %d", i, uint64(w.Bits())-d.Offset, d.Length)
+		}
+		prev, pos = d.end(), p.Offset+p.Length
+	}
+	writeGap(w, puff[pos:], prev, size*8)
+	return w.Bytes(), nil
+}
+
+// FindDeflateSubBlocks walks the deflate stream starting at byte offset of
+// data and returns the extent of each of its blocks.
+func FindDeflateSubBlocks(data []byte, offset int64) ([]BitExtent, error) {
+	var blocks []BitExtent
+	r := deflate.NewBitReaderAt(data, offset*8, int64(len(data))*8)
+	w := &puffWriter{}
+	for {
+		start := r.Offset()
+		final, err := puffBlock(r, w)
+		if err != nil {
+			return nil, fmt.Errorf("puffin: deflate block at bit %d: %w", start, err)
+		}
+		blocks = append(blocks, BitExtent{Offset: uint64(start), Length: uint64(r.Offset() - start)})
+		if final {
+			return blocks, nil
+		}
+		w.out, w.lits = w.out[:0], w.lits[:0]
+	}
+}
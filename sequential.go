@@ -0,0 +1,94 @@
+package payload_extract_go
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrNotSeekable is returned for reads of a payload stream before the data
+// it already went past.
+var ErrNotSeekable = errors.New("payload stream cannot seek backwards")
+
+// sequentialReaderAt serves ReadAt calls at increasing offsets from a stream,
+// skipping the bytes between them.
+type sequentialReaderAt struct {
+	mu  sync.Mutex
+	r   io.Reader
+	pos int64
+}
+
+func (s *sequentialReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < s.pos {
+		return 0, fmt.Errorf("%w: read at %d, stream at %d", ErrNotSeekable, off, s.pos)
+	}
+	if off > s.pos {
+		n, err := io.CopyN(io.Discard, s.r, off-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(s.r, p)
+	s.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// OpenStream parses the payload header, manifest and metadata signature from
+// the non-seekable stream r, which is then read on by the returned Payload.
+// Its data can be read once, front to back: Extract works once with
+// uncompressed outputs, and reading data before the stream position, as
+// signature verification, ExtractTar and PartitionReader do, fails with
+// ErrNotSeekable.
+func OpenStream(r io.Reader) (*Payload, error) {
+	p := &Payload{}
+
+	var err error
+	p.hdr, p.manifest, p.metadataSig, err = readPayloadMetadata(r, -1)
+	if err != nil {
+		return nil, err
+	}
+	p.metadataSize = int64(p.hdr.HdrSize()) + int64(p.hdr.ManifestLen)
+	p.dataOffset = p.metadataSize + int64(p.hdr.ManifestSigLen)
+
+	// The size is not known ahead, unsigned payloads end with their last blob
+	p.size = p.SignatureOffset() + p.SignatureSize()
+	if p.manifest.SignaturesOffset == nil {
+		for _, partition := range p.manifest.GetPartitions() {
+			for _, operation := range partition.GetOperations() {
+				p.size = max(p.size, p.dataOffset+int64(operation.GetDataOffset()+operation.GetDataLength()))
+			}
+		}
+	}
+
+	p.reader = &sequentialReaderAt{r: r, pos: p.dataOffset}
+	return p, nil
+}
+
+// sequential reports whether the payload is read from a stream.
+func (p *Payload) sequential() bool {
+	_, ok := p.reader.(*sequentialReaderAt)
+	return ok
+}
+
+// ExtractPartitionsFromStream parses the payload from the non-seekable
+// reader and extracts partitions_name (or every partition if empty) into
+// out_dir, in one pass.
+func ExtractPartitionsFromStream(
+	reader io.Reader,
+	partitions_name []string,
+	out_dir string,
+	max_workers int,
+) error {
+	payload, err := OpenStream(reader)
+	if err != nil {
+		return err
+	}
+	return payload.ExtractPartitions(partitions_name, out_dir, max_workers)
+}
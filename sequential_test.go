@@ -0,0 +1,127 @@
+package payload_extract_go_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+// streamTestPayload returns a payload whose blobs are interleaved between
+// partitions, and its images.
+func streamTestPayload() ([]byte, map[string][]byte) {
+	const bs = 4096
+	boot := testImage(bs, 8, 1)
+	vendor := testImage(bs, 10, 2)
+
+	tp := newTestPayload(bs)
+	boot_part := tp.addPartition("boot", boot)
+	vendor_part := tp.addPartition("vendor", vendor)
+	tp.addOp(vendor_part, update_engine.InstallOperation_REPLACE, vendor[5*bs:], ext(5, 5))
+	tp.addOp(boot_part, update_engine.InstallOperation_REPLACE, boot, ext(0, 8))
+	tp.addOp(vendor_part, update_engine.InstallOperation_REPLACE, vendor[:5*bs], ext(0, 5))
+	return tp.bytes(), map[string][]byte{"boot": boot, "vendor": vendor}
+}
+
+func TestExtractStream(t *testing.T) {
+	data, images := streamTestPayload()
+
+	// A reader without ReadAt nor Seek
+	payload, err := payload_extract.OpenStream(struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Size() != int64(len(data)) {
+		t.Errorf("size %d, want %d", payload.Size(), len(data))
+	}
+	if err := payload.ExtractTar(context.Background(), io.Discard, payload_extract.ExtractOptions{}); !errors.Is(err, payload_extract.ErrNotSeekable) {
+		t.Errorf("ExtractTar err = %v, want ErrNotSeekable", err)
+	}
+
+	opts := payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2}
+	if err := payload.Extract(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	for name, image := range images {
+		checkImage(t, opts.OutDir, name, image)
+	}
+
+	// The stream is consumed
+	if err := payload.Extract(context.Background(), opts); !errors.Is(err, payload_extract.ErrNotSeekable) {
+		t.Errorf("second Extract err = %v, want ErrNotSeekable", err)
+	}
+}
+
+func TestZipStreamPayloadReader(t *testing.T) {
+	data, images := streamTestPayload()
+
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		// Deflated with a data descriptor, then stored with known sizes
+		w, err := zw.Create("META-INF/com/android/metadata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bytes.Repeat([]byte("ota-type=AB\n"), 100))
+		care_map := []byte("care map")
+		w, err = zw.CreateRaw(&zip.FileHeader{
+			Name:               "care_map.pb",
+			Method:             zip.Store,
+			CRC32:              crc32.ChecksumIEEE(care_map),
+			CompressedSize64:   uint64(len(care_map)),
+			UncompressedSize64: uint64(len(care_map)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(care_map)
+
+		if method == zip.Store {
+			w, err = zw.CreateRaw(&zip.FileHeader{
+				Name:               "payload.bin",
+				Method:             zip.Store,
+				CRC32:              crc32.ChecksumIEEE(data),
+				CompressedSize64:   uint64(len(data)),
+				UncompressedSize64: uint64(len(data)),
+			})
+		} else {
+			w, err = zw.Create("payload.bin")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w, _ = zw.Create("payload_properties.txt")
+		w.Write([]byte("FILE_HASH=\n"))
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := payload_extract.NewZipStreamPayloadReader(struct{ io.Reader }{&buf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := payload_extract.OpenStream(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := payload_extract.ExtractOptions{OutDir: t.TempDir(), Workers: 2}
+		if err := payload.Extract(context.Background(), opts); err != nil {
+			t.Fatal(err)
+		}
+		for name, image := range images {
+			checkImage(t, opts.OutDir, name, image)
+		}
+	}
+
+	if _, err := payload_extract.NewZipStreamPayloadReader(bytes.NewReader([]byte("PK\x01\x02"))); err == nil {
+		t.Error("zip without payload.bin opened")
+	}
+}
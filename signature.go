@@ -0,0 +1,199 @@
+package payload_extract_go
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/affggh/payload_extract/update_engine"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNoSignatureMatch is returned when no signature slot verifies with any of
+// the given keys.
+var ErrNoSignatureMatch = errors.New("no signature matches the given keys")
+
+// SignatureResult reports the verification of one Signatures message.
+type SignatureResult struct {
+	// Hash is the SHA-256 the signatures were checked against
+	Hash []byte
+	// Count is the number of signature slots
+	Count int
+	// Slot is the index of the first matching signature, -1 if none matched
+	Slot int
+	// Key is the index of the key that verified Slot
+	Key int
+	// Err is nil if a slot matched
+	Err error
+}
+
+// LoadPublicKeys parses every PEM "PUBLIC KEY", "RSA PUBLIC KEY" or
+// "CERTIFICATE" block of data. RSA and ECDSA keys are supported.
+func LoadPublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no public key or certificate found in PEM data")
+	}
+	return keys, nil
+}
+
+// LoadPublicKeysFile is LoadPublicKeys on the content of a file.
+func LoadPublicKeysFile(name string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return LoadPublicKeys(data)
+}
+
+// MetadataHash returns the SHA-256 of header + manifest, which is what the
+// metadata signature signs.
+func (payload *Payload) MetadataHash() ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(payload.reader, 0, payload.metadataSize)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// PayloadHash returns the SHA-256 of everything up to the payload signature
+// blob, leaving out the metadata signature, which is what the payload
+// signature signs.
+func (payload *Payload) PayloadHash(ctx context.Context) ([]byte, error) {
+	h := sha256.New()
+	blobs_size := int64(payload.manifest.GetSignaturesOffset())
+	parts := []*io.SectionReader{
+		io.NewSectionReader(payload.reader, 0, payload.metadataSize),
+		io.NewSectionReader(payload.reader, payload.dataOffset, blobs_size),
+	}
+	for _, part := range parts {
+		if _, err := io.Copy(h, &contextReader{ctx: ctx, r: part}); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// PayloadSignature returns the raw Signatures message at signatures_offset.
+func (payload *Payload) PayloadSignature() ([]byte, error) {
+	if payload.SignatureSize() == 0 {
+		return nil, errors.New("payload is not signed")
+	}
+	buf := make([]byte, payload.SignatureSize())
+	if _, err := readFullAt(payload.reader, buf, payload.SignatureOffset()); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// VerifyMetadataSignature checks the metadata signature against keys.
+func (payload *Payload) VerifyMetadataSignature(keys []crypto.PublicKey) SignatureResult {
+	hash, err := payload.MetadataHash()
+	if err != nil {
+		return SignatureResult{Slot: -1, Err: err}
+	}
+	return verifySignatures(payload.metadataSig, hash, keys)
+}
+
+// VerifyPayloadSignature checks the payload signature against keys.
+func (payload *Payload) VerifyPayloadSignature(ctx context.Context, keys []crypto.PublicKey) SignatureResult {
+	sig, err := payload.PayloadSignature()
+	if err != nil {
+		return SignatureResult{Slot: -1, Err: err}
+	}
+	hash, err := payload.PayloadHash(ctx)
+	if err != nil {
+		return SignatureResult{Slot: -1, Err: err}
+	}
+	return verifySignatures(sig, hash, keys)
+}
+
+// verifySignatures checks each signature slot of the serialized Signatures
+// message sig_data against hash with every key.
+func verifySignatures(sig_data []byte, hash []byte, keys []crypto.PublicKey) SignatureResult {
+	result := SignatureResult{Hash: hash, Slot: -1}
+
+	sigs := new(update_engine.Signatures)
+	if err := proto.Unmarshal(sig_data, sigs); err != nil {
+		result.Err = BadPayload(err)
+		return result
+	}
+	result.Count = len(sigs.GetSignatures())
+
+	for slot, sig := range sigs.GetSignatures() {
+		data := sig.GetData()
+		// EC signatures are padded, unpadded_signature_size is the DER length
+		if n := int(sig.GetUnpaddedSignatureSize()); n > 0 && n <= len(data) {
+			data = data[:n]
+		}
+
+		for idx, key := range keys {
+			var ok bool
+			switch key := key.(type) {
+			case *rsa.PublicKey:
+				ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, data) == nil
+			case *ecdsa.PublicKey:
+				ok = ecdsa.VerifyASN1(key, hash, data)
+			}
+			if ok {
+				result.Slot, result.Key = slot, idx
+				return result
+			}
+		}
+	}
+
+	result.Err = ErrNoSignatureMatch
+	return result
+}
+
+// PrintSignatureResult prints the outcome of a signature verification.
+func PrintSignatureResult(name string, r SignatureResult) {
+	if r.Err != nil {
+		fmt.Printf("\t%s Signature: FAIL (%d slots) %v\n", name, r.Count, r.Err)
+		return
+	}
+	fmt.Printf("\t%s Signature: OK slot %d/%d key %d\n", name, r.Slot, r.Count, r.Key)
+}
@@ -0,0 +1,62 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+)
+
+func TestVerifySignatures(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp := newTestPayload(4096)
+	tp.key = key
+	boot := testImage(4096, 8, 1)
+	tp.addImageOps(tp.addPartition("boot", boot), boot, 2)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	otherDer, _ := x509.MarshalPKIXPublicKey(&other.PublicKey)
+	pemData := append(
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	keys, err := payload_extract.LoadPublicKeys(pemData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := payload.VerifyMetadataSignature(keys); r.Err != nil || r.Slot != 0 || r.Key != 1 {
+		t.Errorf("metadata signature: %+v", r)
+	}
+	if r := payload.VerifyPayloadSignature(context.Background(), keys); r.Err != nil || r.Slot != 0 || r.Key != 1 {
+		t.Errorf("payload signature: %+v", r)
+	}
+
+	// Flip a blob byte, the metadata stays valid but the payload does not
+	data[payload.DataOffset()+10] ^= 1
+	if r := payload.VerifyMetadataSignature(keys); r.Err != nil {
+		t.Errorf("metadata signature after blob change: %v", r.Err)
+	}
+	if r := payload.VerifyPayloadSignature(context.Background(), keys); !errors.Is(r.Err, payload_extract.ErrNoSignatureMatch) {
+		t.Errorf("payload signature after blob change: %v", r.Err)
+	}
+}
@@ -0,0 +1,432 @@
+package payload_extract_go
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+
+	"github.com/affggh/payload_extract/update_engine"
+	"github.com/panjf2000/ants/v2"
+)
+
+// OutputFormat selects the file format of extracted images.
+type OutputFormat int
+
+const (
+	// FormatRaw writes plain partition images.
+	FormatRaw OutputFormat = iota
+	// FormatSparseImage writes Android sparse images, as flashed by fastboot.
+	FormatSparseImage
+)
+
+// Android sparse image format, see libsparse's sparse_format.h. Every field is
+// little endian.
+const (
+	simgMagic           = 0xed26ff3a
+	simgHeaderSize      = 28
+	simgChunkHeaderSize = 12
+
+	simgChunkRaw      = 0xcac1
+	simgChunkFill     = 0xcac2
+	simgChunkDontCare = 0xcac3
+	simgChunkCRC32    = 0xcac4
+)
+
+// Block states of a partition, from its operation list
+const (
+	simgBlockDontCare = iota // written by no operation, or DISCARD
+	simgBlockZero            // ZERO operation
+	simgBlockData
+)
+
+// simgBlockStates returns the states of the first total_blocks blocks of
+// partition.
+func simgBlockStates(partition *update_engine.PartitionUpdate, total_blocks int64) []byte {
+	states := make([]byte, total_blocks)
+	for _, operation := range partition.Operations {
+		state := byte(simgBlockData)
+		switch operation.GetType() {
+		case update_engine.InstallOperation_ZERO:
+			state = simgBlockZero
+		case update_engine.InstallOperation_DISCARD:
+			state = simgBlockDontCare
+		}
+		for _, ext := range operation.GetDstExtents() {
+			start := min(int64(ext.GetStartBlock()), total_blocks)
+			end := min(start+int64(ext.GetNumBlocks()), total_blocks)
+			for b := start; b < end; b++ {
+				states[b] = state
+			}
+		}
+	}
+	return states
+}
+
+// simgChunk is one chunk of a sparse image.
+type simgChunk struct {
+	typ    uint16
+	blocks int64
+	fill   uint32
+	offset int64 // of the header of RAW chunks, written before their data
+}
+
+// simgWriter writes the image of a partition, written to it in order, as an
+// Android sparse image. Blocks of ZERO operations become FILL chunks and
+// blocks no operation writes DONT_CARE chunks, whatever their data. Written
+// blocks repeating a 4 byte pattern become FILL chunks, the others RAW chunks.
+//
+// With max_size, the image is split into <path>.0, <path>.1, ... files of at
+// most max_size bytes, as simg2simg does: each one covers the whole image,
+// with DONT_CARE chunks around its own blocks.
+type simgWriter struct {
+	path         string
+	block_size   int
+	total_blocks int64
+	states       []byte
+	max_size     int64
+	max_blocks   int64 // of RAW chunks
+	crc          bool
+
+	buf    []byte // partial block
+	filled int
+	block  int64 // next block index
+	zero   []byte
+
+	files    []string
+	fd       *os.File
+	bw       *bufio.Writer
+	size     int64 // of the current file, once its pending chunk is written
+	chunks   int   // of the current file, with the pending one
+	checksum hash.Hash32
+	chunk    simgChunk // pending, typ 0 before the first one
+}
+
+func newSimgWriter(path string, partition *update_engine.PartitionUpdate, block_size int, size int64, max_size int64, crc bool) (*simgWriter, error) {
+	total_blocks := (size + int64(block_size) - 1) / int64(block_size)
+	if total_blocks > math.MaxUint32 {
+		return nil, fmt.Errorf("%d blocks do not fit a sparse image", total_blocks)
+	}
+	w := &simgWriter{
+		path:         path,
+		block_size:   block_size,
+		total_blocks: total_blocks,
+		states:       simgBlockStates(partition, total_blocks),
+		max_size:     max_size,
+		// RAW chunks sizes must fit the 32 bit total_sz of their header
+		max_blocks: (1<<32 - 1 - simgChunkHeaderSize) / int64(block_size),
+		crc:        crc,
+		buf:        make([]byte, block_size),
+		zero:       make([]byte, block_size),
+	}
+	// A file holds at least one RAW block between DONT_CARE chunks
+	if min_size := simgHeaderSize + 2*simgChunkHeaderSize + int64(block_size) + w.tailSize(); max_size > 0 && max_size < min_size {
+		return nil, fmt.Errorf("sparse image size limit %d is below %d bytes", max_size, min_size)
+	}
+	return w, nil
+}
+
+// tailSize returns the size of the chunks ending a file: DONT_CARE over the
+// blocks after it, and CRC32.
+func (w *simgWriter) tailSize() int64 {
+	size := int64(simgChunkHeaderSize)
+	if w.crc {
+		size += simgChunkHeaderSize + 4
+	}
+	return size
+}
+
+func (w *simgWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.filled == 0 && len(p) >= w.block_size {
+			if err := w.writeBlock(p[:w.block_size]); err != nil {
+				return n - len(p), err
+			}
+			p = p[w.block_size:]
+			continue
+		}
+		copied := copy(w.buf[w.filled:], p)
+		w.filled += copied
+		p = p[copied:]
+		if w.filled == w.block_size {
+			w.filled = 0
+			if err := w.writeBlock(w.buf); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeBlock adds the next block of the image.
+func (w *simgWriter) writeBlock(data []byte) error {
+	if w.block >= w.total_blocks {
+		return fmt.Errorf("%w: sparse image ends at block %d", ErrDataLength, w.total_blocks)
+	}
+
+	typ, fill := uint16(simgChunkRaw), uint32(0)
+	switch w.states[w.block] {
+	case simgBlockDontCare:
+		typ, data = simgChunkDontCare, w.zero
+	case simgBlockZero:
+		typ, data = simgChunkFill, w.zero
+	default:
+		// A block equal to itself shifted by 4 bytes repeats its first word
+		if bytes.Equal(data[4:], data[:len(data)-4]) {
+			typ, fill = simgChunkFill, binary.LittleEndian.Uint32(data)
+		}
+	}
+
+	extend := w.fd != nil && w.chunk.typ == typ &&
+		(typ != simgChunkFill || w.chunk.fill == fill) &&
+		(typ != simgChunkRaw || w.chunk.blocks < w.max_blocks)
+	grow := int64(0)
+	if typ == simgChunkRaw {
+		grow += int64(w.block_size)
+	}
+	if !extend {
+		grow += simgChunkHeaderSize
+		if typ == simgChunkFill {
+			grow += 4
+		}
+	}
+
+	if w.fd == nil {
+		if err := w.create(); err != nil {
+			return err
+		}
+	} else if w.max_size > 0 && w.size+grow+w.tailSize() > w.max_size {
+		if err := w.finish(); err != nil {
+			return err
+		}
+		if err := w.create(); err != nil {
+			return err
+		}
+		extend = false
+	}
+
+	if !extend {
+		if err := w.startChunk(typ, fill); err != nil {
+			return err
+		}
+	}
+	w.chunk.blocks++
+	if typ == simgChunkRaw {
+		if _, err := w.bw.Write(data); err != nil {
+			return err
+		}
+		w.size += int64(w.block_size)
+	}
+	if w.crc {
+		w.checksum.Write(data)
+	}
+	w.block++
+	return nil
+}
+
+// create starts the next file, with a DONT_CARE chunk over the blocks
+// before it.
+func (w *simgWriter) create() error {
+	path := w.path
+	if w.max_size > 0 {
+		path = fmt.Sprintf("%s.%d", w.path, len(w.files))
+	}
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w.files = append(w.files, path)
+	w.fd, w.bw = fd, bufio.NewWriterSize(fd, 1<<20)
+	w.chunk, w.chunks = simgChunk{}, 0
+	if w.crc {
+		w.checksum = crc32.NewIEEE()
+	}
+
+	// The header is written once the chunks are counted
+	if _, err := w.bw.Write(make([]byte, simgHeaderSize)); err != nil {
+		return err
+	}
+	w.size = simgHeaderSize
+	return w.skip(w.block)
+}
+
+// skip adds a DONT_CARE chunk of blocks blocks around the blocks of the
+// current file.
+func (w *simgWriter) skip(blocks int64) error {
+	if blocks == 0 {
+		return nil
+	}
+	if w.chunk.typ != simgChunkDontCare {
+		if err := w.startChunk(simgChunkDontCare, 0); err != nil {
+			return err
+		}
+	}
+	w.chunk.blocks += blocks
+	if w.crc {
+		for ; blocks > 0; blocks-- {
+			w.checksum.Write(w.zero)
+		}
+	}
+	return nil
+}
+
+// startChunk ends the pending chunk and starts one of typ. The header of RAW
+// chunks is written right away, to be patched once their size is known.
+func (w *simgWriter) startChunk(typ uint16, fill uint32) error {
+	if err := w.endChunk(); err != nil {
+		return err
+	}
+	w.chunk = simgChunk{typ: typ, fill: fill}
+	w.chunks++
+	w.size += simgChunkHeaderSize
+	if typ == simgChunkFill {
+		w.size += 4
+	}
+	if typ == simgChunkRaw {
+		w.chunk.offset = w.size - simgChunkHeaderSize
+		if _, err := w.bw.Write(make([]byte, simgChunkHeaderSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endChunk writes the pending chunk.
+func (w *simgWriter) endChunk() error {
+	chunk := w.chunk
+	switch chunk.typ {
+	case simgChunkRaw:
+		if err := w.bw.Flush(); err != nil {
+			return err
+		}
+		_, err := w.fd.WriteAt(simgChunkHeader(chunk.typ, chunk.blocks, chunk.blocks*int64(w.block_size)), chunk.offset)
+		return err
+	case simgChunkFill:
+		if _, err := w.bw.Write(simgChunkHeader(chunk.typ, chunk.blocks, 4)); err != nil {
+			return err
+		}
+		return binary.Write(w.bw, binary.LittleEndian, chunk.fill)
+	case simgChunkDontCare:
+		_, err := w.bw.Write(simgChunkHeader(chunk.typ, chunk.blocks, 0))
+		return err
+	}
+	return nil
+}
+
+// finish ends the current file with a DONT_CARE chunk over the blocks after
+// it and, with crc, a CRC32 chunk with the checksum of the whole image, as
+// libsparse writes it.
+func (w *simgWriter) finish() error {
+	if err := w.skip(w.total_blocks - w.block); err != nil {
+		return err
+	}
+	if err := w.endChunk(); err != nil {
+		return err
+	}
+	if w.crc {
+		w.chunks++
+		if _, err := w.bw.Write(simgChunkHeader(simgChunkCRC32, 0, 4)); err != nil {
+			return err
+		}
+		if err := binary.Write(w.bw, binary.LittleEndian, w.checksum.Sum32()); err != nil {
+			return err
+		}
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+
+	header := make([]byte, simgHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], simgMagic)
+	binary.LittleEndian.PutUint16(header[4:], 1) // major_version
+	binary.LittleEndian.PutUint16(header[6:], 0) // minor_version
+	binary.LittleEndian.PutUint16(header[8:], simgHeaderSize)
+	binary.LittleEndian.PutUint16(header[10:], simgChunkHeaderSize)
+	binary.LittleEndian.PutUint32(header[12:], uint32(w.block_size))
+	binary.LittleEndian.PutUint32(header[16:], uint32(w.total_blocks))
+	binary.LittleEndian.PutUint32(header[20:], uint32(w.chunks))
+	// image_checksum is left 0, the CRC32 chunk carries it
+	if _, err := w.fd.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	fd := w.fd
+	w.fd = nil
+	return fd.Close()
+}
+
+// Close writes the last partial block, zero padded, and ends the last file.
+func (w *simgWriter) Close() error {
+	if w.filled != 0 {
+		clear(w.buf[w.filled:])
+		w.filled = 0
+		if err := w.writeBlock(w.buf); err != nil {
+			return err
+		}
+	}
+	if w.block != w.total_blocks {
+		return fmt.Errorf("%w: sparse image written up to block %d of %d", io.ErrUnexpectedEOF, w.block, w.total_blocks)
+	}
+	// Images without blocks still get a file
+	if w.fd == nil && len(w.files) == 0 {
+		if err := w.create(); err != nil {
+			return err
+		}
+	}
+	return w.finish()
+}
+
+// remove deletes the files written so far.
+func (w *simgWriter) remove() {
+	if w.fd != nil {
+		w.fd.Close()
+		w.fd = nil
+	}
+	for _, path := range w.files {
+		os.Remove(path)
+	}
+}
+
+func simgChunkHeader(typ uint16, blocks int64, data_size int64) []byte {
+	header := make([]byte, simgChunkHeaderSize)
+	binary.LittleEndian.PutUint16(header[0:], typ)
+	binary.LittleEndian.PutUint16(header[2:], 0)
+	binary.LittleEndian.PutUint32(header[4:], uint32(blocks))
+	binary.LittleEndian.PutUint32(header[8:], uint32(simgChunkHeaderSize+data_size))
+	return header
+}
+
+// extractSparseImage streams the image of p into the sparse image at
+// out_path, or the files it is split into, see simgWriter. Nothing is left
+// behind on errors.
+func (payload *Payload) extractSparseImage(
+	ctx context.Context,
+	p *update_engine.PartitionUpdate,
+	opts ExtractOptions,
+	out_path string,
+	source io.ReaderAt,
+	progress ProgressReporter,
+	pool *ants.Pool,
+) error {
+	block_size := payload.BlockSize()
+	size := imageSize(p, block_size)
+	w, err := newSimgWriter(out_path, p, block_size, size, opts.SimgMaxSize, opts.SimgCRC)
+	if err != nil {
+		return err
+	}
+	err = streamPartition(ctx, w, payload, block_size, p, size, source, !opts.SkipDataHash, progress, pool, 2*max(opts.Workers, 1))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		w.remove()
+	}
+	return err
+}
@@ -0,0 +1,230 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+type simgChunk struct {
+	typ    uint16
+	blocks uint32
+}
+
+// unsparse expands a sparse image, returning the raw image and its chunks.
+// The CRC32 chunk, if any, is checked against the expanded image.
+func unsparse(t *testing.T, simg []byte) ([]byte, []simgChunk) {
+	t.Helper()
+	le := binary.LittleEndian
+	if len(simg) < 28 || le.Uint32(simg) != 0xed26ff3a {
+		t.Fatal("bad sparse image magic")
+	}
+	bs := int(le.Uint32(simg[12:]))
+	totalBlocks := int(le.Uint32(simg[16:]))
+	totalChunks := int(le.Uint32(simg[20:]))
+
+	var raw []byte
+	var chunks []simgChunk
+	pos := int(le.Uint16(simg[8:]))
+	for i := 0; i < totalChunks; i++ {
+		typ, blocks, size := le.Uint16(simg[pos:]), le.Uint32(simg[pos+4:]), int(le.Uint32(simg[pos+8:]))
+		data := simg[pos+12 : pos+size]
+		pos += size
+		chunks = append(chunks, simgChunk{typ, blocks})
+
+		switch typ {
+		case 0xcac1:
+			if len(data) != int(blocks)*bs {
+				t.Fatalf("chunk %d: %d bytes of RAW data for %d blocks", i, len(data), blocks)
+			}
+			raw = append(raw, data...)
+		case 0xcac2:
+			for j := 0; j < int(blocks)*bs/4; j++ {
+				raw = append(raw, data...)
+			}
+		case 0xcac3:
+			raw = append(raw, make([]byte, int(blocks)*bs)...)
+		case 0xcac4:
+			if got := crc32.ChecksumIEEE(raw); got != le.Uint32(data) {
+				t.Errorf("crc32 %08x, image has %08x", le.Uint32(data), got)
+			}
+		default:
+			t.Fatalf("chunk %d: unknown type %#x", i, typ)
+		}
+	}
+	if pos != len(simg) {
+		t.Errorf("%d bytes after the last chunk", len(simg)-pos)
+	}
+	if len(raw) != totalBlocks*bs {
+		t.Errorf("chunks cover %d bytes, header has %d blocks", len(raw), totalBlocks)
+	}
+	return raw, chunks
+}
+
+// sparseTestPayload returns a payload whose boot image has RAW, FILL and
+// DONT_CARE blocks, and the image.
+func sparseTestPayload() ([]byte, []byte) {
+	const bs = 4096
+	boot := testImage(bs, 16, 1)
+	clear(boot[4*bs : 6*bs])
+	for i := 6 * bs; i < 8*bs; i += 4 {
+		binary.LittleEndian.PutUint32(boot[i:], 0xdeadbeef)
+	}
+	// Blocks 8 and 9 are written by no operation
+	clear(boot[8*bs : 10*bs])
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:4*bs], ext(0, 4))
+	tp.addOp(part, update_engine.InstallOperation_ZERO, nil, ext(4, 2))
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[6*bs:8*bs], ext(6, 2))
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[10*bs:], ext(10, 6))
+	return tp.bytes(), boot
+}
+
+func TestExtractSparseImage(t *testing.T) {
+	data, boot := sparseTestPayload()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	err = payload.Extract(context.Background(), payload_extract.ExtractOptions{
+		OutDir:  out,
+		Workers: 2,
+		Format:  payload_extract.FormatSparseImage,
+		SimgCRC: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	simg, err := os.ReadFile(filepath.Join(out, "boot.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(out); len(entries) != 1 {
+		t.Errorf("%d files in the output directory, want boot.img only", len(entries))
+	}
+
+	raw, chunks := unsparse(t, simg)
+	if !bytes.Equal(raw, boot) {
+		t.Error("expanded image differs")
+	}
+	// testImage leaves blocks 3 and 13 zero
+	want := []simgChunk{
+		{0xcac1, 3},
+		{0xcac2, 3}, // zero block 3 and the ZERO operation
+		{0xcac2, 2}, // 0xdeadbeef
+		{0xcac3, 2},
+		{0xcac1, 3},
+		{0xcac2, 1},
+		{0xcac1, 2},
+		{0xcac4, 0},
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("chunks %v, want %v", chunks, want)
+	}
+	for i := range want {
+		if chunks[i] != want[i] {
+			t.Errorf("chunk %d is %v, want %v", i, chunks[i], want[i])
+		}
+	}
+}
+
+func TestExtractSparseImageSplit(t *testing.T) {
+	const bs = 4096
+	data, boot := sparseTestPayload()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for the header, a FILL chunk, 3 RAW blocks and the tail chunks
+	const max_size = 28 + 16 + 12 + 3*bs + 12 + 16
+	out := t.TempDir()
+	err = payload.Extract(context.Background(), payload_extract.ExtractOptions{
+		OutDir:      out,
+		Workers:     2,
+		Format:      payload_extract.FormatSparseImage,
+		SimgMaxSize: max_size,
+		SimgCRC:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every file covers the image, blocks which are not DONT_CARE in one
+	// file are in no other
+	image := make([]byte, len(boot))
+	covered := make([]bool, len(boot)/bs)
+	entries, _ := os.ReadDir(out)
+	for i := range entries {
+		simg, err := os.ReadFile(filepath.Join(out, fmt.Sprintf("boot.img.%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(simg) > max_size {
+			t.Errorf("boot.img.%d has %d bytes, limit is %d", i, len(simg), max_size)
+		}
+		raw, chunks := unsparse(t, simg)
+		if len(raw) != len(boot) {
+			t.Fatalf("boot.img.%d expands to %d bytes, want %d", i, len(raw), len(boot))
+		}
+		pos := 0
+		for _, chunk := range chunks {
+			end := pos + int(chunk.blocks)
+			if chunk.typ == 0xcac1 || chunk.typ == 0xcac2 {
+				for b := pos; b < end; b++ {
+					if covered[b] {
+						t.Errorf("block %d in several files", b)
+					}
+					covered[b] = true
+				}
+				copy(image[pos*bs:end*bs], raw[pos*bs:end*bs])
+			}
+			pos = end
+		}
+	}
+	if len(entries) < 2 {
+		t.Errorf("image split into %d files", len(entries))
+	}
+	if !bytes.Equal(image, boot) {
+		t.Error("merged image differs")
+	}
+
+	// A limit below a single block fails without leaving files behind
+	out = t.TempDir()
+	err = payload.Extract(context.Background(), payload_extract.ExtractOptions{
+		OutDir:      out,
+		Format:      payload_extract.FormatSparseImage,
+		SimgMaxSize: bs,
+	})
+	if err == nil {
+		t.Error("expected error for a limit below one block")
+	}
+	if entries, _ := os.ReadDir(out); len(entries) != 0 {
+		t.Errorf("%d files left behind", len(entries))
+	}
+
+	// Sparse images are streamed from a seekable payload
+	stream, err := payload_extract.OpenStream(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Extract(context.Background(), payload_extract.ExtractOptions{OutDir: t.TempDir(), Format: payload_extract.FormatSparseImage})
+	if !errors.Is(err, payload_extract.ErrNotSeekable) {
+		t.Errorf("err = %v, want ErrNotSeekable", err)
+	}
+}
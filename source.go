@@ -0,0 +1,215 @@
+package payload_extract_go
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/affggh/payload_extract/bsdiff"
+	"github.com/affggh/payload_extract/lz4diff"
+	"github.com/affggh/payload_extract/puffin"
+	"github.com/affggh/payload_extract/update_engine"
+	"github.com/affggh/payload_extract/zucchini"
+	"github.com/andybalholm/brotli"
+)
+
+// SourceProvider gives access to the partition images of the previous build,
+// which the SOURCE_* operations of a delta payload read from. Images with a
+// Size or Stat method, as *os.File, have the source extents of operations
+// checked against their size before these are read.
+type SourceProvider interface {
+	OpenSource(partition string) (io.ReaderAt, error)
+}
+
+// DirSource serves <dir>/<partition>.img files, as extracted from the
+// previous build's full payload.
+type DirSource struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// NewDirSource creates a DirSource reading images from dir.
+func NewDirSource(dir string) *DirSource {
+	return &DirSource{
+		dir:   dir,
+		files: make(map[string]*os.File),
+	}
+}
+
+// OpenSource opens <dir>/<partition>.img, returning the same file on repeated
+// calls.
+func (d *DirSource) OpenSource(partition string) (io.ReaderAt, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if fd, ok := d.files[partition]; ok {
+		return fd, nil
+	}
+	fd, err := os.Open(path.Join(d.dir, partition+".img"))
+	if err != nil {
+		return nil, err
+	}
+	d.files[partition] = fd
+	return fd, nil
+}
+
+// Close closes every opened source image.
+func (d *DirSource) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	for name, fd := range d.files {
+		if cerr := fd.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(d.files, name)
+	}
+	return err
+}
+
+// isSourceOperation reports whether an operation reads the source partition.
+func isSourceOperation(op_type update_engine.InstallOperation_Type) bool {
+	switch op_type {
+	case update_engine.InstallOperation_SOURCE_COPY,
+		update_engine.InstallOperation_SOURCE_BSDIFF,
+		update_engine.InstallOperation_BROTLI_BSDIFF,
+		update_engine.InstallOperation_PUFFDIFF,
+		update_engine.InstallOperation_ZUCCHINI,
+		update_engine.InstallOperation_LZ4DIFF_BSDIFF,
+		update_engine.InstallOperation_LZ4DIFF_PUFFDIFF:
+		return true
+	}
+	return false
+}
+
+// needsSource reports whether any operation of partition reads the source
+// partition.
+func needsSource(partition *update_engine.PartitionUpdate) bool {
+	for _, operation := range partition.GetOperations() {
+		if isSourceOperation(operation.GetType()) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceSize returns the size of a source image, from the Size method of
+// bytes.Reader and io.SectionReader or the Stat method of *os.File.
+func sourceSize(source io.ReaderAt) (int64, bool) {
+	switch s := source.(type) {
+	case interface{ Size() int64 }:
+		return s.Size(), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := s.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size(), true
+		}
+	}
+	return 0, false
+}
+
+// readSourceExtents reads the src_extents of operation from source and checks
+// them against src_sha256_hash.
+func readSourceExtents(operation *update_engine.InstallOperation, source io.ReaderAt, block_size int) ([]byte, error) {
+	if source == nil {
+		return nil, fmt.Errorf("%s operation needs a source image", operation.GetType())
+	}
+
+	// The extents come from the manifest, keep them within the image before
+	// allocating them
+	size, known := sourceSize(source)
+	total := uint64(0)
+	for _, ext := range operation.GetSrcExtents() {
+		if known {
+			blocks := uint64(size) / uint64(block_size)
+			if ext.GetStartBlock() > blocks || ext.GetNumBlocks() > blocks-ext.GetStartBlock() {
+				return nil, BadPayload(fmt.Sprintf("source extent %d+%d exceeds the source image of %d bytes", ext.GetStartBlock(), ext.GetNumBlocks(), size))
+			}
+		}
+		total += ext.GetNumBlocks() * uint64(block_size)
+	}
+	if known && total > uint64(size) {
+		return nil, BadPayload(fmt.Sprintf("source extents of %d bytes exceed the source image of %d bytes", total, size))
+	}
+
+	buf := make([]byte, total)
+	pos := uint64(0)
+	for _, ext := range operation.GetSrcExtents() {
+		length := ext.GetNumBlocks() * uint64(block_size)
+		if _, err := readFullAt(source, buf[pos:pos+length], int64(ext.GetStartBlock()*uint64(block_size))); err != nil {
+			return nil, fmt.Errorf("read source extent %d+%d: %w", ext.GetStartBlock(), ext.GetNumBlocks(), err)
+		}
+		pos += length
+	}
+
+	if want := operation.GetSrcSha256Hash(); len(want) != 0 {
+		if got := sha256.Sum256(buf); !bytes.Equal(got[:], want) {
+			return nil, fmt.Errorf("%w: source extents have sha256 %x, want %x, wrong source image?", ErrHashMismatch, got, want)
+		}
+	}
+	return buf, nil
+}
+
+// applyDiffOperation patches the src_extents of operation with the patch in
+// data and writes the result to its dst_extents.
+func applyDiffOperation(operation *update_engine.InstallOperation, writer io.WriterAt, block_size int, data []byte, source io.ReaderAt) (int, error) {
+	var new_size func(patch []byte) (int64, error)
+	var apply func(old, patch []byte) ([]byte, error)
+	switch operation.GetType() {
+	case update_engine.InstallOperation_SOURCE_BSDIFF,
+		update_engine.InstallOperation_BROTLI_BSDIFF:
+		new_size, apply = bsdiff.NewSize, bsdiff.Patch
+	case update_engine.InstallOperation_PUFFDIFF:
+		new_size, apply = puffin.NewSize, puffin.Patch
+	case update_engine.InstallOperation_ZUCCHINI:
+		var err error
+		if data, err = zucchiniPatch(data); err != nil {
+			return 0, err
+		}
+		new_size, apply = zucchini.NewSize, zucchini.Apply
+	case update_engine.InstallOperation_LZ4DIFF_BSDIFF,
+		update_engine.InstallOperation_LZ4DIFF_PUFFDIFF:
+		new_size, apply = lz4diff.NewSize, lz4diff.Patch
+	default:
+		return 0, BadPayload("unexpcted diff type " + operation.GetType().String())
+	}
+
+	// The patch header sizes the output, check it against dst_extents before
+	// patching
+	size, err := new_size(data)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkDataLength(size, extentsSize(operation.GetDstExtents(), block_size), block_size); err != nil {
+		return 0, err
+	}
+
+	src_data, err := readSourceExtents(operation, source, block_size)
+	if err != nil {
+		return 0, err
+	}
+	new_data, err := apply(src_data, data)
+	if err != nil {
+		return 0, err
+	}
+	return writeExtents(writer, operation.GetDstExtents(), new_data, block_size)
+}
+
+// zucchiniPatch returns the Zucchini patch of a ZUCCHINI operation blob,
+// which some generators brotli compress.
+func zucchiniPatch(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte("Zucc")) {
+		return data, nil
+	}
+	patch, err := io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("zucchini patch is neither raw nor brotli compressed: %w", err)
+	}
+	return patch, nil
+}
@@ -0,0 +1,89 @@
+package payload_extract_go
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+// sparseWriter skips writing all-zero blocks to a freshly truncated file,
+// leaving them as holes. It relies on every block of the output being written
+// at most once, which holds for the operations of a partition.
+type sparseWriter struct {
+	writer     io.WriterAt
+	block_size int64
+}
+
+func newSparseWriter(writer io.WriterAt, block_size int) *sparseWriter {
+	return &sparseWriter{writer: writer, block_size: int64(block_size)}
+}
+
+func (w *sparseWriter) WriteAt(p []byte, off int64) (int, error) {
+	// Runs of non-zero blocks are written with a single WriteAt
+	start := 0
+	for pos := 0; pos < len(p); {
+		end := min(len(p), pos+int(w.block_size-(off+int64(pos))%w.block_size))
+		if !isZero(p[pos:end]) {
+			pos = end
+			continue
+		}
+
+		if start < pos {
+			if n, err := w.writer.WriteAt(p[start:pos], off+int64(start)); err != nil {
+				return start + n, err
+			}
+		}
+		pos = end
+		start = end
+	}
+	if start < len(p) {
+		n, err := w.writer.WriteAt(p[start:], off+int64(start))
+		return start + n, err
+	}
+	return len(p), nil
+}
+
+func isZero(b []byte) bool {
+	for len(b) > 0 {
+		n := min(len(b), len(zero_buffer))
+		if !bytes.Equal(b[:n], zero_buffer[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// DiskUsage returns the size of the file at path and the space allocated to
+// it, smaller than size for sparse files. Where the allocated space is not
+// known it is reported as the size.
+func DiskUsage(path string) (int64, int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), allocatedSize(info), nil
+}
+
+// PrintDiskUsage prints the size and allocated space of the images of
+// partitions in out_dir, and their totals.
+func PrintDiskUsage(out_dir string, partitions []*update_engine.PartitionUpdate) {
+	fmt.Println("Disk Usage:")
+	fmt.Println("\t\t", "PartitionName", "Size", "Allocated")
+	var total_size, total_allocated int64
+	for _, p := range partitions {
+		size, allocated, err := DiskUsage(path.Join(out_dir, p.GetPartitionName()+".img"))
+		if err != nil {
+			fmt.Printf("\t\t %-14s%v\n", p.GetPartitionName(), err)
+			continue
+		}
+		total_size += size
+		total_allocated += allocated
+		fmt.Printf("\t\t %-14s%-12d%d\n", p.GetPartitionName(), size, allocated)
+	}
+	fmt.Printf("\t\t %-14s%-12d%d\n", "total", total_size, total_allocated)
+}
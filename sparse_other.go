@@ -0,0 +1,9 @@
+//go:build !unix
+
+package payload_extract_go
+
+import "os"
+
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package payload_extract_go
+
+import (
+	"os"
+	"syscall"
+)
+
+func allocatedSize(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		// st_blocks counts 512 byte units whatever the filesystem block size
+		return int64(st.Blocks) * 512
+	}
+	return info.Size()
+}
@@ -0,0 +1,292 @@
+package payload_extract_go
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/affggh/payload_extract/update_engine"
+	"github.com/panjf2000/ants/v2"
+)
+
+// operationBuffer is an io.WriterAt collecting in memory what an operation
+// writes to its dst_extents, in extent order.
+type operationBuffer struct {
+	extents    []*update_engine.Extent
+	block_size int64
+	data       []byte
+}
+
+func newOperationBuffer(operation *update_engine.InstallOperation, block_size int) *operationBuffer {
+	return &operationBuffer{
+		extents:    operation.GetDstExtents(),
+		block_size: int64(block_size),
+		data:       make([]byte, extentsSize(operation.GetDstExtents(), block_size)),
+	}
+}
+
+func (b *operationBuffer) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	buf_offset := int64(0)
+	for _, ext := range b.extents {
+		start := int64(ext.GetStartBlock()) * b.block_size
+		length := int64(ext.GetNumBlocks()) * b.block_size
+		if cur := off + int64(n); n < len(p) && cur >= start && cur < start+length {
+			n += copy(b.data[buf_offset+cur-start:buf_offset+length], p[n:])
+		}
+		buf_offset += length
+	}
+	if n < len(p) {
+		return n, fmt.Errorf("%w: write at %d outside dst_extents", ErrDataLength, off+int64(n))
+	}
+	return n, nil
+}
+
+// streamedOperation is an operation decoded ahead of the stream.
+type streamedOperation struct {
+	done      chan struct{}
+	buffer    *operationBuffer
+	err       error
+	remaining int // extents not streamed yet
+}
+
+// streamPartition writes the first size bytes of the image of partition to w
+// in order. Operations are decoded by the pool in the order the stream needs
+// them, up to window operations ahead, instead of being written in place.
+func streamPartition(
+	ctx context.Context,
+	w io.Writer,
+	payload *Payload,
+	block_size int,
+	partition *update_engine.PartitionUpdate,
+	size int64,
+	source io.ReaderAt,
+	verify_data bool,
+	progress ProgressReporter,
+	pool *ants.Pool,
+	window int,
+) error {
+	operations := partition.GetOperations()
+
+	// Extents in destination order, holes are streamed as zeros
+	var extents []partitionExtent
+	for idx, operation := range operations {
+		switch operation.GetType() {
+		case update_engine.InstallOperation_ZERO,
+			update_engine.InstallOperation_DISCARD:
+			continue
+		}
+		op_offset := int64(0)
+		for _, ext := range operation.GetDstExtents() {
+			length := int64(ext.GetNumBlocks()) * int64(block_size)
+			extents = append(extents, partitionExtent{
+				offset:    int64(ext.GetStartBlock()) * int64(block_size),
+				length:    length,
+				operation: idx,
+				opOffset:  op_offset,
+			})
+			op_offset += length
+		}
+	}
+	sort.SliceStable(extents, func(i, j int) bool {
+		return extents[i].offset < extents[j].offset
+	})
+
+	// Operations in the order of their first extent in the stream
+	var order []int
+	streamed := make(map[int]*streamedOperation)
+	order_index := make(map[int]int)
+	for _, ext := range extents {
+		op, ok := streamed[ext.operation]
+		if !ok {
+			op = &streamedOperation{done: make(chan struct{})}
+			streamed[ext.operation] = op
+			order_index[ext.operation] = len(order)
+			order = append(order, ext.operation)
+		}
+		op.remaining++
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// Stops the decoding of queued operations once the stream failed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	submitted := 0
+	submit := func(idx int) error {
+		operation := operations[idx]
+		op := streamed[idx]
+
+		data, err := payload.readOperationData(operation)
+		if err != nil {
+			return fmt.Errorf("operation %d: %w", idx, err)
+		}
+
+		wg.Add(1)
+		err = pool.Submit(func() {
+			defer wg.Done()
+			defer close(op.done)
+			// ants recovers panics on its own, hiding them from the caller
+			defer func() {
+				if r := recover(); r != nil {
+					op.err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			if op.err = ctx.Err(); op.err != nil {
+				return
+			}
+			if verify_data {
+				if op.err = checkDataHash(operation, data, payload.dataOffset); op.err != nil {
+					return
+				}
+			}
+			op.buffer = newOperationBuffer(operation, block_size)
+			op.err = extractOperationToFile(operation, op.buffer, block_size, data, source, false, progress, partition.GetPartitionName())
+			if op.err == nil {
+				progress.OperationDone(partition.GetPartitionName(), idx)
+			}
+		})
+		if err != nil {
+			wg.Done()
+			return fmt.Errorf("operation %d: %w", idx, err)
+		}
+		return nil
+	}
+
+	pos := int64(0)
+	for _, ext := range extents {
+		if ext.offset >= size {
+			break
+		}
+		if ext.offset < pos {
+			return BadPayload(fmt.Sprintf("operation %d overlaps another one at %d", ext.operation, ext.offset))
+		}
+		if ext.offset > pos {
+			if _, err := io.CopyN(w, zeroReader{}, ext.offset-pos); err != nil {
+				return err
+			}
+			pos = ext.offset
+		}
+
+		// Decode up to window operations past the one needed now
+		for ; submitted < min(order_index[ext.operation]+window, len(order)); submitted++ {
+			if err := submit(order[submitted]); err != nil {
+				return err
+			}
+		}
+
+		op := streamed[ext.operation]
+		select {
+		case <-op.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if op.err != nil {
+			return fmt.Errorf("operation %d: %w", ext.operation, op.err)
+		}
+
+		// The image is cut at size
+		length := min(ext.length, size-ext.offset)
+		if _, err := w.Write(op.buffer.data[ext.opOffset : ext.opOffset+length]); err != nil {
+			return err
+		}
+		pos = ext.offset + length
+
+		if op.remaining--; op.remaining == 0 {
+			op.buffer = nil
+		}
+	}
+
+	if pos < size {
+		if _, err := io.CopyN(w, zeroReader{}, size-pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroReader reads zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// imageSize returns the size of the streamed image of p, its
+// new_partition_info size or else the end of its last extent.
+func imageSize(p *update_engine.PartitionUpdate, block_size int) int64 {
+	if size := int64(p.GetNewPartitionInfo().GetSize()); size != 0 {
+		return size
+	}
+	return partitionSize(p, block_size)
+}
+
+// ExtractTar writes the partitions selected by opts to w as a tar archive of
+// <name>.img entries, sized from new_partition_info. Operations are decoded
+// concurrently but written in destination order, so w needs not seek. The
+// output options of opts do not apply, and the first error ends the archive.
+func (payload *Payload) ExtractTar(ctx context.Context, w io.Writer, opts ExtractOptions) error {
+	if payload.sequential() {
+		return fmt.Errorf("%w: tar entries are streamed in partition order", ErrNotSeekable)
+	}
+
+	all_parts := payload.Partitions(opts.Partitions)
+	block_size := payload.BlockSize()
+
+	progress := opts.Progress
+	if progress == nil {
+		progress = NopProgress{}
+	}
+
+	pool, err := ants.NewPool(opts.Workers)
+	if err != nil {
+		return err
+	}
+	defer pool.Release()
+
+	tw := tar.NewWriter(w)
+	mod_time := time.Now().Truncate(time.Second)
+	for idx, p := range all_parts {
+		size := imageSize(p, block_size)
+
+		var source io.ReaderAt
+		if needsSource(p) {
+			if opts.Source == nil {
+				return fmt.Errorf("partition %s: delta update needs a source image", p.GetPartitionName())
+			}
+			source, err = opts.Source.OpenSource(p.GetPartitionName())
+			if err != nil {
+				return fmt.Errorf("partition %s: %w", p.GetPartitionName(), err)
+			}
+		}
+
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     p.GetPartitionName() + ".img",
+			Size:     size,
+			Mode:     0644,
+			ModTime:  mod_time,
+		})
+		if err != nil {
+			return err
+		}
+
+		progress.PartitionStarted(p.GetPartitionName(), idx, len(all_parts), size)
+		err = streamPartition(ctx, tw, payload, block_size, p, size, source, !opts.SkipDataHash, progress, pool, 2*max(opts.Workers, 1))
+		if err != nil && !errors.Is(err, ctx.Err()) {
+			progress.Error(p.GetPartitionName(), err)
+		}
+		progress.PartitionFinished(p.GetPartitionName())
+		if err != nil {
+			return fmt.Errorf("partition %s: %w", p.GetPartitionName(), err)
+		}
+	}
+	return tw.Close()
+}
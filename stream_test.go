@@ -0,0 +1,98 @@
+package payload_extract_go_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/DataDog/zstd"
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+func TestExtractTar(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 10, 1)
+	// Block 5 is written by no operation, the image ends with 2 blocks no
+	// extent reaches
+	clear(boot[5*bs : 6*bs])
+	boot = append(boot, make([]byte, 2*bs)...)
+	vendor := testImage(bs, 40, 2)
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("boot", boot)
+	// Operations in payload order write the image out of order
+	compressed, err := zstd.Compress(nil, append(bytes.Clone(boot[8*bs:10*bs]), boot[:2*bs]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.addOp(part, update_engine.InstallOperation_ZSTD, compressed, ext(8, 2), ext(0, 2))
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[2*bs:5*bs], ext(2, 3))
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[6*bs:8*bs], ext(6, 2))
+	tp.addImageOps(tp.addPartition("vendor", vendor), vendor, 3)
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	// A writer without Seek nor WriteAt
+	w := struct{ io.Writer }{&out}
+	if err := payload.ExtractTar(context.Background(), w, payload_extract.ExtractOptions{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{"boot.img": boot, "vendor.img": vendor}
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		image, ok := want[hdr.Name]
+		if !ok {
+			t.Errorf("unexpected entry %s", hdr.Name)
+			continue
+		}
+		delete(want, hdr.Name)
+		if !bytes.Equal(got, image) {
+			t.Errorf("%s differs", hdr.Name)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("missing entries %v", want)
+	}
+}
+
+func TestExtractTarError(t *testing.T) {
+	const bs = 4096
+	boot := testImage(bs, 8, 1)
+
+	tp := newTestPayload(bs)
+	part := tp.addPartition("boot", boot)
+	tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[:4*bs], ext(0, 4))
+	op := tp.addOp(part, update_engine.InstallOperation_REPLACE, boot[4*bs:], ext(4, 4))
+	op.DataSha256Hash[0] ^= 0xff
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = payload.ExtractTar(context.Background(), io.Discard, payload_extract.ExtractOptions{Workers: 2})
+	if !errors.Is(err, payload_extract.ErrHashMismatch) {
+		t.Errorf("err = %v, want ErrHashMismatch", err)
+	}
+}
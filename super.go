@@ -0,0 +1,310 @@
+package payload_extract_go
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+// Logical partition (LP) metadata of super images, see liblp's
+// metadata_format.h. Every field is little endian.
+//
+// The super image starts with reserved bytes, the geometry and its backup,
+// then every metadata slot and their backups. Partition data follows from the
+// first logical sector.
+const (
+	lpReservedBytes     = 4096
+	lpGeometrySize      = 4096
+	lpMetadataMaxSize   = 65536
+	lpSectorSize        = 512
+	lpLogicalBlockSize  = 4096
+	lpPartitionAlign    = 1 << 20
+	lpDefaultSlotCount  = 2
+	lpPartitionNameSize = 36
+
+	lpGeometryMagic  = 0x616c4467
+	lpGeometryStruct = 52
+	lpHeaderMagic    = 0x414c5030
+	lpMajorVersion   = 10
+	lpHeaderSizeV1_0 = 128
+	lpHeaderSizeV1_2 = 256
+
+	lpPartitionEntrySize   = 52
+	lpExtentEntrySize      = 24
+	lpGroupEntrySize       = 48
+	lpBlockDeviceEntrySize = 64
+
+	lpPartitionAttrReadonly = 1
+	lpTargetTypeLinear      = 0
+	lpHeaderFlagVirtualAB   = 1
+)
+
+// lpSlotSuffixes are the slots of the super image. Logical partitions get
+// their data in the first one and are empty in the other.
+var lpSlotSuffixes = []string{"_a", "_b"}
+
+type superGroup struct {
+	name     string
+	max_size uint64
+}
+
+type superPartition struct {
+	name   string
+	group  int
+	offset int64 // in the super image
+	size   int64 // 0 for partitions without extent
+}
+
+// superLayout places the logical partitions of dynamic_partition_metadata in
+// a super image.
+type superLayout struct {
+	size       int64
+	slots      int
+	virtual_ab bool
+	groups     []superGroup
+	partitions []superPartition
+	// data partition of every unsuffixed partition name
+	index map[string]int
+}
+
+// firstLogicalOffset returns where partition data starts, past the metadata
+// and its backups.
+func (l *superLayout) firstLogicalOffset() int64 {
+	reserved := int64(lpReservedBytes + 2*(lpGeometrySize+lpMetadataMaxSize*l.slots))
+	return alignUp(reserved, lpPartitionAlign)
+}
+
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
+
+// newSuperLayout lays out the logical partitions of metadata whose image size
+// is in sizes in a super image of size bytes with slots metadata slots.
+// Partitions missing from sizes are left out.
+func newSuperLayout(metadata *update_engine.DynamicPartitionMetadata, sizes map[string]int64, size int64, slots int) (*superLayout, error) {
+	if slots <= 0 {
+		slots = lpDefaultSlotCount
+	}
+	if size%lpLogicalBlockSize != 0 {
+		return nil, fmt.Errorf("super size %d is not a multiple of %d", size, lpLogicalBlockSize)
+	}
+	l := &superLayout{
+		size:       size,
+		slots:      slots,
+		virtual_ab: metadata.GetSnapshotEnabled(),
+		groups:     []superGroup{{name: "default"}},
+		index:      make(map[string]int),
+	}
+
+	offset := l.firstLogicalOffset()
+	for slot, suffix := range lpSlotSuffixes {
+		for _, group := range metadata.GetGroups() {
+			l.groups = append(l.groups, superGroup{name: group.GetName() + suffix, max_size: group.GetSize()})
+			group_index := len(l.groups) - 1
+
+			group_size := uint64(0)
+			for _, name := range group.GetPartitionNames() {
+				partition_size, ok := sizes[name]
+				if !ok {
+					continue
+				}
+				if len(name+suffix) >= lpPartitionNameSize {
+					return nil, fmt.Errorf("partition name %q is too long", name+suffix)
+				}
+
+				part := superPartition{name: name + suffix, group: group_index}
+				if slot == 0 {
+					part.size = alignUp(partition_size, lpLogicalBlockSize)
+					part.offset = offset
+					offset = alignUp(offset+part.size, lpPartitionAlign)
+					if part.offset+part.size > size {
+						return nil, fmt.Errorf("partition %s does not fit in a super of %d bytes", part.name, size)
+					}
+					l.index[name] = len(l.partitions)
+				}
+				group_size += uint64(part.size)
+				l.partitions = append(l.partitions, part)
+			}
+			if group.GetSize() != 0 && group_size > group.GetSize() {
+				return nil, fmt.Errorf("group %s needs %d bytes, maximum is %d", group.GetName()+suffix, group_size, group.GetSize())
+			}
+		}
+	}
+	return l, nil
+}
+
+// partition returns the offset of the data of the unsuffixed partition name
+// in the super image, if it is laid out there.
+func (l *superLayout) partition(name string) (int64, bool) {
+	if l == nil {
+		return 0, false
+	}
+	i, ok := l.index[name]
+	if !ok {
+		return 0, false
+	}
+	return l.partitions[i].offset, true
+}
+
+func putLpName(b []byte, name string) {
+	copy(b[:lpPartitionNameSize-1], name)
+}
+
+// geometry returns the LpMetadataGeometry block.
+func (l *superLayout) geometry() []byte {
+	b := make([]byte, lpGeometrySize)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], lpGeometryMagic)
+	le.PutUint32(b[4:], lpGeometryStruct)
+	le.PutUint32(b[40:], lpMetadataMaxSize)
+	le.PutUint32(b[44:], uint32(l.slots))
+	le.PutUint32(b[48:], lpLogicalBlockSize)
+	// The checksum covers the struct with a zero checksum
+	sum := sha256.Sum256(b[:lpGeometryStruct])
+	copy(b[8:], sum[:])
+	return b
+}
+
+// metadata returns the LpMetadataHeader followed by the partition, extent,
+// group and block device tables.
+func (l *superLayout) metadata() ([]byte, error) {
+	le := binary.LittleEndian
+
+	var tables []byte
+	var extents []byte
+	for _, part := range l.partitions {
+		entry := make([]byte, lpPartitionEntrySize)
+		putLpName(entry, part.name)
+		le.PutUint32(entry[36:], lpPartitionAttrReadonly)
+		le.PutUint32(entry[40:], uint32(len(extents)/lpExtentEntrySize))
+		le.PutUint32(entry[48:], uint32(part.group))
+		if part.size != 0 {
+			le.PutUint32(entry[44:], 1)
+			extent := make([]byte, lpExtentEntrySize)
+			le.PutUint64(extent[0:], uint64(part.size/lpSectorSize))
+			le.PutUint32(extent[8:], lpTargetTypeLinear)
+			le.PutUint64(extent[12:], uint64(part.offset/lpSectorSize))
+			le.PutUint32(extent[20:], 0) // block device index
+			extents = append(extents, extent...)
+		}
+		tables = append(tables, entry...)
+	}
+	partitions_size := len(tables)
+	tables = append(tables, extents...)
+
+	for _, group := range l.groups {
+		entry := make([]byte, lpGroupEntrySize)
+		putLpName(entry, group.name)
+		le.PutUint64(entry[40:], group.max_size)
+		tables = append(tables, entry...)
+	}
+
+	device := make([]byte, lpBlockDeviceEntrySize)
+	le.PutUint64(device[0:], uint64(l.firstLogicalOffset()/lpSectorSize))
+	le.PutUint32(device[8:], lpPartitionAlign)
+	le.PutUint64(device[16:], uint64(l.size))
+	putLpName(device[24:], "super")
+	tables = append(tables, device...)
+
+	header_size := lpHeaderSizeV1_0
+	minor_version := 0
+	if l.virtual_ab {
+		// Header flags need metadata version 10.2
+		header_size, minor_version = lpHeaderSizeV1_2, 2
+	}
+	if header_size+len(tables) > lpMetadataMaxSize {
+		return nil, fmt.Errorf("super metadata of %d bytes exceeds %d", header_size+len(tables), lpMetadataMaxSize)
+	}
+
+	header := make([]byte, header_size)
+	le.PutUint32(header[0:], lpHeaderMagic)
+	le.PutUint16(header[4:], lpMajorVersion)
+	le.PutUint16(header[6:], uint16(minor_version))
+	le.PutUint32(header[8:], uint32(header_size))
+	le.PutUint32(header[44:], uint32(len(tables)))
+	tables_sum := sha256.Sum256(tables)
+	copy(header[48:], tables_sum[:])
+
+	// Table descriptors: offset from the end of the header, entry count and
+	// entry size
+	descriptor := func(at, offset, size, entry_size int) {
+		le.PutUint32(header[at:], uint32(offset))
+		le.PutUint32(header[at+4:], uint32(size/entry_size))
+		le.PutUint32(header[at+8:], uint32(entry_size))
+	}
+	descriptor(80, 0, partitions_size, lpPartitionEntrySize)
+	descriptor(92, partitions_size, len(extents), lpExtentEntrySize)
+	descriptor(104, partitions_size+len(extents), len(l.groups)*lpGroupEntrySize, lpGroupEntrySize)
+	descriptor(116, len(tables)-lpBlockDeviceEntrySize, lpBlockDeviceEntrySize, lpBlockDeviceEntrySize)
+	if l.virtual_ab {
+		le.PutUint32(header[128:], lpHeaderFlagVirtualAB)
+	}
+
+	header_sum := sha256.Sum256(header)
+	copy(header[12:], header_sum[:])
+	return append(header, tables...), nil
+}
+
+// writeMetadata writes the geometry and every metadata slot, with their
+// backups, to the super image w.
+func (l *superLayout) writeMetadata(w io.WriterAt) error {
+	metadata, err := l.metadata()
+	if err != nil {
+		return err
+	}
+
+	geometry := l.geometry()
+	for _, offset := range []int64{lpReservedBytes, lpReservedBytes + lpGeometrySize} {
+		if _, err := w.WriteAt(geometry, offset); err != nil {
+			return err
+		}
+	}
+
+	slots_offset := int64(lpReservedBytes + 2*lpGeometrySize)
+	for slot := 0; slot < 2*l.slots; slot++ {
+		if _, err := w.WriteAt(metadata, slots_offset+int64(slot)*lpMetadataMaxSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planSuper lays out the logical partitions among partitions, but those
+// written to devices, in a super image of opts.SuperSize.
+func (payload *Payload) planSuper(partitions []*update_engine.PartitionUpdate, opts ExtractOptions) (*superLayout, error) {
+	metadata := payload.Manifest().GetDynamicPartitionMetadata()
+	if metadata == nil {
+		return nil, errors.New("payload has no dynamic_partition_metadata")
+	}
+
+	sizes := make(map[string]int64)
+	for _, p := range partitions {
+		if _, ok := opts.Devices[p.GetPartitionName()]; ok {
+			continue
+		}
+		sizes[p.GetPartitionName()] = partitionSize(p, payload.BlockSize())
+	}
+	return newSuperLayout(metadata, sizes, opts.SuperSize, opts.SuperMetadataSlots)
+}
+
+// createSuper creates <OutDir>/super.img of opts.SuperSize with the metadata
+// of layout.
+func createSuper(layout *superLayout, opts ExtractOptions) (*os.File, error) {
+	super_path := path.Join(opts.OutDir, "super.img")
+	fd, err := createImage(super_path, opts.SuperSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := layout.writeMetadata(fd); err != nil {
+		fd.Close()
+		os.Remove(super_path)
+		return nil, err
+	}
+	return fd, nil
+}
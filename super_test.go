@@ -0,0 +1,174 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+	"github.com/affggh/payload_extract/update_engine"
+	"google.golang.org/protobuf/proto"
+)
+
+type lpPartition struct {
+	name    string
+	group   string
+	extents [][2]uint64 // num_sectors, first sector
+}
+
+// readLpMetadata checks the geometry and the first metadata slot of a super
+// image and returns its partitions and groups sizes.
+func readLpMetadata(t *testing.T, super []byte) ([]lpPartition, map[string]uint64) {
+	t.Helper()
+	le := binary.LittleEndian
+
+	geometry := bytes.Clone(super[4096 : 4096+52])
+	if le.Uint32(geometry) != 0x616c4467 {
+		t.Fatal("bad geometry magic")
+	}
+	if !bytes.Equal(geometry, super[8192:8192+52]) {
+		t.Error("backup geometry differs")
+	}
+	sum := bytes.Clone(geometry[8:40])
+	clear(geometry[8:40])
+	if got := sha256.Sum256(geometry); !bytes.Equal(got[:], sum) {
+		t.Error("bad geometry checksum")
+	}
+
+	header := super[12288:]
+	if le.Uint32(header) != 0x414c5030 || le.Uint16(header[4:]) != 10 {
+		t.Fatal("bad metadata header")
+	}
+	headerSize := le.Uint32(header[8:])
+	check := bytes.Clone(header[:headerSize])
+	clear(check[12:44])
+	if got := sha256.Sum256(check); !bytes.Equal(got[:], header[12:44]) {
+		t.Error("bad header checksum")
+	}
+	tables := header[headerSize : headerSize+le.Uint32(header[44:])]
+	if got := sha256.Sum256(tables); !bytes.Equal(got[:], header[48:80]) {
+		t.Error("bad tables checksum")
+	}
+
+	table := func(at int) [][]byte {
+		offset, num, size := le.Uint32(header[at:]), le.Uint32(header[at+4:]), le.Uint32(header[at+8:])
+		var entries [][]byte
+		for i := uint32(0); i < num; i++ {
+			entries = append(entries, tables[offset+i*size:offset+(i+1)*size])
+		}
+		return entries
+	}
+	name := func(b []byte) string {
+		return strings.TrimRight(string(b[:36]), "\x00")
+	}
+
+	groups := make(map[string]uint64)
+	var groupNames []string
+	for _, g := range table(104) {
+		groups[name(g)] = le.Uint64(g[40:])
+		groupNames = append(groupNames, name(g))
+	}
+	extents := table(92)
+	var partitions []lpPartition
+	for _, p := range table(80) {
+		part := lpPartition{name: name(p), group: groupNames[le.Uint32(p[48:])]}
+		first, num := le.Uint32(p[40:]), le.Uint32(p[44:])
+		for _, e := range extents[first : first+num] {
+			part.extents = append(part.extents, [2]uint64{le.Uint64(e), le.Uint64(e[12:])})
+		}
+		partitions = append(partitions, part)
+	}
+
+	devices := table(116)
+	if len(devices) != 1 || name(devices[0][24:]) != "super" || le.Uint64(devices[0][16:]) != uint64(len(super)) {
+		t.Error("bad block device")
+	}
+	return partitions, groups
+}
+
+func TestExtractSuper(t *testing.T) {
+	const bs = 4096
+	system := testImage(bs, 300, 1)
+	vendor := testImage(bs, 7, 2)
+	boot := testImage(bs, 4, 3)
+
+	tp := newTestPayload(bs)
+	for name, image := range map[string][]byte{"system": system, "vendor": vendor, "boot": boot} {
+		tp.addImageOps(tp.addPartition(name, image), image, 16)
+	}
+	tp.dynamic = &update_engine.DynamicPartitionMetadata{
+		Groups: []*update_engine.DynamicPartitionGroup{{
+			Name:           proto.String("main"),
+			Size:           proto.Uint64(8 << 20),
+			PartitionNames: []string{"system", "vendor"},
+		}},
+	}
+	data := tp.bytes()
+
+	payload, err := payload_extract.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	opts := payload_extract.ExtractOptions{OutDir: out, Workers: 2, SuperSize: 16 << 20}
+	if err := payload.Extract(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, out, "boot", boot)
+	if _, err := os.Stat(filepath.Join(out, "system.img")); !os.IsNotExist(err) {
+		t.Error("system.img written outside super.img")
+	}
+
+	super, err := os.ReadFile(filepath.Join(out, "super.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(super) != 16<<20 {
+		t.Fatalf("super.img is %d bytes", len(super))
+	}
+	partitions, groups := readLpMetadata(t, super)
+
+	if groups["main_a"] != 8<<20 || groups["main_b"] != 8<<20 {
+		t.Errorf("groups %v", groups)
+	}
+	images := map[string][]byte{"system_a": system, "vendor_a": vendor}
+	var names []string
+	for _, p := range partitions {
+		names = append(names, p.name)
+		if !strings.HasPrefix(p.group, "main_") || p.group[4:] != p.name[len(p.name)-2:] {
+			t.Errorf("%s in group %s", p.name, p.group)
+		}
+		image, ok := images[p.name]
+		if !ok {
+			if len(p.extents) != 0 {
+				t.Errorf("%s has extents", p.name)
+			}
+			continue
+		}
+		if len(p.extents) != 1 || p.extents[0][0]*512 != uint64(len(image)) {
+			t.Fatalf("%s extents %v", p.name, p.extents)
+		}
+		start := p.extents[0][1] * 512
+		if start%(1<<20) != 0 {
+			t.Errorf("%s starts at %d, not aligned", p.name, start)
+		}
+		if !bytes.Equal(super[start:start+uint64(len(image))], image) {
+			t.Errorf("%s data differs", p.name)
+		}
+	}
+	if want := "system_a vendor_a system_b vendor_b"; strings.Join(names, " ") != want {
+		t.Errorf("partitions %s, want %s", strings.Join(names, " "), want)
+	}
+
+	// Partitions must fit the super size
+	opts.SuperSize = 2 << 20
+	if err := payload.Extract(context.Background(), opts); err == nil {
+		t.Error("extracting to a too small super image succeeded")
+	}
+}
@@ -0,0 +1,168 @@
+package payload_extract_go_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/DataDog/zstd"
+	"github.com/affggh/payload_extract/update_engine"
+	"google.golang.org/protobuf/proto"
+)
+
+// testPayload builds small in-memory payloads for tests.
+type testPayload struct {
+	blockSize  int
+	partitions []*update_engine.PartitionUpdate
+	blobs      bytes.Buffer
+	// key signs the metadata and payload if set
+	key *rsa.PrivateKey
+	// dynamic is the manifest's dynamic_partition_metadata
+	dynamic *update_engine.DynamicPartitionMetadata
+}
+
+func newTestPayload(blockSize int) *testPayload {
+	return &testPayload{blockSize: blockSize}
+}
+
+func ext(start, num uint64) *update_engine.Extent {
+	return &update_engine.Extent{StartBlock: proto.Uint64(start), NumBlocks: proto.Uint64(num)}
+}
+
+// addPartition adds a partition with the expected image content. The
+// operations are added afterwards with addOp or generated with addImageOps.
+func (tp *testPayload) addPartition(name string, image []byte) *update_engine.PartitionUpdate {
+	hash := sha256.Sum256(image)
+	part := &update_engine.PartitionUpdate{
+		PartitionName: proto.String(name),
+		NewPartitionInfo: &update_engine.PartitionInfo{
+			Size: proto.Uint64(uint64(len(image))),
+			Hash: hash[:],
+		},
+	}
+	tp.partitions = append(tp.partitions, part)
+	return part
+}
+
+// addOp appends an operation with blob data to part.
+func (tp *testPayload) addOp(part *update_engine.PartitionUpdate, typ update_engine.InstallOperation_Type, data []byte, dst ...*update_engine.Extent) *update_engine.InstallOperation {
+	op := &update_engine.InstallOperation{
+		Type:       typ.Enum(),
+		DstExtents: dst,
+	}
+	if len(data) > 0 {
+		hash := sha256.Sum256(data)
+		op.DataOffset = proto.Uint64(uint64(tp.blobs.Len()))
+		op.DataLength = proto.Uint64(uint64(len(data)))
+		op.DataSha256Hash = hash[:]
+		tp.blobs.Write(data)
+	}
+	part.Operations = append(part.Operations, op)
+	return op
+}
+
+// addImageOps splits image into chunks of chunkBlocks blocks and emits a
+// ZERO, REPLACE or ZSTD operation for each of them.
+func (tp *testPayload) addImageOps(part *update_engine.PartitionUpdate, image []byte, chunkBlocks int) {
+	chunk := chunkBlocks * tp.blockSize
+	for off := 0; off < len(image); off += chunk {
+		data := image[off:min(off+chunk, len(image))]
+		dst := ext(uint64(off/tp.blockSize), uint64(len(data)/tp.blockSize))
+
+		switch {
+		case bytes.Count(data, []byte{0}) == len(data):
+			tp.addOp(part, update_engine.InstallOperation_ZERO, nil, dst)
+		case (off/chunk)%2 == 0:
+			tp.addOp(part, update_engine.InstallOperation_REPLACE, data, dst)
+		default:
+			compressed, err := zstd.Compress(nil, data)
+			if err != nil {
+				panic(err)
+			}
+			tp.addOp(part, update_engine.InstallOperation_ZSTD, compressed, dst)
+		}
+	}
+}
+
+func (tp *testPayload) bytes() []byte {
+	sigSize := 256
+	if tp.key != nil {
+		sigSize = tp.key.Size()
+	}
+	signatures := func(data []byte) []byte {
+		sigs, err := proto.Marshal(&update_engine.Signatures{
+			Signatures: []*update_engine.Signatures_Signature{{
+				Data:                  data,
+				UnpaddedSignatureSize: proto.Uint32(uint32(len(data))),
+			}},
+		})
+		if err != nil {
+			panic(err)
+		}
+		return sigs
+	}
+	// Placeholder of the final signature size
+	sigs := signatures(make([]byte, sigSize))
+
+	manifest := &update_engine.DeltaArchiveManifest{
+		BlockSize:        proto.Uint32(uint32(tp.blockSize)),
+		MinorVersion:     proto.Uint32(0),
+		Partitions:       tp.partitions,
+		SignaturesOffset: proto.Uint64(uint64(tp.blobs.Len())),
+		SignaturesSize:   proto.Uint64(uint64(len(sigs))),
+
+		DynamicPartitionMetadata: tp.dynamic,
+	}
+	manifestBytes, err := proto.Marshal(manifest)
+	if err != nil {
+		panic(err)
+	}
+
+	var metadata bytes.Buffer
+	metadata.WriteString("CrAU")
+	binary.Write(&metadata, binary.BigEndian, uint64(2))
+	binary.Write(&metadata, binary.BigEndian, uint64(len(manifestBytes)))
+	binary.Write(&metadata, binary.BigEndian, uint32(len(sigs)))
+	metadata.Write(manifestBytes)
+
+	metadataSig, payloadSig := sigs, sigs
+	if tp.key != nil {
+		sign := func(parts ...[]byte) []byte {
+			h := sha256.New()
+			for _, part := range parts {
+				h.Write(part)
+			}
+			sig, err := rsa.SignPKCS1v15(nil, tp.key, crypto.SHA256, h.Sum(nil))
+			if err != nil {
+				panic(err)
+			}
+			return signatures(sig)
+		}
+		metadataSig = sign(metadata.Bytes())
+		payloadSig = sign(metadata.Bytes(), tp.blobs.Bytes())
+	}
+
+	var out bytes.Buffer
+	out.Write(metadata.Bytes())
+	out.Write(metadataSig)
+	out.Write(tp.blobs.Bytes())
+	out.Write(payloadSig)
+	return out.Bytes()
+}
+
+// testImage returns a partition image of blocks blocks mixing random-ish and
+// zero filled blocks.
+func testImage(blockSize, blocks int, seed byte) []byte {
+	image := make([]byte, blockSize*blocks)
+	for b := 0; b < blocks; b++ {
+		if b%5 == 3 {
+			continue
+		}
+		for i := 0; i < blockSize; i++ {
+			image[b*blockSize+i] = byte(i*7+b) ^ seed
+		}
+	}
+	return image
+}
@@ -3,9 +3,9 @@ package payload_extract_go
 // Generated by Google Gemini 2.5 preview
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"sync"
@@ -24,6 +24,8 @@ const defaultUserAgent = "Dalvik/2.1.0 (Linux; U; Android 15; RMX5010 Build/AP3A
 // for consecutive ReadAt calls to improve performance on sequential patterns.
 type UrlRangeReaderAt struct {
 	url string
+	// ctx is used by ReadAt, which has no context argument
+	ctx context.Context
 
 	total int64
 	// mu protects access to the stream, streamNextBytePos, and client fields.
@@ -43,41 +45,55 @@ func (r *UrlRangeReaderAt) Size() int64 {
 // NewUrlRangeReaderAt creates a new UrlRangeReaderAt for the given URL.
 // It uses a default http.Client.
 func NewUrlRangeReaderAt(url string) *UrlRangeReaderAt {
+	r, err := NewUrlRangeReaderAtContext(context.Background(), url)
+	if err != nil {
+		Logger.Fatalln(err)
+	}
+	return r
+}
+
+// NewUrlRangeReaderAtContext creates a new UrlRangeReaderAt for the given URL.
+// ctx bounds the initial request and every later ReadAt, cancelling it aborts
+// in-flight range requests.
+func NewUrlRangeReaderAtContext(ctx context.Context, url string) (*UrlRangeReaderAt, error) {
 	defaultClient := http.Client{
 		//Timeout: 30 * time.Second, // Example timeout
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	req.Header.Add("User-Agent", defaultUserAgent)
 
 	resp, err := defaultClient.Do(req)
 	if err != nil {
-		Logger.Fatalln(err)
+		return nil, err
 	}
+	// Only the headers are needed
+	resp.Body.Close()
 	//fmt.Printf("Header: %v Code:%d\n", resp.Header, resp.StatusCode)
 
 	total, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 	if err != nil {
-		Logger.Fatalln(err)
+		return nil, err
 	}
 
 	return &UrlRangeReaderAt{
 		url:    url,
+		ctx:    ctx,
 		client: defaultClient,
 		total:  total,
 		// stream starts as nil
 		// streamNextBytePos starts at 0
-	}
+	}, nil
 }
 
 func (r *UrlRangeReaderAt) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.stream != nil {
-		r.Close()
+		r.stream.Close()
 		r.stream = nil
 	}
 
@@ -89,6 +105,17 @@ func (r *UrlRangeReaderAt) Close() error {
 // It attempts to reuse the internal stream if 'off' is contiguous
 // with the end of the previous read from the stream.
 func (r *UrlRangeReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return r.ReadAtContext(r.ctx, p, off)
+}
+
+// ReadAtContext is like ReadAt but makes the range request with ctx.
+func (r *UrlRangeReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	if len(p) == 0 {
 		return 0, nil // As per io.ReaderAt contract
 	}
@@ -138,7 +165,7 @@ func (r *UrlRangeReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
 		r.mu.Unlock()
 
 		// Make a new HTTP request for the specific range.
-		req, httpErr := http.NewRequest("GET", r.url, nil)
+		req, httpErr := http.NewRequestWithContext(ctx, "GET", r.url, nil)
 		if httpErr != nil {
 			return 0, fmt.Errorf("UrlRangeReaderAt.ReadAt: failed to create request for offset %d: %w", off, httpErr)
 		}
@@ -0,0 +1,123 @@
+package payload_extract_go
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/affggh/payload_extract/update_engine"
+)
+
+// VerifyResult is the outcome of checking one extracted image against the
+// partition's new_partition_info.
+type VerifyResult struct {
+	Partition string
+	Path      string
+
+	Size     int64
+	WantSize int64
+	Hash     []byte
+	WantHash []byte
+
+	// Skipped is set when the manifest has no size nor hash for the partition
+	Skipped bool
+	// Err is nil if the image matches
+	Err error
+}
+
+// OK reports whether the image matched new_partition_info.
+func (r *VerifyResult) OK() bool {
+	return r.Err == nil
+}
+
+// VerifyImage streams the image at image_path and compares its size and
+// SHA-256 with info.
+func VerifyImage(ctx context.Context, image_path string, info *update_engine.PartitionInfo) VerifyResult {
+	result := VerifyResult{
+		Path:     image_path,
+		WantSize: int64(info.GetSize()),
+		WantHash: info.GetHash(),
+	}
+	if info.Size == nil && len(result.WantHash) == 0 {
+		result.Skipped = true
+		return result
+	}
+
+	fd, err := os.Open(image_path)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	result.Size, err = io.Copy(h, &contextReader{ctx: ctx, r: fd})
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Hash = h.Sum(nil)
+
+	switch {
+	case info.Size != nil && result.Size != result.WantSize:
+		result.Err = fmt.Errorf("size is %d, want %d", result.Size, result.WantSize)
+	case len(result.WantHash) != 0 && !bytes.Equal(result.Hash, result.WantHash):
+		result.Err = fmt.Errorf("%w: sha256 is %x, want %x", ErrHashMismatch, result.Hash, result.WantHash)
+	}
+	return result
+}
+
+// VerifyImages checks <out_dir>/<name>.img of every selected partition (every
+// partition if partitions_name is empty). The returned error joins every
+// failure, the results hold the per partition details.
+func (payload *Payload) VerifyImages(ctx context.Context, out_dir string, partitions_name []string) ([]VerifyResult, error) {
+	var results []VerifyResult
+	var errs []error
+	for _, p := range payload.Partitions(partitions_name) {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		result := VerifyImage(ctx, path.Join(out_dir, p.GetPartitionName()+".img"), p.GetNewPartitionInfo())
+		result.Partition = p.GetPartitionName()
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("partition %s: %w", result.Partition, result.Err))
+		}
+		results = append(results, result)
+	}
+	return results, errors.Join(errs...)
+}
+
+// PrintVerifyResults prints a per partition OK/FAIL table.
+func PrintVerifyResults(results []VerifyResult) {
+	fmt.Println("Verify Result:")
+	fmt.Println("\t\t", "PartitionName", "Status", "Detail")
+	for _, r := range results {
+		status, detail := "OK", fmt.Sprintf("%d %x", r.Size, r.Hash)
+		switch {
+		case r.Skipped:
+			status, detail = "SKIP", "no new_partition_info"
+		case r.Err != nil:
+			status, detail = "FAIL", r.Err.Error()
+		}
+		fmt.Printf("\t\t %-14s%-6s%s\n", r.Partition, status, detail)
+	}
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
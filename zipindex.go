@@ -0,0 +1,332 @@
+package payload_extract_go
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/DataDog/zstd"
+	"github.com/affggh/payload_extract/internal/deflate"
+)
+
+const (
+	// Default distance between the checkpoints of deflated payload indexes
+	defaultZipIndexInterval = 4 << 20
+	// Compressed data read at once while indexing
+	zipIndexChunkSize = 1 << 20
+)
+
+// ErrZipIndexMismatch is returned when loading the index of another zip
+// entry.
+var ErrZipIndexMismatch = errors.New("zip index does not match payload.bin")
+
+// deflateCheckpoint is a deflate block boundary the entry can be inflated
+// from without the data before it.
+type deflateCheckpoint struct {
+	in     int64  // bit offset of the block in the compressed data
+	out    int64  // uncompressed offset of the block
+	window []byte // up to deflate.WindowSize bytes of output before out
+}
+
+// inflater inflates deflate data from a checkpoint on. Unlike
+// compress/flate it starts at any bit, checkpoints need not be byte aligned.
+type inflater struct {
+	src  io.ReaderAt // compressed data
+	size int64       // compressed size
+
+	buf     []byte // compressed data from buf_off
+	buf_off int64
+	bits    *deflate.BitReader // over buf, nil before the first fill
+	out     []byte             // window followed by the output not read yet
+	unread  int                // start of the output not read yet in out
+	pos     int64              // uncompressed offset of out[unread]
+	final   bool               // the final block was inflated
+
+	// block is called at each block boundary before inflating the block
+	block func(f *inflater)
+}
+
+func newInflater(src io.ReaderAt, size int64, c *deflateCheckpoint) *inflater {
+	f := &inflater{src: src, size: size}
+	f.reset(c)
+	return f
+}
+
+// reset restarts the inflater at c.
+func (f *inflater) reset(c *deflateCheckpoint) {
+	f.buf, f.buf_off, f.bits = f.buf[:0], c.in/8, nil
+	f.out = append(f.out[:0], c.window...)
+	f.unread, f.pos, f.final = len(f.out), c.out, false
+	if err := f.fill(c.in); err != nil {
+		// Reported again by the next inflate
+		f.bits = nil
+	}
+}
+
+// fill reads more compressed data, dropping what comes before bit offset
+// start.
+func (f *inflater) fill(start int64) error {
+	drop := int(start/8 - f.buf_off)
+	f.buf = append(f.buf[:0], f.buf[drop:]...)
+	f.buf_off += int64(drop)
+
+	end := f.buf_off + int64(len(f.buf))
+	if end >= f.size {
+		return io.ErrUnexpectedEOF
+	}
+	chunk := min(int64(zipIndexChunkSize), f.size-end)
+	f.buf = append(f.buf, make([]byte, chunk)...)
+	n, err := readFullAt(f.src, f.buf[len(f.buf)-int(chunk):], end)
+	f.buf = f.buf[:len(f.buf)-int(chunk)+n]
+	if err != nil && err != io.EOF {
+		return err
+	}
+	f.bits = deflate.NewBitReaderAt(f.buf, start-f.buf_off*8, int64(len(f.buf))*8)
+	return nil
+}
+
+// boundary returns the compressed bit offset and the uncompressed offset of
+// the next block, and the window before it.
+func (f *inflater) boundary() (in, out int64, window []byte) {
+	return f.buf_off*8 + f.bits.Offset(), f.pending(), f.out[max(0, len(f.out)-deflate.WindowSize):]
+}
+
+// inflateBlock inflates the next block.
+func (f *inflater) inflateBlock() error {
+	// Keep the window of the output already read
+	if drop := f.unread - deflate.WindowSize; drop > 0 {
+		f.out = append(f.out[:0], f.out[drop:]...)
+		f.unread -= drop
+	}
+
+	if f.bits == nil {
+		return io.ErrUnexpectedEOF
+	}
+	if f.block != nil {
+		f.block(f)
+	}
+
+	start := f.buf_off*8 + f.bits.Offset()
+	for {
+		r := *f.bits
+		inflated, final, err := deflate.InflateBlock(&r, f.out)
+		if errors.Is(err, deflate.ErrUnexpectedEnd) {
+			// The block goes on past the data read so far
+			if err := f.fill(start); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f.out, *f.bits, f.final = inflated, r, final
+		return nil
+	}
+}
+
+// pending returns the uncompressed offset the output inflated so far ends
+// at, the offset of the next block.
+func (f *inflater) pending() int64 {
+	return f.pos + int64(len(f.out)-f.unread)
+}
+
+// read reads at off, at or after the inflater position, skipping the data
+// before it.
+func (f *inflater) read(p []byte, off int64) (int, error) {
+	for {
+		pending := f.out[f.unread:]
+		if skip := off - f.pos; skip > 0 {
+			skipped := min(skip, int64(len(pending)))
+			f.unread += int(skipped)
+			f.pos += skipped
+			pending = pending[skipped:]
+		}
+		if off == f.pos && len(pending) > 0 {
+			n := copy(p, pending)
+			f.unread += n
+			f.pos += int64(n)
+			return n, nil
+		}
+		if f.final {
+			return 0, io.EOF
+		}
+		if err := f.inflateBlock(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// zipIndex gives random access to the deflated data of a zip entry, zran
+// style: inflating it the first time records a checkpoint every interval
+// bytes of output, reads before the last one restart from the checkpoint
+// before them.
+type zipIndex struct {
+	src         io.ReaderAt // compressed data
+	size        int64       // compressed size
+	interval    int64
+	checkpoints []deflateCheckpoint // by offset
+
+	// indexer inflates from a checkpoint on, recording new ones past the
+	// last
+	indexer *inflater
+}
+
+func newZipIndex(src io.ReaderAt, size int64, interval int64) *zipIndex {
+	x := &zipIndex{
+		src:         src,
+		size:        size,
+		interval:    interval,
+		checkpoints: []deflateCheckpoint{{}},
+	}
+	x.indexer = newInflater(src, size, &x.checkpoints[0])
+	x.indexer.block = x.record
+	return x
+}
+
+// record adds a checkpoint at the next block of f once interval bytes went
+// by since the last one.
+func (x *zipIndex) record(f *inflater) {
+	in, out, window := f.boundary()
+	if out >= x.indexed()+x.interval {
+		x.checkpoints = append(x.checkpoints, deflateCheckpoint{in: in, out: out, window: bytes.Clone(window)})
+	}
+}
+
+// checkpoint returns the last checkpoint at or before off.
+func (x *zipIndex) checkpoint(off int64) *deflateCheckpoint {
+	idx := sort.Search(len(x.checkpoints), func(i int) bool {
+		return x.checkpoints[i].out > off
+	})
+	return &x.checkpoints[idx-1]
+}
+
+// indexed returns the offset of the last checkpoint.
+func (x *zipIndex) indexed() int64 {
+	return x.checkpoints[len(x.checkpoints)-1].out
+}
+
+// forward reports whether the indexer is the way to read at off: it is
+// there or before, or off comes after the last checkpoint.
+func (x *zipIndex) forward(off int64) bool {
+	return off >= x.indexer.pos || off >= x.indexed()
+}
+
+// read reads from the indexer at off, restarting it from the checkpoint
+// before off when off is behind it or past a checkpoint it did not reach.
+func (x *zipIndex) read(p []byte, off int64) (int, error) {
+	c := x.checkpoint(off)
+	if off < x.indexer.pos || c.out > x.indexer.pending() {
+		x.indexer.reset(c)
+	}
+	return x.indexer.read(p, off)
+}
+
+// Index file layout, little endian: magic, version, entry crc32, compressed
+// and uncompressed sizes, interval, checkpoint count, then per checkpoint
+// its in and out offsets and zstd compressed window.
+const (
+	zipIndexMagic   = "PEZI"
+	zipIndexVersion = 1
+)
+
+type zipIndexHeader struct {
+	Magic            [4]byte
+	Version          uint32
+	CRC32            uint32
+	CompressedSize   uint64
+	UncompressedSize uint64
+	Interval         uint64
+	Checkpoints      uint32
+}
+
+type zipIndexCheckpoint struct {
+	In, Out   uint64
+	WindowLen uint32
+}
+
+func (x *zipIndex) save(w io.Writer, crc uint32, uncompressed_size uint64) error {
+	bw := bufio.NewWriter(w)
+	hdr := zipIndexHeader{
+		Version:          zipIndexVersion,
+		CRC32:            crc,
+		CompressedSize:   uint64(x.size),
+		UncompressedSize: uncompressed_size,
+		Interval:         uint64(x.interval),
+		Checkpoints:      uint32(len(x.checkpoints)),
+	}
+	copy(hdr.Magic[:], zipIndexMagic)
+	if err := binary.Write(bw, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	for _, c := range x.checkpoints {
+		window, err := zstd.Compress(nil, c.window)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(bw, binary.LittleEndian, &zipIndexCheckpoint{In: uint64(c.in), Out: uint64(c.out), WindowLen: uint32(len(window))})
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(window); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (x *zipIndex) load(r io.Reader, crc uint32, uncompressed_size uint64) error {
+	br := bufio.NewReader(r)
+	var hdr zipIndexHeader
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	if string(hdr.Magic[:]) != zipIndexMagic || hdr.Version != zipIndexVersion {
+		return errors.New("not a zip index")
+	}
+	if hdr.CRC32 != crc || hdr.CompressedSize != uint64(x.size) || hdr.UncompressedSize != uncompressed_size || hdr.Checkpoints == 0 {
+		return ErrZipIndexMismatch
+	}
+	// Checkpoints are at least an interval apart, the counts and lengths
+	// are bounded before allocating them
+	if hdr.Interval == 0 || uint64(hdr.Checkpoints) > hdr.UncompressedSize/hdr.Interval+1 {
+		return fmt.Errorf("zip index of %d checkpoints every %d bytes is corrupt", hdr.Checkpoints, hdr.Interval)
+	}
+	max_window_len := uint32(zstd.CompressBound(deflate.WindowSize))
+
+	checkpoints := make([]deflateCheckpoint, hdr.Checkpoints)
+	for i := range checkpoints {
+		var c zipIndexCheckpoint
+		if err := binary.Read(br, binary.LittleEndian, &c); err != nil {
+			return err
+		}
+		if c.WindowLen == 0 || c.WindowLen > max_window_len {
+			return fmt.Errorf("zip index checkpoint %d is corrupt", i)
+		}
+		compressed := make([]byte, c.WindowLen)
+		if _, err := io.ReadFull(br, compressed); err != nil {
+			return err
+		}
+		// The frame header sizes the output of Decompress, not trusted either
+		window := make([]byte, deflate.WindowSize)
+		n, err := zstd.DecompressInto(window, compressed)
+		if err != nil {
+			return err
+		}
+		window = window[:n]
+		checkpoints[i] = deflateCheckpoint{in: int64(c.In), out: int64(c.Out), window: window}
+		if c.In > uint64(x.size)*8 || c.Out > uncompressed_size ||
+			(i > 0 && checkpoints[i].out <= checkpoints[i-1].out) || (i == 0 && c.Out != 0) {
+			return fmt.Errorf("zip index checkpoint %d is corrupt", i)
+		}
+	}
+
+	x.interval = int64(hdr.Interval)
+	x.checkpoints = checkpoints
+	x.indexer.reset(&x.checkpoints[0])
+	return nil
+}
@@ -0,0 +1,144 @@
+package payload_extract_go_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	payload_extract "github.com/affggh/payload_extract"
+)
+
+// countingReaderAt counts the bytes read from it.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n atomic.Int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// deflatedZip returns a zip holding data as a deflated payload.bin.
+func deflatedZip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("payload.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZipPayloadReaderIndex(t *testing.T) {
+	// Compressible text with incompressible runs, for stored, fixed and
+	// dynamic blocks at any bit offset
+	rng := rand.New(rand.NewSource(1))
+	var data []byte
+	for len(data) < 6<<20 {
+		if rng.Intn(4) == 0 {
+			run := make([]byte, rng.Intn(100<<10))
+			rng.Read(run)
+			data = append(data, run...)
+		} else {
+			for i := rng.Intn(5000); i > 0; i-- {
+				data = append(data, []byte("payload block ")...)
+				data = append(data, byte('a'+rng.Intn(26)))
+			}
+		}
+	}
+	zipped := deflatedZip(t, data)
+
+	src := &countingReaderAt{r: bytes.NewReader(zipped)}
+	zr, err := payload_extract.NewZipPayloadReader(src, int64(len(zipped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !zr.Deflated() {
+		t.Fatal("payload.bin stored")
+	}
+	zr.SetIndexInterval(256 << 10)
+
+	// The first pass indexes
+	got, err := io.ReadAll(io.NewSectionReader(zr, 0, zr.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("first pass differs")
+	}
+
+	checkReads := func(zr *payload_extract.ZipPayloadReader) {
+		t.Helper()
+		for _, off := range []int64{5 << 20, 17, 3<<20 + 12345, int64(len(data)) - 1000, 1 << 20} {
+			buf := make([]byte, 1000)
+			start := src.n.Load()
+			if _, err := io.ReadFull(io.NewSectionReader(zr, off, 1000), buf); err != nil {
+				t.Fatalf("read at %d: %v", off, err)
+			}
+			if !bytes.Equal(buf, data[off:off+1000]) {
+				t.Fatalf("read at %d differs", off)
+			}
+			// At most an interval of data and the reader buffers
+			if read := src.n.Load() - start; read > 1<<20 {
+				t.Errorf("read at %d read %d compressed bytes", off, read)
+			}
+		}
+	}
+	checkReads(zr)
+
+	var index bytes.Buffer
+	if err := zr.SaveIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader with the saved index needs no first pass
+	loaded, err := payload_extract.NewZipPayloadReader(src, int64(len(zipped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.LoadIndex(bytes.NewReader(index.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	checkReads(loaded)
+
+	// Corrupt counts and lengths are refused before they are allocated
+	for name, corrupt := range map[string]func(b []byte){
+		"checkpoints": func(b []byte) { binary.LittleEndian.PutUint32(b[36:], 0xFFFFFFFF) },
+		"interval":    func(b []byte) { binary.LittleEndian.PutUint64(b[28:], 0) },
+		"window":      func(b []byte) { binary.LittleEndian.PutUint32(b[56:], 0xFFFFFFFF) },
+	} {
+		b := bytes.Clone(index.Bytes())
+		corrupt(b)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if err := loaded.LoadIndex(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: corrupt index loaded", name)
+		}
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > 64<<20 {
+			t.Errorf("%s: loading allocated %d bytes", name, n)
+		}
+	}
+
+	other := deflatedZip(t, data[1:])
+	zr, err = payload_extract.NewZipPayloadReader(bytes.NewReader(other), int64(len(other)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zr.LoadIndex(bytes.NewReader(index.Bytes())); !errors.Is(err, payload_extract.ErrZipIndexMismatch) {
+		t.Errorf("LoadIndex err = %v, want ErrZipIndexMismatch", err)
+	}
+}
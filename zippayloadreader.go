@@ -3,125 +3,210 @@ package payload_extract_go
 import (
 	"archive/zip"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 	"sync"
 )
 
+// Idle inflate streams a ZipPayloadReader keeps for reads going on where
+// previous ones stopped
+const maxZipStreams = 8
+
+// ZipPayloadReader reads payload.bin out of an OTA zip. Stored entries are
+// read straight from the zip. Deflated entries are indexed while read the
+// first time, see SetIndexInterval, so later reads inflate at most one index
+// interval before their offset.
+//
+// ReadAt is safe for concurrent use, stored entries are read without
+// locking. Read and Seek share one position.
 type ZipPayloadReader struct {
-	//zr *zip.Reader // zip reader
 	zf *zip.File
-	or io.ReaderAt // origin reader
 
-	dataoff int64 // store method use
+	section *io.SectionReader // store method use
 
-	pos int64
+	// Deflate method use: the index and the indexer reading past it are
+	// serialized, reads before it inflate from a checkpoint concurrently
+	index_mu sync.Mutex
+	index    *zipIndex
 
-	stream       io.ReadCloser
-	streamStart  int64
-	streamOffset int64
+	streams_mu sync.Mutex
+	streams    []*inflater // idle, least recently used first
 
-	mu sync.Mutex
+	pos_mu sync.Mutex
+	pos    int64
 }
 
 func (r *ZipPayloadReader) ReadAt(p []byte, off int64) (int, error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if r.zf.Method == zip.Store { // If zip compress method is Store, jump to offset return data
-		writelen, err := r.or.ReadAt(p, r.dataoff+off)
-		if err != nil {
-			return 0, err
-		}
-		r.pos += int64(writelen)
-		return writelen, err
-	} else {
-		if r.stream == nil || r.streamStart+r.streamOffset != off { // Reuse stream to avoid read save speed
-			if r.stream != nil {
-				r.stream.Close()
-				r.stream = nil
-			}
-			var err error
-			r.stream, err = r.zf.Open()
-			if err != nil {
-				return 0, err
-			}
-
-			io.CopyN(io.Discard, r.stream, off)
-			r.streamStart = off
-			r.streamOffset = 0
-		}
+	if r.section != nil {
+		return r.section.ReadAt(p, off)
+	}
 
-		writelen, err := r.stream.Read(p)
-		if err != nil {
-			return 0, err
-		}
-		r.streamOffset += int64(writelen)
-		r.pos += int64(writelen)
+	if off < 0 {
+		return 0, fmt.Errorf("zip payload: negative offset %d", off)
+	}
+	if off >= r.Size() {
+		return 0, io.EOF
+	}
+	want := len(p)
+	p = p[:min(int64(want), r.Size()-off)]
 
-		return writelen, err
+	n, err := r.inflateAt(p, off)
+	if err == nil && n < want {
+		err = io.EOF
 	}
+	return n, err
 }
 
-func (r *ZipPayloadReader) Read(p []byte) (int, error) {
-	if r.zf.Method == zip.Store { // If zip compress method is Store, jump to offset return data
-		writelen, err := r.or.ReadAt(p, r.dataoff+r.pos)
-		if err != nil {
-			return 0, err
-		}
-		r.pos += int64(writelen)
-		return writelen, err
-	} else {
-		if r.stream == nil || r.streamStart+r.streamOffset != r.pos { // Reuse stream to avoid read save speed
-			if r.stream != nil {
-				r.stream.Close()
-				r.stream = nil
-			}
-			var err error
-			r.stream, err = r.zf.Open()
+// inflateAt fills p with the deflated entry data at off, within the entry.
+func (r *ZipPayloadReader) inflateAt(p []byte, off int64) (int, error) {
+	r.index_mu.Lock()
+	// Reads past the indexed data go on indexing it
+	if r.index.forward(off) {
+		defer r.index_mu.Unlock()
+		n := 0
+		for n < len(p) {
+			read, err := r.index.read(p[n:], off+int64(n))
+			n += read
 			if err != nil {
-				return 0, err
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, err
 			}
-
-			io.CopyN(io.Discard, r.stream, r.pos)
-			r.streamStart = r.pos
-			r.streamOffset = 0
 		}
+		return n, nil
+	}
+	checkpoint := *r.index.checkpoint(off)
+	src, size := r.index.src, r.index.size
+	r.index_mu.Unlock()
 
-		writelen, err := r.stream.Read(p)
+	stream := r.takeStream(off, checkpoint.out)
+	if stream == nil {
+		stream = newInflater(src, size, &checkpoint)
+	}
+	n := 0
+	for n < len(p) {
+		read, err := stream.read(p[n:], off+int64(n))
+		n += read
 		if err != nil {
-			return 0, err
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+	r.putStream(stream)
+	return n, nil
+}
+
+// takeStream returns the idle stream closest before off, if it is past the
+// checkpoint at from.
+func (r *ZipPayloadReader) takeStream(off, from int64) *inflater {
+	r.streams_mu.Lock()
+	defer r.streams_mu.Unlock()
+	best := -1
+	for i, s := range r.streams {
+		if s.pos <= off && s.pos >= from && (best < 0 || s.pos > r.streams[best].pos) {
+			best = i
 		}
-		r.streamOffset += int64(writelen)
-		r.pos += int64(writelen)
+	}
+	if best < 0 {
+		return nil
+	}
+	stream := r.streams[best]
+	r.streams = append(r.streams[:best], r.streams[best+1:]...)
+	return stream
+}
 
-		return writelen, err
+func (r *ZipPayloadReader) putStream(stream *inflater) {
+	r.streams_mu.Lock()
+	defer r.streams_mu.Unlock()
+	r.streams = append(r.streams, stream)
+	if len(r.streams) > maxZipStreams {
+		r.streams = r.streams[1:]
 	}
 }
 
+func (r *ZipPayloadReader) Read(p []byte) (int, error) {
+	r.pos_mu.Lock()
+	defer r.pos_mu.Unlock()
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
 func (r *ZipPayloadReader) Seek(off int64, whence int) (int64, error) {
+	r.pos_mu.Lock()
+	defer r.pos_mu.Unlock()
 	switch whence {
 	case io.SeekStart:
-		r.pos = off
 	case io.SeekCurrent:
-		r.pos += off
+		off += r.pos
 	case io.SeekEnd:
-		r.pos = int64(r.zf.UncompressedSize64) + off
+		off += r.Size()
 	default:
 		return 0, errors.New("unsupported whence")
 	}
+	if off < 0 {
+		return 0, errors.New("seek to a negative position")
+	}
+	r.pos = off
+	return r.pos, nil
+}
 
-	r.pos = min(int64(r.zf.UncompressedSize64-1), r.pos)
+// Deflated reports whether payload.bin is deflated, and read through an
+// index.
+func (r *ZipPayloadReader) Deflated() bool {
+	return r.index != nil
+}
 
-	return r.pos, nil
+// SetIndexInterval sets the uncompressed distance between the checkpoints
+// of the index of deflated entries, 4MiB by default. Each checkpoint keeps
+// 32KiB of data. It applies to the data not indexed yet, intervals below 1
+// are ignored.
+func (r *ZipPayloadReader) SetIndexInterval(interval int64) {
+	if !r.Deflated() || interval <= 0 {
+		return
+	}
+	r.index_mu.Lock()
+	defer r.index_mu.Unlock()
+	r.index.interval = interval
 }
 
-func (r *ZipPayloadReader) Close() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if r.stream != nil {
-		return r.stream.Close()
+// SaveIndex writes the index of deflated payload.bin recorded so far to w,
+// for LoadIndex.
+func (r *ZipPayloadReader) SaveIndex(w io.Writer) error {
+	if !r.Deflated() {
+		return errors.New("stored payload.bin has no index")
+	}
+	r.index_mu.Lock()
+	defer r.index_mu.Unlock()
+	return r.index.save(w, r.zf.CRC32, r.zf.UncompressedSize64)
+}
+
+// LoadIndex replaces the index of deflated payload.bin with the one saved by
+// SaveIndex in rd. Indexes of other entries fail with ErrZipIndexMismatch.
+func (r *ZipPayloadReader) LoadIndex(rd io.Reader) error {
+	if !r.Deflated() {
+		return errors.New("stored payload.bin has no index")
 	}
-	return nil // stub
+	r.index_mu.Lock()
+	defer r.index_mu.Unlock()
+	return r.index.load(rd, r.zf.CRC32, r.zf.UncompressedSize64)
+}
+
+// Size returns the uncompressed size of payload.bin.
+func (r *ZipPayloadReader) Size() int64 {
+	return int64(r.zf.UncompressedSize64)
+}
+
+// Close drops the idle inflate streams.
+func (r *ZipPayloadReader) Close() error {
+	r.streams_mu.Lock()
+	defer r.streams_mu.Unlock()
+	r.streams = nil
+	return nil
 }
 
 func NewZipPayloadReader(reader io.ReaderAt, size int64) (*ZipPayloadReader, error) {
@@ -146,19 +231,17 @@ func NewZipPayloadReader(reader io.ReaderAt, size int64) (*ZipPayloadReader, err
 		return nil, errors.New("could not found payload.bin data offset")
 	}
 
-	Logger.Println("Zip compress method:", func() string {
-		if zf.Method == zip.Store {
-			return "Store"
-		}
-		return "Deflate"
-	}())
-
-	return &ZipPayloadReader{
-		zf:           zf,
-		or:           reader,
-		dataoff:      dataoff,
-		pos:          0,
-		streamStart:  0,
-		streamOffset: 0,
-	}, nil
+	r := &ZipPayloadReader{zf: zf}
+	switch zf.Method {
+	case zip.Store:
+		Logger.Println("Zip compress method:", "Store")
+		r.section = io.NewSectionReader(reader, dataoff, int64(zf.UncompressedSize64))
+	case zip.Deflate:
+		Logger.Println("Zip compress method:", "Deflate")
+		compressed_size := int64(zf.CompressedSize64)
+		r.index = newZipIndex(io.NewSectionReader(reader, dataoff, compressed_size), compressed_size, defaultZipIndexInterval)
+	default:
+		return nil, fmt.Errorf("payload.bin: unsupported zip method %d", zf.Method)
+	}
+	return r, nil
 }
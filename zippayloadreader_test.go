@@ -0,0 +1,103 @@
+package payload_extract_go_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	payload_extract "github.com/affggh/payload_extract"
+)
+
+func storedZip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "payload.bin",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(data)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZipPayloadReader(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	data := make([]byte, 0, 3<<20)
+	for len(data) < 3<<20 {
+		data = append(data, []byte("payload ")...)
+		data = append(data, byte(rng.Intn(256)))
+	}
+
+	for name, zipped := range map[string][]byte{"store": storedZip(t, data), "deflate": deflatedZip(t, data)} {
+		t.Run(name, func(t *testing.T) {
+			open := func() *payload_extract.ZipPayloadReader {
+				zr, err := payload_extract.NewZipPayloadReader(bytes.NewReader(zipped), int64(len(zipped)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				zr.SetIndexInterval(128 << 10)
+				return zr
+			}
+
+			// Read, ReadAt and Seek, up to and past the end
+			zr := open()
+			if err := iotest.TestReader(zr, data); err != nil {
+				t.Error(err)
+			}
+
+			buf := make([]byte, 100)
+			n, err := zr.ReadAt(buf, int64(len(data))-40)
+			if n != 40 || err != io.EOF || !bytes.Equal(buf[:n], data[len(data)-40:]) {
+				t.Errorf("ReadAt at the end = %d, %v", n, err)
+			}
+			if pos, err := zr.Seek(0, io.SeekEnd); pos != int64(len(data)) || err != nil {
+				t.Errorf("Seek to the end = %d, %v", pos, err)
+			}
+			if n, err := zr.Read(buf); n != 0 || err != io.EOF {
+				t.Errorf("Read at the end = %d, %v", n, err)
+			}
+
+			// Parallel workers, on a fresh reader for deflate to index
+			// concurrently
+			zr = open()
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(seed))
+					buf := make([]byte, 64<<10)
+					for i := 0; i < 20; i++ {
+						off := rng.Int63n(int64(len(data) - len(buf)))
+						if _, err := zr.ReadAt(buf, off); err != nil {
+							t.Errorf("ReadAt %d: %v", off, err)
+							return
+						}
+						if !bytes.Equal(buf, data[off:off+int64(len(buf))]) {
+							t.Errorf("ReadAt %d differs", off)
+							return
+						}
+					}
+				}(int64(w))
+			}
+			wg.Wait()
+			if err := zr.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package payload_extract_go
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	zipLocalHeaderSignature = 0x04034b50
+	zipDescriptorSignature  = 0x08074b50
+	zipLocalHeaderLen       = 30
+	zipFlagDescriptor       = 0x8 // sizes and crc follow the data
+	zipMethodStore          = 0
+	zipMethodDeflate        = 8
+	zip64ExtraID            = 0x0001
+)
+
+// Signatures that may follow an entry's data descriptor
+var zipRecordSignatures = [][]byte{
+	[]byte("PK\x03\x04"), // local file header
+	[]byte("PK\x01\x02"), // central directory
+	[]byte("PK\x05\x06"), // end of central directory
+	[]byte("PK\x06\x06"), // zip64 end of central directory
+	[]byte("PK\x06\x08"), // archive extra data
+}
+
+// NewZipStreamPayloadReader reads the OTA zip stream reader up to its
+// payload.bin entry, found through the local file headers, and returns a
+// reader of the uncompressed payload, for OpenStream. Entries before it must
+// be stored with known sizes or deflated.
+func NewZipStreamPayloadReader(reader io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(reader)
+	for {
+		var hdr [zipLocalHeaderLen]byte
+		if _, err := io.ReadFull(br, hdr[:4]); err != nil {
+			return nil, fmt.Errorf("reading zip local header: %w", err)
+		}
+		if binary.LittleEndian.Uint32(hdr[:]) != zipLocalHeaderSignature {
+			// The central directory follows the last entry
+			return nil, errors.New("could not found payload.bin in zip stream")
+		}
+		if _, err := io.ReadFull(br, hdr[4:]); err != nil {
+			return nil, fmt.Errorf("reading zip local header: %w", err)
+		}
+
+		flags := binary.LittleEndian.Uint16(hdr[6:])
+		method := binary.LittleEndian.Uint16(hdr[8:])
+		compressed_size := uint64(binary.LittleEndian.Uint32(hdr[18:]))
+		uncompressed_size := uint64(binary.LittleEndian.Uint32(hdr[22:]))
+		name_extra := make([]byte, int(binary.LittleEndian.Uint16(hdr[26:]))+int(binary.LittleEndian.Uint16(hdr[28:])))
+		if _, err := io.ReadFull(br, name_extra); err != nil {
+			return nil, fmt.Errorf("reading zip local header: %w", err)
+		}
+		name_len := binary.LittleEndian.Uint16(hdr[26:])
+		name := string(name_extra[:name_len])
+		zip64 := zip64Sizes(name_extra[name_len:], &uncompressed_size, &compressed_size)
+		sizes_known := flags&zipFlagDescriptor == 0 || compressed_size != 0
+
+		if strings.HasSuffix(name, "payload.bin") {
+			switch method {
+			case zipMethodStore:
+				Logger.Println("Zip compress method:", "Store")
+				if !sizes_known {
+					// The payload ends itself
+					return br, nil
+				}
+				return io.LimitReader(br, int64(compressed_size)), nil
+			case zipMethodDeflate:
+				Logger.Println("Zip compress method:", "Deflate")
+				return flate.NewReader(br), nil
+			}
+			return nil, fmt.Errorf("payload.bin: unsupported zip method %d", method)
+		}
+
+		// Skip the entry
+		switch {
+		case sizes_known:
+			if _, err := io.CopyN(io.Discard, br, int64(compressed_size)); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		case method == zipMethodDeflate:
+			// The deflate stream ends itself, flate reads no further than
+			// it needs from a bufio.Reader
+			fr := flate.NewReader(br)
+			_, err := io.Copy(io.Discard, fr)
+			fr.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: cannot skip a stored zip entry of unknown size", name)
+		}
+		if flags&zipFlagDescriptor != 0 {
+			if err := skipZipDescriptor(br, zip64); err != nil {
+				return nil, fmt.Errorf("%s: data descriptor: %w", name, err)
+			}
+		}
+	}
+}
+
+// zip64Sizes replaces the sizes saturated in the local header by those of
+// the zip64 extra field, reporting whether there is one.
+func zip64Sizes(extra []byte, uncompressed_size, compressed_size *uint64) bool {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if id == zip64ExtraID {
+			field := extra[:size]
+			for _, value := range []*uint64{uncompressed_size, compressed_size} {
+				if *value == 0xffffffff && len(field) >= 8 {
+					*value = binary.LittleEndian.Uint64(field)
+					field = field[8:]
+				}
+			}
+			return true
+		}
+		extra = extra[size:]
+	}
+	return false
+}
+
+// skipZipDescriptor skips a data descriptor: an optional signature, the crc
+// and both sizes, 8 bytes each for zip64 entries. Writers may use 8 byte
+// sizes without a zip64 extra field, the next record tells.
+func skipZipDescriptor(br *bufio.Reader, zip64 bool) error {
+	head, err := br.Peek(4)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(head) == zipDescriptorSignature {
+		br.Discard(4)
+	}
+	skip := 12
+	if zip64 {
+		skip = 20
+	}
+	if _, err := br.Discard(skip); err != nil {
+		return err
+	}
+	if !zip64 {
+		next, err := br.Peek(4)
+		if err != nil {
+			return err
+		}
+		if !isZipRecord(next) {
+			_, err = br.Discard(8)
+			return err
+		}
+	}
+	return nil
+}
+
+func isZipRecord(signature []byte) bool {
+	for _, record := range zipRecordSignatures {
+		if bytes.Equal(signature, record) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package zucchini
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// Apply applies the ensemble patch data to old and returns the new image.
+func Apply(old []byte, data []byte) ([]byte, error) {
+	p, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return p.Apply(old)
+}
+
+// Apply rebuilds the new image from old, checking both against the sizes and
+// CRC-32s of the header.
+func (p *Patch) Apply(old []byte) ([]byte, error) {
+	if uint64(len(old)) != uint64(p.Header.OldSize) {
+		return nil, fmt.Errorf("zucchini: old image has %d bytes, want %d", len(old), p.Header.OldSize)
+	}
+	if crc := crc32.ChecksumIEEE(old); crc != p.Header.OldCRC {
+		return nil, fmt.Errorf("zucchini: old image crc32 is %08x, want %08x", crc, p.Header.OldCRC)
+	}
+
+	out := make([]byte, p.Header.NewSize)
+	for i, e := range p.Elements {
+		if e.ExeType != ExeTypeNoOp {
+			return nil, fmt.Errorf("element %d: %w %d (%s), only raw elements are patched", i, ErrUnsupported, e.ExeType, exeTypeNames[e.ExeType])
+		}
+		old_region := old[e.OldOffset : e.OldOffset+e.OldLength]
+		new_region := out[e.NewOffset : e.NewOffset+e.NewLength]
+		if err := e.applyEquivalenceAndExtraData(old_region, new_region); err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		if err := e.applyRawDelta(new_region); err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+	}
+
+	if crc := crc32.ChecksumIEEE(out); crc != p.Header.NewCRC {
+		return nil, fmt.Errorf("zucchini: new image crc32 is %08x, want %08x", crc, p.Header.NewCRC)
+	}
+	return out, nil
+}
+
+// applyEquivalenceAndExtraData copies the equivalences from old and fills the
+// gaps between them with extra data.
+func (e *Element) applyEquivalenceAndExtraData(old, out []byte) error {
+	extra := e.extraData
+	equivalences := e.equivalences()
+	dst := uint64(0)
+	for {
+		eq, ok, err := equivalences.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if eq.dstOffset < dst || eq.dstOffset-dst > uint64(len(extra)) {
+			return fmt.Errorf("%w: overlapping equivalences", ErrCorrupt)
+		}
+		gap := eq.dstOffset - dst
+		dst += uint64(copy(out[dst:eq.dstOffset], extra[:gap]))
+		extra = extra[gap:]
+		dst += uint64(copy(out[dst:dst+eq.length], old[eq.srcOffset:eq.srcOffset+eq.length]))
+	}
+	copy(out[dst:], extra)
+	return nil
+}
+
+// applyRawDelta adds the byte diffs of the raw delta to the equivalence bytes
+// they apply to, walking both in lockstep.
+func (e *Element) applyRawDelta(out []byte) error {
+	equivalences := e.equivalences()
+	eq, ok, err := equivalences.next()
+	if err != nil {
+		return err
+	}
+
+	skip, diffs := e.rawDeltaSkip, e.rawDeltaDiff
+	base_copy_offset := uint64(0)
+	compensation := uint64(0)
+	for len(skip) > 0 && len(diffs) > 0 {
+		copy_offset_diff, valid := decodeVarUint(&skip)
+		diff := int8(diffs[0])
+		diffs = diffs[1:]
+		if !valid || diff == 0 {
+			return fmt.Errorf("%w: bad raw delta", ErrCorrupt)
+		}
+		copy_offset := uint64(copy_offset_diff) + compensation
+		compensation = copy_offset + 1
+
+		for ok && base_copy_offset+eq.length <= copy_offset {
+			base_copy_offset += eq.length
+			if eq, ok, err = equivalences.next(); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%w: raw delta past the equivalences", ErrCorrupt)
+		}
+		out[eq.dstOffset-base_copy_offset+copy_offset] += byte(diff)
+	}
+	if len(skip) != 0 || len(diffs) != 0 {
+		return fmt.Errorf("%w: unterminated raw delta", ErrCorrupt)
+	}
+	return nil
+}
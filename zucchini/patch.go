@@ -0,0 +1,328 @@
+// Package zucchini applies Zucchini ensemble patches, as used by the ZUCCHINI
+// operation of incremental payloads.
+//
+// Only raw (no-op executable type) elements are supported: they are rebuilt
+// from the equivalences, extra data and raw delta of the patch. Elements of
+// the ELF, DEX and PE types additionally need their references corrected by
+// the matching disassembler, which is not implemented; patches containing them
+// are rejected with ErrUnsupported.
+package zucchini
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Magic of the patch header, "Zucc"
+const magic = 'Z' | 'u'<<8 | 'c'<<16 | 'c'<<24
+
+const (
+	majorVersion = 1
+
+	patchHeaderSize   = 24
+	elementHeaderSize = 22
+
+	// Bound of the element count, like Zucchini's kElementCountBound
+	maxElements = 1 << 16
+)
+
+// Executable types of an element
+const (
+	ExeTypeNoOp       = 0
+	ExeTypeWin32X86   = 1
+	ExeTypeWin32X64   = 2
+	ExeTypeElfX86     = 3
+	ExeTypeElfX64     = 4
+	ExeTypeElfAArch32 = 5
+	ExeTypeElfAArch64 = 6
+	ExeTypeDex        = 7
+	ExeTypeZtf        = 8
+)
+
+// Names of the executable types, for errors
+var exeTypeNames = map[uint32]string{
+	ExeTypeNoOp:       "raw",
+	ExeTypeWin32X86:   "PE x86",
+	ExeTypeWin32X64:   "PE x64",
+	ExeTypeElfX86:     "ELF x86",
+	ExeTypeElfX64:     "ELF x64",
+	ExeTypeElfAArch32: "ELF AArch32",
+	ExeTypeElfAArch64: "ELF AArch64",
+	ExeTypeDex:        "DEX",
+	ExeTypeZtf:        "ZTF",
+}
+
+var (
+	// ErrCorrupt is returned for malformed patches.
+	ErrCorrupt = errors.New("zucchini: corrupt patch")
+	// ErrUnsupported is returned for elements needing a disassembler.
+	ErrUnsupported = errors.New("zucchini: unsupported element type")
+)
+
+// Header is the header of an ensemble patch.
+type Header struct {
+	MajorVersion uint16
+	MinorVersion uint16
+	OldSize      uint32
+	OldCRC       uint32
+	NewSize      uint32
+	NewCRC       uint32
+}
+
+// Element is the patch of one region of the old and new images.
+type Element struct {
+	OldOffset, OldLength uint32
+	NewOffset, NewLength uint32
+	ExeType              uint32
+	Version              uint16
+
+	// Equivalences: src_skip (varint), dst_skip and copy_count (varuint)
+	srcSkip, dstSkip, copyCount []byte
+	extraData                   []byte
+	// Raw delta: copy offset skips (varuint) and byte diffs
+	rawDeltaSkip, rawDeltaDiff []byte
+	referenceDelta             []byte
+	extraTargets               map[uint8][]byte
+}
+
+// Patch is a parsed ensemble patch.
+type Patch struct {
+	Header   Header
+	Elements []*Element
+}
+
+// bufferSource reads the little endian fields of a patch.
+type bufferSource struct {
+	data []byte
+}
+
+func (s *bufferSource) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(s.data) {
+		return nil, ErrCorrupt
+	}
+	b := s.data[:n]
+	s.data = s.data[n:]
+	return b, nil
+}
+
+func (s *bufferSource) u8() (uint8, error) {
+	b, err := s.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (s *bufferSource) u32() (uint32, error) {
+	b, err := s.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// buffer reads a u32 length prefixed buffer.
+func (s *bufferSource) buffer() ([]byte, error) {
+	n, err := s.u32()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) > uint64(len(s.data)) {
+		return nil, ErrCorrupt
+	}
+	return s.bytes(int(n))
+}
+
+// NewSize returns the size of the new image of the ensemble patch data.
+func NewSize(data []byte) (int64, error) {
+	if len(data) < patchHeaderSize || binary.LittleEndian.Uint32(data) != magic {
+		return 0, fmt.Errorf("%w: bad header", ErrCorrupt)
+	}
+	return int64(binary.LittleEndian.Uint32(data[16:])), nil
+}
+
+// Parse decodes an ensemble patch.
+func Parse(data []byte) (*Patch, error) {
+	s := &bufferSource{data: data}
+
+	b, err := s.bytes(patchHeaderSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: short header", ErrCorrupt)
+	}
+	if binary.LittleEndian.Uint32(b) != magic {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	p := &Patch{Header: Header{
+		MajorVersion: binary.LittleEndian.Uint16(b[4:]),
+		MinorVersion: binary.LittleEndian.Uint16(b[6:]),
+		OldSize:      binary.LittleEndian.Uint32(b[8:]),
+		OldCRC:       binary.LittleEndian.Uint32(b[12:]),
+		NewSize:      binary.LittleEndian.Uint32(b[16:]),
+		NewCRC:       binary.LittleEndian.Uint32(b[20:]),
+	}}
+	if p.Header.MajorVersion != majorVersion {
+		return nil, fmt.Errorf("zucchini: unsupported patch version %d.%d", p.Header.MajorVersion, p.Header.MinorVersion)
+	}
+
+	count, err := s.u32()
+	if err != nil {
+		return nil, err
+	}
+	if count > maxElements {
+		return nil, fmt.Errorf("%w: %d elements", ErrCorrupt, count)
+	}
+	for i := uint32(0); i < count; i++ {
+		e, err := parseElement(s)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		if uint64(e.OldOffset)+uint64(e.OldLength) > uint64(p.Header.OldSize) ||
+			uint64(e.NewOffset)+uint64(e.NewLength) > uint64(p.Header.NewSize) {
+			return nil, fmt.Errorf("%w: element %d out of the image bounds", ErrCorrupt, i)
+		}
+		p.Elements = append(p.Elements, e)
+	}
+	if len(s.data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrCorrupt, len(s.data))
+	}
+	return p, nil
+}
+
+func parseElement(s *bufferSource) (*Element, error) {
+	b, err := s.bytes(elementHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	e := &Element{
+		OldOffset: binary.LittleEndian.Uint32(b[0:]),
+		OldLength: binary.LittleEndian.Uint32(b[4:]),
+		NewOffset: binary.LittleEndian.Uint32(b[8:]),
+		NewLength: binary.LittleEndian.Uint32(b[12:]),
+		ExeType:   binary.LittleEndian.Uint32(b[16:]),
+		Version:   binary.LittleEndian.Uint16(b[20:]),
+	}
+
+	for _, buf := range []*[]byte{
+		&e.srcSkip, &e.dstSkip, &e.copyCount,
+		&e.extraData,
+		&e.rawDeltaSkip, &e.rawDeltaDiff,
+		&e.referenceDelta,
+	} {
+		if *buf, err = s.buffer(); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+
+	pools, err := s.u32()
+	if err != nil {
+		return nil, err
+	}
+	e.extraTargets = make(map[uint8][]byte)
+	for i := uint32(0); i < pools; i++ {
+		tag, err := s.u8()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := e.extraTargets[tag]; ok || tag == 0xFF {
+			return nil, fmt.Errorf("%w: bad pool tag %d", ErrCorrupt, tag)
+		}
+		if e.extraTargets[tag], err = s.buffer(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// validate checks that the equivalences are ordered, within the element and
+// leave exactly the extra data uncovered.
+func (e *Element) validate() error {
+	equivalences := e.equivalences()
+	total := uint64(0)
+	prev_dst_end := uint64(0)
+	for {
+		eq, ok, err := equivalences.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if eq.srcOffset+eq.length > uint64(e.OldLength) || eq.dstOffset+eq.length > uint64(e.NewLength) {
+			return fmt.Errorf("%w: out of bounds equivalence", ErrCorrupt)
+		}
+		if prev_dst_end > eq.dstOffset+eq.length {
+			return fmt.Errorf("%w: out of order equivalence", ErrCorrupt)
+		}
+		prev_dst_end = eq.dstOffset + eq.length
+		total += eq.length
+	}
+	if total > uint64(e.NewLength) || uint64(e.NewLength)-total != uint64(len(e.extraData)) {
+		return fmt.Errorf("%w: incorrect amount of extra data", ErrCorrupt)
+	}
+	return nil
+}
+
+// decodeVarUint decodes a LEB128 unsigned value of at most 32 bits.
+func decodeVarUint(b *[]byte) (uint32, bool) {
+	var v uint32
+	for i := 0; i < 5 && i < len(*b); i++ {
+		c := (*b)[i]
+		if i == 4 && c > 0x0F {
+			return 0, false
+		}
+		v |= uint32(c&0x7F) << (7 * i)
+		if c&0x80 == 0 {
+			*b = (*b)[i+1:]
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// decodeVarInt decodes a zigzag encoded signed value.
+func decodeVarInt(b *[]byte) (int32, bool) {
+	u, ok := decodeVarUint(b)
+	return int32(u>>1) ^ -int32(u&1), ok
+}
+
+type equivalence struct {
+	srcOffset, dstOffset, length uint64
+}
+
+// equivalenceSource iterates the delta encoded equivalences of an element.
+type equivalenceSource struct {
+	srcSkip, dstSkip, copyCount []byte
+	prevSrc, prevDst            int64
+}
+
+func (e *Element) equivalences() *equivalenceSource {
+	return &equivalenceSource{srcSkip: e.srcSkip, dstSkip: e.dstSkip, copyCount: e.copyCount}
+}
+
+func (s *equivalenceSource) next() (equivalence, bool, error) {
+	if len(s.srcSkip) == 0 || len(s.dstSkip) == 0 || len(s.copyCount) == 0 {
+		if len(s.srcSkip)+len(s.dstSkip)+len(s.copyCount) != 0 {
+			return equivalence{}, false, fmt.Errorf("%w: unterminated equivalences", ErrCorrupt)
+		}
+		return equivalence{}, false, nil
+	}
+
+	length, ok1 := decodeVarUint(&s.copyCount)
+	src_diff, ok2 := decodeVarInt(&s.srcSkip)
+	dst_diff, ok3 := decodeVarUint(&s.dstSkip)
+	if !ok1 || !ok2 || !ok3 {
+		return equivalence{}, false, fmt.Errorf("%w: bad equivalence", ErrCorrupt)
+	}
+
+	src := s.prevSrc + int64(src_diff)
+	dst := s.prevDst + int64(dst_diff)
+	if src < 0 || src > 0xFFFFFFFF || dst > 0xFFFFFFFF {
+		return equivalence{}, false, fmt.Errorf("%w: equivalence offset overflow", ErrCorrupt)
+	}
+	s.prevSrc, s.prevDst = src+int64(length), dst+int64(length)
+	return equivalence{srcOffset: uint64(src), dstOffset: uint64(dst), length: uint64(length)}, true, nil
+}
@@ -0,0 +1,129 @@
+package zucchini_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/affggh/payload_extract/zucchini"
+)
+
+type equivalence struct {
+	src, dst, length int
+}
+
+type rawDelta struct {
+	offset int // in the concatenated equivalence bytes
+	diff   int8
+}
+
+func varUint(b []byte, v uint32) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func varInt(b []byte, v int32) []byte {
+	return varUint(b, uint32(v<<1^v>>31))
+}
+
+func buffer(b []byte, data []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// element encodes a raw element turning old into new with the given
+// equivalences, taking the extra data from new and applying raw deltas.
+func element(old, new []byte, exeType uint32, eqs []equivalence, deltas []rawDelta) []byte {
+	var srcSkip, dstSkip, copyCount, extra, deltaSkip, deltaDiff []byte
+	prevSrc, prevDst := 0, 0
+	for _, eq := range eqs {
+		extra = append(extra, new[prevDst:eq.dst]...)
+		srcSkip = varInt(srcSkip, int32(eq.src-prevSrc))
+		dstSkip = varUint(dstSkip, uint32(eq.dst-prevDst))
+		copyCount = varUint(copyCount, uint32(eq.length))
+		prevSrc, prevDst = eq.src+eq.length, eq.dst+eq.length
+	}
+	extra = append(extra, new[prevDst:]...)
+
+	compensation := 0
+	for _, d := range deltas {
+		deltaSkip = varUint(deltaSkip, uint32(d.offset-compensation))
+		deltaDiff = append(deltaDiff, byte(d.diff))
+		compensation = d.offset + 1
+	}
+
+	var e []byte
+	for _, v := range []uint32{0, uint32(len(old)), 0, uint32(len(new)), exeType} {
+		e = binary.LittleEndian.AppendUint32(e, v)
+	}
+	e = binary.LittleEndian.AppendUint16(e, 1)
+	for _, buf := range [][]byte{srcSkip, dstSkip, copyCount, extra, deltaSkip, deltaDiff, nil} {
+		e = buffer(e, buf)
+	}
+	return binary.LittleEndian.AppendUint32(e, 0) // pool count
+}
+
+func patch(old, new []byte, elements ...[]byte) []byte {
+	var p []byte
+	p = append(p, "Zucc"...)
+	p = binary.LittleEndian.AppendUint16(p, 1)
+	p = binary.LittleEndian.AppendUint16(p, 0)
+	for _, v := range []uint32{uint32(len(old)), crc32.ChecksumIEEE(old), uint32(len(new)), crc32.ChecksumIEEE(new)} {
+		p = binary.LittleEndian.AppendUint32(p, v)
+	}
+	p = binary.LittleEndian.AppendUint32(p, uint32(len(elements)))
+	for _, e := range elements {
+		p = append(p, e...)
+	}
+	return p
+}
+
+func TestApply(t *testing.T) {
+	old := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	// "ghijk" with k-1, "new", "0123", "uvwxyz" with u+2
+	want := []byte("ghijjnew0123wvwxyz")
+
+	eqs := []equivalence{
+		{src: 16, dst: 0, length: 5},
+		{src: 0, dst: 8, length: 4},
+		{src: 30, dst: 12, length: 6},
+	}
+	// Equivalence bytes are numbered 0-4, 5-8 and 9-14
+	deltas := []rawDelta{{offset: 4, diff: -1}, {offset: 9, diff: 2}}
+	// The raw delta is applied to new, copy equivalence bytes unchanged
+	base := []byte("ghijknew0123uvwxyz")
+
+	p := patch(old, want, element(old, base, zucchini.ExeTypeNoOp, eqs, deltas))
+	got, err := zucchini.Apply(old, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Wrong old image
+	if _, err := zucchini.Apply([]byte("0123456789abcdefghijklmnopqrstuvwxyZ"), p); err == nil {
+		t.Error("expected old crc mismatch")
+	}
+
+	// Elements needing a disassembler
+	p = patch(old, want, element(old, base, zucchini.ExeTypeElfAArch64, eqs, deltas))
+	if _, err := zucchini.Apply(old, p); !errors.Is(err, zucchini.ErrUnsupported) {
+		t.Errorf("err = %v, want ErrUnsupported", err)
+	} else if !strings.Contains(err.Error(), "ELF AArch64") {
+		t.Errorf("err = %v does not name the element type", err)
+	}
+
+	// Equivalence past the old image
+	bad := element(old, base, zucchini.ExeTypeNoOp, []equivalence{{src: 34, dst: 0, length: 5}}, nil)
+	if _, err := zucchini.Apply(old, patch(old, want, bad)); !errors.Is(err, zucchini.ErrCorrupt) {
+		t.Errorf("err = %v, want ErrCorrupt", err)
+	}
+}